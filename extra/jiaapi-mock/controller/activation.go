@@ -89,3 +89,21 @@ func (c *ActivationController) PostActivate(ctx echo.Context) error {
 
 	return ctx.JSON(http.StatusAccepted, isuState)
 }
+
+func (c *ActivationController) PostDeactivate(ctx echo.Context) error {
+	req := &ActivationRequest{}
+	err := ctx.Bind(req)
+	if err != nil {
+		ctx.Logger().Errorf("failed to bind: %v", err)
+		return ctx.String(http.StatusBadRequest, "Bad Request")
+	}
+
+	if _, ok := validIsu[req.IsuUUID]; !ok {
+		ctx.Logger().Errorf("bad isu_uuid: %v", req.IsuUUID)
+		return ctx.String(http.StatusNotFound, "Bad isu_uuid")
+	}
+
+	c.isuConditionPosterManager.StopPosting(req.IsuUUID)
+
+	return ctx.NoContent(http.StatusAccepted)
+}
@@ -39,6 +39,7 @@ func main() {
 	// APIs
 	e.POST("/api/auth", authController.PostAuth)
 	e.POST("/api/activate", activationController.PostActivate)
+	e.POST("/api/deactivate", activationController.PostDeactivate)
 
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("JIAAPI_SERVER_PORT", "5000"))
@@ -31,3 +31,12 @@ func (m *IsuConditionPosterManager) StartPosting(targetURL *url.URL, isuUUID str
 	}
 	return nil
 }
+
+func (m *IsuConditionPosterManager) StopPosting(isuUUID string) {
+	m.activatedIsuMtx.Lock()
+	defer m.activatedIsuMtx.Unlock()
+	if isu, ok := m.activatedIsu[isuUUID]; ok {
+		isu.StopPosting()
+		delete(m.activatedIsu, isuUUID)
+	}
+}
@@ -0,0 +1,28 @@
+// ビルドしたファイルの .br と .gz を作る
+// webapp/go はこれらをそのまま Content-Encoding 付きで返す
+const fs = require('fs')
+const path = require('path')
+const zlib = require('zlib')
+
+const compressible = /\.(html|js|css|svg|json|txt)$/
+const minSize = 256
+
+const walk = dir =>
+  fs.readdirSync(dir, { withFileTypes: true }).flatMap(entry => {
+    const p = path.join(dir, entry.name)
+    return entry.isDirectory() ? walk(p) : [p]
+  })
+
+const outDir = process.argv[2]
+for (const file of walk(outDir)) {
+  if (!compressible.test(file)) continue
+  const data = fs.readFileSync(file)
+  if (data.length < minSize) continue
+  fs.writeFileSync(
+    `${file}.br`,
+    zlib.brotliCompressSync(data, {
+      params: { [zlib.constants.BROTLI_PARAM_QUALITY]: 11 }
+    })
+  )
+  fs.writeFileSync(`${file}.gz`, zlib.gzipSync(data, { level: 9 }))
+}
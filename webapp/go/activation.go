@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	activationStatusPending = "pending_activation"
+	activationStatusActive  = "active"
+	activationStatusFailed  = "failed"
+
+	isuActivationModeSync  = "sync"
+	isuActivationModeAsync = "async"
+
+	auditActionActivateIsu = "activate_isu"
+
+	activationWorkerInterval = time.Second
+	activationBatchSize      = 20
+	activationMaxAttempts    = 10
+	activationRetryBaseDelay = time.Second * 5
+	activationRetryMaxDelay  = time.Minute * 5
+	activationLease          = time.Minute // 処理中のISUを他のアプリケーションサーバーが重複して処理しないための猶予
+	activationErrorMaxLength = 1024
+	// 同期的な activate の途中でアプリケーションサーバーが止まり，取り残された登録を消すまでの時間
+	abandonedRegistrationTimeout  = time.Minute * 10
+	abandonedRegistrationInterval = time.Minute
+	abandonedRegistrationBatch    = 100
+)
+
+var (
+	isuActivationMode = isuActivationModeSync
+
+	// 新しく登録されたISUをすぐに処理するようワーカーに知らせる
+	activationWakeup = make(chan struct{}, 1)
+)
+
+// ISUのactivateの状況
+// 行が存在しないISUは同期的にactivateされるISUで，`character` が空の間は activate の途中とみなす
+type IsuActivation struct {
+	JIAIsuUUID    string         `db:"jia_isu_uuid"`
+	Status        string         `db:"status"`
+	Attempts      int            `db:"attempts"`
+	LastError     sql.NullString `db:"last_error"`
+	NextAttemptAt time.Time      `db:"next_attempt_at"`
+	CreatedAt     time.Time      `db:"created_at"`
+	UpdatedAt     time.Time      `db:"updated_at"`
+}
+
+type PostIsuResponse struct {
+	Isu
+	ActivationStatus string  `json:"activation_status"`
+	ActivationError  *string `json:"activation_error"`
+}
+
+// レスポンスに含めるactivateの状況と最後のエラー
+// character はISUの `character` で，行が存在しない場合に使う
+func (ia *IsuActivation) state(character string) (string, *string) {
+	if ia == nil {
+		if character == "" {
+			return activationStatusPending, nil
+		}
+		return activationStatusActive, nil
+	}
+	if !ia.LastError.Valid {
+		return ia.Status, nil
+	}
+	lastError := ia.LastError.String
+	return ia.Status, &lastError
+}
+
+// ユーザーの所有するISUのactivateの状況を取得
+func getIsuActivationsByUser(db *sqlx.DB, jiaUserID string) (map[string]*IsuActivation, error) {
+	activations := []*IsuActivation{}
+	err := db.Select(&activations,
+		"SELECT ia.* FROM `isu_activation` ia INNER JOIN `isu` i ON ia.`jia_isu_uuid` = i.`jia_isu_uuid`"+
+			"	WHERE i.`jia_user_id` = ?",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := make(map[string]*IsuActivation, len(activations))
+	for _, activation := range activations {
+		res[activation.JIAIsuUUID] = activation
+	}
+	return res, nil
+}
+
+// ISUのactivateの状況を取得
+func getIsuActivation(q sqlx.Queryer, jiaIsuUUID string) (*IsuActivation, error) {
+	var activation IsuActivation
+	err := sqlx.Get(q, &activation, "SELECT * FROM `isu_activation` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return &activation, nil
+}
+
+// activate を待つISUとして登録する
+func insertPendingIsuActivation(tx *sqlx.Tx, jiaIsuUUID string, now time.Time) error {
+	_, err := tx.Exec(
+		"INSERT INTO `isu_activation` (`jia_isu_uuid`, `status`, `next_attempt_at`) VALUES (?, ?, ?)",
+		jiaIsuUUID, activationStatusPending, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// ISUが activate されたことを記録する
+// 非同期の activate を経ていないISUには行がないので何もしない
+func markIsuActivated(db sqlx.Execer, jiaIsuUUID string) error {
+	_, err := db.Exec(
+		"UPDATE `isu_activation` SET `status` = ?, `last_error` = NULL WHERE `jia_isu_uuid` = ?",
+		activationStatusActive, jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// ワーカーに新しいISUが登録されたことを知らせる
+func notifyActivationWorker() {
+	select {
+	case activationWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// 再試行までの待ち時間
+func activationRetryDelay(attempts int) time.Duration {
+	delay := activationRetryBaseDelay
+	for i := 1; i < attempts && delay < activationRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > activationRetryMaxDelay {
+		delay = activationRetryMaxDelay
+	}
+	return delay
+}
+
+// 再試行しても成功しない失敗か
+// JIAが 4xx を返した場合は，ISUが存在しない等の理由なので諦める
+func isPermanentActivationError(err error) bool {
+	var jiaErr *jiaServiceError
+	return errors.As(err, &jiaErr) && jiaErr.StatusCode >= 400 && jiaErr.StatusCode < 500 && !jiaErr.temporary()
+}
+
+// 期限の来た activate 待ちのISUを処理する
+func processPendingActivations(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	jiaIsuUUIDs := []string{}
+	err := db.Select(&jiaIsuUUIDs,
+		"SELECT `jia_isu_uuid` FROM `isu_activation` WHERE `status` = ? AND `next_attempt_at` <= ?"+
+			"	ORDER BY `next_attempt_at` LIMIT ?",
+		activationStatusPending, now, activationBatchSize)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		err = processPendingActivation(ctx, db, jiaIsuUUID, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func processPendingActivation(ctx context.Context, db *sqlx.DB, jiaIsuUUID string, now time.Time) error {
+	// 複数のアプリケーションサーバーで同時に処理しないよう，期限を延ばせた場合のみ処理する
+	result, err := db.Exec(
+		"UPDATE `isu_activation` SET `next_attempt_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ? AND `next_attempt_at` <= ?",
+		now.Add(activationLease), jiaIsuUUID, activationStatusPending, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	isuFromJIA, activateErr := jiaAPIClient.Activate(ctx, getJIAServiceURL(db), jiaIsuUUID)
+	if activateErr != nil {
+		return recordActivationFailure(db, jiaIsuUUID, activateErr, time.Now())
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec(
+		"UPDATE `isu_activation` SET `status` = ?, `attempts` = `attempts` + 1, `last_error` = NULL WHERE `jia_isu_uuid` = ?",
+		activationStatusActive, jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	err = insertActivationAuditLog(tx, jiaIsuUUID, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// activate の失敗を記録し，再試行の予定を立てる
+// 回数の上限に達したか，再試行しても成功しない失敗の場合は failed にする
+func recordActivationFailure(db *sqlx.DB, jiaIsuUUID string, activateErr error, now time.Time) error {
+	activation, err := getIsuActivation(db, jiaIsuUUID)
+	if err != nil {
+		return err
+	}
+	if activation == nil {
+		return nil
+	}
+
+	attempts := activation.Attempts
+	// サーキットブレーカーが開いている間は JIA に問い合わせていないので回数に数えない
+	if !errors.Is(activateErr, errJIACircuitOpen) {
+		attempts++
+	}
+	status := activationStatusPending
+	if attempts >= activationMaxAttempts || isPermanentActivationError(activateErr) {
+		status = activationStatusFailed
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE `isu_activation` SET `status` = ?, `attempts` = ?, `last_error` = ?, `next_attempt_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		status, attempts, truncateAuditValue(activateErr.Error(), activationErrorMaxLength), now.Add(activationRetryDelay(attempts)),
+		jiaIsuUUID, activationStatusPending)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	// 再試行する失敗は記録せず，諦めたときだけ記録する
+	if status == activationStatusFailed && affected > 0 {
+		err = insertActivationAuditLog(tx, jiaIsuUUID, activateErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 非同期の activate の結果を，ISUの所有者の操作として操作履歴に記録する
+// ステータスコードは同期的な activate でクライアントに返すものと同じにする
+// 処理の間にISUが削除されていれば記録しない
+func insertActivationAuditLog(tx *sqlx.Tx, jiaIsuUUID string, activateErr error) error {
+	var jiaUserID string
+	err := tx.Get(&jiaUserID, "SELECT `jia_user_id` FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	a := AuditLog{
+		Action:     auditActionActivateIsu,
+		Actor:      jiaUserID,
+		JIAIsuUUID: jiaIsuUUID,
+		Result:     auditResultSuccess,
+		StatusCode: http.StatusCreated,
+	}
+	if activateErr != nil {
+		a.Result = auditResultFailure
+		a.StatusCode = jiaErrorStatusCode(activateErr)
+		a.Detail = truncateAuditValue(activateErr.Error(), activationErrorMaxLength)
+	}
+	return insertAuditLog(tx, a)
+}
+
+// 同期的な activate の途中で取り残された登録を消す
+// 失敗した場合は登録時に消しているので，ここで消すのはアプリケーションサーバーが途中で止まったものだけ
+func deleteAbandonedRegistrations(db *sqlx.DB, now time.Time) error {
+	isus := []Isu{}
+	err := db.Select(&isus,
+		"SELECT i.`jia_user_id`, i.`jia_isu_uuid` FROM `isu` i"+
+			"	LEFT JOIN `isu_activation` ia ON i.`jia_isu_uuid` = ia.`jia_isu_uuid`"+
+			"	WHERE i.`character` = '' AND ia.`jia_isu_uuid` IS NULL AND i.`created_at` < ?"+
+			"	LIMIT ?",
+		now.Add(-abandonedRegistrationTimeout), abandonedRegistrationBatch)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, isu := range isus {
+		err = deleteUnactivatedIsu(isu.JIAUserID, isu.JIAIsuUUID)
+		if err != nil {
+			return err
+		}
+		log.Warnf("deleted abandoned registration of isu %v", isu.JIAIsuUUID)
+	}
+	return nil
+}
+
+// activate 待ちのISUを定期的に処理する
+func runActivationWorker(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cleanupTicker := time.NewTicker(abandonedRegistrationInterval)
+	defer cleanupTicker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-activationWakeup:
+		case <-cleanupTicker.C:
+			if err := deleteAbandonedRegistrations(db, time.Now()); err != nil {
+				log.Errorf("failed to delete abandoned registrations: %v", err)
+			}
+			continue
+		}
+		if err := processPendingActivations(context.Background(), db, time.Now()); err != nil {
+			log.Errorf("failed to process pending activations: %v", err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	adminActor = "admin"
+
+	auditActionAdminReactivateIsu        = "admin_reactivate_isu"
+	auditActionAdminUpdateJIAService     = "admin_update_jia_service_url"
+	auditActionAdminDisableUser          = "admin_disable_user"
+	auditActionAdminEnableUser           = "admin_enable_user"
+	auditActionAdminUpdateScoringProfile = "admin_update_scoring_profile"
+	adminListDefaultLimit                = 50
+	adminListMaxLimit                    = 500
+	adminIsuStatsRecentConditionRange    = time.Hour * 24
+)
+
+var (
+	adminAPIToken string // 運用者向けAPIの認証に使うトークン．空の場合は運用者向けAPIを無効にする
+)
+
+type AdminUser struct {
+	JIAUserID  string       `db:"jia_user_id"`
+	CreatedAt  time.Time    `db:"created_at"`
+	DisabledAt sql.NullTime `db:"disabled_at"`
+	IsuCount   int          `db:"isu_count"`
+}
+
+type AdminUserResponse struct {
+	JIAUserID  string `json:"jia_user_id"`
+	CreatedAt  int64  `json:"created_at"`
+	DisabledAt *int64 `json:"disabled_at"`
+	IsuCount   int    `json:"isu_count"`
+}
+
+type AdminIsuResponse struct {
+	ID         int    `json:"id"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Name       string `json:"name"`
+	Character  string `json:"character"`
+	JIAUserID  string `json:"jia_user_id"`
+	CreatedAt  int64  `json:"created_at"`
+}
+
+type AdminIsuStatsResponse struct {
+	JIAIsuUUID               string `json:"jia_isu_uuid"`
+	JIAUserID                string `json:"jia_user_id"`
+	ConditionCount           int    `json:"condition_count"`
+	RecentConditionCount     int    `json:"recent_condition_count"`
+	FirstConditionTimestamp  *int64 `json:"first_condition_timestamp"`
+	LatestConditionTimestamp *int64 `json:"latest_condition_timestamp"`
+	LastIngestedAt           *int64 `json:"last_ingested_at"`
+	Connectivity             string `json:"connectivity"`
+}
+
+type PutJIAServiceURLRequest struct {
+	URL string `json:"url"`
+}
+
+func nullTimeToUnix(t sql.NullTime) *int64 {
+	if !t.Valid {
+		return nil
+	}
+	unix := t.Time.Unix()
+	return &unix
+}
+
+// 運用者向けAPIのトークンを確認
+func checkAdminToken(c echo.Context) (int, error) {
+	if adminAPIToken == "" {
+		return http.StatusNotFound, fmt.Errorf("not found")
+	}
+
+	token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminAPIToken)) != 1 {
+		return http.StatusUnauthorized, fmt.Errorf("unauthorized")
+	}
+	return 0, nil
+}
+
+// 運用者向けAPIの認証を行うミドルウェア
+// 利用者のセッションとは別の資格情報として，Authorizationヘッダーのトークンを検証する
+func adminAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if errStatusCode, err := checkAdminToken(c); err != nil {
+			return c.String(errStatusCode, err.Error())
+		}
+
+		c.Set(auditContextActor, adminActor)
+		return next(c)
+	}
+}
+
+// 一覧の取得範囲をクエリパラメータから取得
+func parseAdminListRange(c echo.Context) (int, int, error) {
+	limit := adminListDefaultLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > adminListMaxLimit {
+			return 0, 0, fmt.Errorf("bad format: limit")
+		}
+	}
+
+	offset := 0
+	if offsetStr := c.QueryParam("offset"); offsetStr != "" {
+		var err error
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("bad format: offset")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+func likeContains(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + replacer.Replace(s) + "%"
+}
+
+// GET /api/admin/user
+// 全ユーザーを検索
+func getAdminUsers(c echo.Context) error {
+	limit, offset, err := parseAdminListRange(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	query := "SELECT u.`jia_user_id`, u.`created_at`, d.`disabled_at`, COUNT(i.`id`) AS `isu_count`" +
+		"	FROM `user` u LEFT JOIN `user_disabled` d ON u.`jia_user_id` = d.`jia_user_id`" +
+		"	LEFT JOIN `isu` i ON u.`jia_user_id` = i.`jia_user_id`"
+	args := []interface{}{}
+	if q := c.QueryParam("q"); q != "" {
+		query += " WHERE u.`jia_user_id` LIKE ?"
+		args = append(args, likeContains(q))
+	}
+	query += " GROUP BY u.`jia_user_id`, d.`disabled_at` ORDER BY u.`jia_user_id` LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	users := []AdminUser{}
+	err = db.Select(&users, query, args...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []AdminUserResponse{}
+	for _, user := range users {
+		res = append(res, AdminUserResponse{
+			JIAUserID:  user.JIAUserID,
+			CreatedAt:  user.CreatedAt.Unix(),
+			DisabledAt: nullTimeToUnix(user.DisabledAt),
+			IsuCount:   user.IsuCount,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/admin/isu
+// 全ユーザーのISUを検索
+func getAdminIsuList(c echo.Context) error {
+	limit, offset, err := parseAdminListRange(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	query := "SELECT `id`, `jia_isu_uuid`, `name`, `character`, `jia_user_id`, `created_at` FROM `isu` WHERE 1 = 1"
+	args := []interface{}{}
+	if q := c.QueryParam("q"); q != "" {
+		query += " AND (`name` LIKE ? OR `jia_isu_uuid` LIKE ?)"
+		args = append(args, likeContains(q), likeContains(q))
+	}
+	if jiaUserID := c.QueryParam("jia_user_id"); jiaUserID != "" {
+		query += " AND `jia_user_id` = ?"
+		args = append(args, jiaUserID)
+	}
+	if character := c.QueryParam("character"); character != "" {
+		query += " AND `character` = ?"
+		args = append(args, character)
+	}
+	query += " ORDER BY `id` DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	isuList := []Isu{}
+	err = db.Select(&isuList, query, args...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []AdminIsuResponse{}
+	for _, isu := range isuList {
+		res = append(res, AdminIsuResponse{
+			ID:         isu.ID,
+			JIAIsuUUID: isu.JIAIsuUUID,
+			Name:       isu.Name,
+			Character:  isu.Character,
+			JIAUserID:  isu.JIAUserID,
+			CreatedAt:  isu.CreatedAt.Unix(),
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/admin/isu/:jia_isu_uuid/stats
+// ISUのコンディション受付状況を取得
+func getAdminIsuStats(c echo.Context) error {
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	var isu Isu
+	err := db.Get(&isu, "SELECT `id`, `jia_isu_uuid`, `jia_user_id`, `created_at` FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var conditionStats struct {
+		Count    int          `db:"count"`
+		First    sql.NullTime `db:"first"`
+		Latest   sql.NullTime `db:"latest"`
+		Recently int          `db:"recently"`
+	}
+	err = conditionShards.Shard(jiaIsuUUID).DB.Get(&conditionStats,
+		"SELECT COUNT(*) AS `count`, MIN(`timestamp`) AS `first`, MAX(`timestamp`) AS `latest`,"+
+			"	COALESCE(SUM(`created_at` >= ?), 0) AS `recently`"+
+			"	FROM `isu_condition` WHERE `jia_isu_uuid` = ?",
+		time.Now().Add(-adminIsuStatsRecentConditionRange), jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	connectivity, _, err := getIsuConnectivity(db, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	lastIngestedAt, lastIngestedAtUnix := connectivity.lastIngestedAtOr(isu)
+
+	res := AdminIsuStatsResponse{
+		JIAIsuUUID:               isu.JIAIsuUUID,
+		JIAUserID:                isu.JIAUserID,
+		ConditionCount:           conditionStats.Count,
+		RecentConditionCount:     conditionStats.Recently,
+		FirstConditionTimestamp:  nullTimeToUnix(conditionStats.First),
+		LatestConditionTimestamp: nullTimeToUnix(conditionStats.Latest),
+		LastIngestedAt:           lastIngestedAtUnix,
+		Connectivity:             calculateConnectivity(lastIngestedAt, time.Now()),
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// POST /api/admin/isu/:jia_isu_uuid/activate
+// JIAにISUのactivateを再度依頼し，性格を更新
+func postAdminReactivateIsu(c echo.Context) error {
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	setAuditTarget(c, adminActor, jiaIsuUUID)
+
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	isuFromJIA, err := jiaAPIClient.Activate(c.Request().Context(), getJIAServiceURL(db), jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		setAuditDetail(c, err.Error())
+		return respondJIAError(c, err)
+	}
+
+	_, err = db.Exec("UPDATE `isu` SET `character` = ? WHERE `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	err = markIsuActivated(db, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, isuFromJIA)
+}
+
+// PUT /api/admin/config/jia_service_url
+// JIAのサービスURLを変更
+func putAdminJIAServiceURL(c echo.Context) error {
+	setAuditTarget(c, adminActor, "")
+
+	var req PutJIAServiceURLRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.String(http.StatusBadRequest, "bad format: url")
+	}
+	setAuditDetail(c, req.URL)
+
+	_, err = db.Exec(
+		"INSERT INTO `isu_association_config` (`name`, `url`) VALUES (?, ?) ON DUPLICATE KEY UPDATE `url` = VALUES(`url`)",
+		"jia_service_url",
+		strings.TrimSuffix(req.URL, "/"),
+	)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// POST /api/admin/user/:jia_user_id/disable
+// ユーザーを無効化し，サインインできないようにする
+func postAdminDisableUser(c echo.Context) error {
+	return setUserDisabled(c, true)
+}
+
+// POST /api/admin/user/:jia_user_id/enable
+// 無効化したユーザーを元に戻す
+func postAdminEnableUser(c echo.Context) error {
+	return setUserDisabled(c, false)
+}
+
+func setUserDisabled(c echo.Context, disabled bool) error {
+	jiaUserID := c.Param("jia_user_id")
+	setAuditTarget(c, adminActor, "")
+	setAuditDetail(c, jiaUserID)
+
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "not found: user")
+	}
+
+	if disabled {
+		_, err = db.Exec("INSERT IGNORE INTO `user_disabled` (`jia_user_id`) VALUES (?)", jiaUserID)
+	} else {
+		_, err = db.Exec("DELETE FROM `user_disabled` WHERE `jia_user_id` = ?", jiaUserID)
+	}
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/admin/audit
+// ユーザー・ISUを横断して操作履歴を取得
+func getAdminAuditLogs(c echo.Context) error {
+	beforeID, limit, err := parseAuditLogRange(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	res, err := getAuditLogs(db, c.QueryParam("actor"), c.QueryParam("jia_isu_uuid"), beforeID, limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
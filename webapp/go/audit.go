@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	auditActionSignIn      = "sign_in"
+	auditActionSignOut     = "sign_out"
+	auditActionRegisterIsu = "register_isu"
+
+	auditResultSuccess = "success"
+	auditResultFailure = "failure"
+
+	auditContextActor      = "audit_actor"
+	auditContextJIAIsuUUID = "audit_jia_isu_uuid"
+	auditContextDetail     = "audit_detail"
+
+	auditUserAgentMaxLength = 1024
+	auditValueMaxLength     = 255
+
+	auditLogDefaultLimit = 50
+	auditLogMaxLimit     = 200
+
+	// 同じホストのnginxを経由する構成を既定とする
+	defaultTrustedProxies = "127.0.0.1/32,::1/128"
+)
+
+// 追記のみ行う操作履歴
+type AuditLog struct {
+	ID         int       `db:"id"`
+	Action     string    `db:"action"`
+	Actor      string    `db:"actor"`
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	IP         string    `db:"ip"`
+	UserAgent  string    `db:"user_agent"`
+	Result     string    `db:"result"`
+	StatusCode int       `db:"status_code"`
+	Detail     string    `db:"detail"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type AuditLogResponse struct {
+	ID         int    `json:"id"`
+	Action     string `json:"action"`
+	Actor      string `json:"actor"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	IP         string `json:"ip"`
+	UserAgent  string `json:"user_agent"`
+	Result     string `json:"result"`
+	StatusCode int    `json:"status_code"`
+	Detail     string `json:"detail"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+func (a AuditLog) toResponse() AuditLogResponse {
+	return AuditLogResponse{
+		ID:         a.ID,
+		Action:     a.Action,
+		Actor:      a.Actor,
+		JIAIsuUUID: a.JIAIsuUUID,
+		IP:         a.IP,
+		UserAgent:  a.UserAgent,
+		Result:     a.Result,
+		StatusCode: a.StatusCode,
+		Detail:     a.Detail,
+		Timestamp:  a.CreatedAt.Unix(),
+	}
+}
+
+// 操作の主体と対象のISUを記録する
+// ハンドラーの中でしか分からない情報なのでハンドラーから呼ぶ
+func setAuditTarget(c echo.Context, actor string, jiaIsuUUID string) {
+	c.Set(auditContextActor, actor)
+	c.Set(auditContextJIAIsuUUID, jiaIsuUUID)
+}
+
+// TRUSTED_PROXIES を読み込み，操作履歴に記録するIPアドレスの取り出し方を決める
+// X-Forwarded-For は，ここに含まれるプロキシから届いたリクエストのものだけを信用する
+// IPアドレスかCIDRをカンマ区切りで並べ，空の場合は X-Forwarded-For を使わない
+func parseTrustedProxies(s string) (echo.IPExtractor, error) {
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	trusted := 0
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("bad format: TRUSTED_PROXIES: %v", entry)
+			}
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipRange, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: TRUSTED_PROXIES: %v", entry)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+		trusted++
+	}
+	if trusted == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// 操作結果の補足を記録する
+func setAuditDetail(c echo.Context, detail string) {
+	c.Set(auditContextDetail, detail)
+}
+
+func auditContextString(c echo.Context, key string) string {
+	v, _ := c.Get(key).(string)
+	return v
+}
+
+// ハンドラーの実行結果を操作履歴に記録するミドルウェア
+func auditLog(action string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			statusCode := c.Response().Status
+			result := auditResultSuccess
+			if statusCode >= http.StatusBadRequest {
+				result = auditResultFailure
+			}
+
+			err := insertAuditLog(db, AuditLog{
+				Action:     action,
+				Actor:      auditContextString(c, auditContextActor),
+				JIAIsuUUID: auditContextString(c, auditContextJIAIsuUUID),
+				IP:         c.RealIP(),
+				UserAgent:  c.Request().UserAgent(),
+				Result:     result,
+				StatusCode: statusCode,
+				Detail:     auditContextString(c, auditContextDetail),
+			})
+			if err != nil {
+				c.Logger().Error(err)
+			}
+			return nil
+		}
+	}
+}
+
+// カラムの長さを超える値を切り詰める
+// 不正な文字列として挿入を拒否されないよう，マルチバイト文字の途中では切らない
+func truncateAuditValue(v string, maxLength int) string {
+	if len(v) <= maxLength {
+		return v
+	}
+	end := maxLength
+	for end > 0 && !utf8.RuneStart(v[end]) {
+		end--
+	}
+	return v[:end]
+}
+
+func insertAuditLog(db sqlx.Execer, a AuditLog) error {
+	a.Actor = truncateAuditValue(a.Actor, auditValueMaxLength)
+	a.JIAIsuUUID = truncateAuditValue(a.JIAIsuUUID, auditValueMaxLength)
+	a.UserAgent = truncateAuditValue(a.UserAgent, auditUserAgentMaxLength)
+
+	_, err := db.Exec(
+		"INSERT INTO `audit_log`"+
+			"	(`action`, `actor`, `jia_isu_uuid`, `ip`, `user_agent`, `result`, `status_code`, `detail`)"+
+			"	VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		a.Action, a.Actor, a.JIAIsuUUID, a.IP, a.UserAgent, a.Result, a.StatusCode, a.Detail)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 操作履歴を新しい順に取得
+// actor, jiaIsuUUID が空文字列の場合はその条件で絞り込まない
+func getAuditLogs(db *sqlx.DB, actor string, jiaIsuUUID string, beforeID int, limit int) ([]AuditLogResponse, error) {
+	query := "SELECT * FROM `audit_log` WHERE 1 = 1"
+	args := []interface{}{}
+	if actor != "" {
+		query += " AND `actor` = ?"
+		args = append(args, actor)
+	}
+	if jiaIsuUUID != "" {
+		query += " AND `jia_isu_uuid` = ?"
+		args = append(args, jiaIsuUUID)
+	}
+	if beforeID > 0 {
+		query += " AND `id` < ?"
+		args = append(args, beforeID)
+	}
+	query += " ORDER BY `id` DESC LIMIT ?"
+	args = append(args, limit)
+
+	logs := []AuditLog{}
+	err := db.Select(&logs, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := []AuditLogResponse{}
+	for _, l := range logs {
+		res = append(res, l.toResponse())
+	}
+	return res, nil
+}
+
+// ユーザー自身の操作と，ユーザーのISUへの操作の履歴を新しい順に取得
+// ISUへの操作はユーザーが登録した後のものだけを含め，他の操作者のIPアドレスとUser-Agentは返さない
+func getUserAuditLogs(db *sqlx.DB, jiaUserID string, jiaIsuUUID string, beforeID int, limit int) ([]AuditLogResponse, error) {
+	actorQuery := "SELECT * FROM `audit_log` WHERE `actor` = ?"
+	actorArgs := []interface{}{jiaUserID}
+	isuQuery := "SELECT a.* FROM `audit_log` a INNER JOIN `isu` i ON a.`jia_isu_uuid` = i.`jia_isu_uuid`" +
+		" WHERE i.`jia_user_id` = ? AND a.`created_at` >= i.`created_at`"
+	isuArgs := []interface{}{jiaUserID}
+	if jiaIsuUUID != "" {
+		actorQuery += " AND `jia_isu_uuid` = ?"
+		actorArgs = append(actorArgs, jiaIsuUUID)
+		isuQuery += " AND a.`jia_isu_uuid` = ?"
+		isuArgs = append(isuArgs, jiaIsuUUID)
+	}
+	if beforeID > 0 {
+		actorQuery += " AND `id` < ?"
+		actorArgs = append(actorArgs, beforeID)
+		isuQuery += " AND a.`id` < ?"
+		isuArgs = append(isuArgs, beforeID)
+	}
+	// それぞれインデックスで新しい順に limit 件まで読んでからまとめる
+	query := "(" + actorQuery + " ORDER BY `id` DESC LIMIT ?) UNION (" + isuQuery + " ORDER BY a.`id` DESC LIMIT ?)" +
+		" ORDER BY `id` DESC LIMIT ?"
+	args := append(append(append(actorArgs, limit), isuArgs...), limit, limit)
+
+	logs := []AuditLog{}
+	err := db.Select(&logs, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := []AuditLogResponse{}
+	for _, l := range logs {
+		if l.Actor != jiaUserID {
+			l.IP = ""
+			l.UserAgent = ""
+		}
+		res = append(res, l.toResponse())
+	}
+	return res, nil
+}
+
+// 操作履歴の取得範囲をクエリパラメータから取得
+func parseAuditLogRange(c echo.Context) (int, int, error) {
+	beforeID := 0
+	if beforeStr := c.QueryParam("before"); beforeStr != "" {
+		var err error
+		beforeID, err = strconv.Atoi(beforeStr)
+		if err != nil || beforeID <= 0 {
+			return 0, 0, fmt.Errorf("bad format: before")
+		}
+	}
+
+	limit := auditLogDefaultLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > auditLogMaxLimit {
+			return 0, 0, fmt.Errorf("bad format: limit")
+		}
+	}
+
+	return beforeID, limit, nil
+}
+
+// GET /api/audit
+// サインインしている自分自身の操作と，自分のISUへの操作の履歴を取得
+func getMyAuditLogs(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	beforeID, limit, err := parseAuditLogRange(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	res, err := getUserAuditLogs(db, jiaUserID, c.QueryParam("jia_isu_uuid"), beforeID, limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
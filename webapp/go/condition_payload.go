@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	defaultConditionPayloadMaxSize = 8 * 1024 * 1024
+
+	mimeApplicationMsgpack    = "application/msgpack"
+	mimeApplicationXMsgpack   = "application/x-msgpack"
+	mimeApplicationVndMsgpack = "application/vnd.msgpack"
+
+	contentEncodingIdentity = "identity"
+	contentEncodingGzip     = "gzip"
+	contentEncodingZstd     = "zstd"
+)
+
+var (
+	// 展開後のリクエストボディの上限
+	// 圧縮されたボディは展開しながら数えるので，展開すると巨大になるボディも読み切る前に弾ける
+	conditionPayloadMaxSize = defaultConditionPayloadMaxSize
+
+	errConditionPayloadTooLarge            = errors.New("payload too large")
+	errConditionPayloadUnsupportedEncoding = errors.New("unsupported content encoding")
+)
+
+// 圧縮されたリクエストボディか
+// OpenAPI の検証はボディを展開しないので，これらはハンドラーで検証する
+func isCompressedRequest(r *http.Request) bool {
+	encoding := strings.TrimSpace(strings.ToLower(r.Header.Get(echo.HeaderContentEncoding)))
+	return encoding != "" && encoding != contentEncodingIdentity
+}
+
+// Content-Encoding に従ってボディを展開する Reader を返す
+func newConditionPayloadReader(r *http.Request) (io.ReadCloser, error) {
+	encoding := strings.TrimSpace(strings.ToLower(r.Header.Get(echo.HeaderContentEncoding)))
+	switch encoding {
+	case "", contentEncodingIdentity:
+		return r.Body, nil
+	case contentEncodingGzip:
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("bad request body")
+		}
+		return gr, nil
+	case contentEncodingZstd:
+		zr, err := zstd.NewReader(r.Body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(conditionPayloadMaxSize)+1))
+		if err != nil {
+			return nil, fmt.Errorf("bad request body")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, errConditionPayloadUnsupportedEncoding
+	}
+}
+
+// ISUから送られたコンディションを読み込む
+func decodePostIsuConditionRequest(r *http.Request) ([]PostIsuConditionRequest, error) {
+	req := []PostIsuConditionRequest{}
+	err := decodeConditionPayload(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// コンディションを含むリクエストボディを v に読み込む
+// Content-Type で JSON と MessagePack を切り替える．MessagePack のキーは JSON と同じ
+// Content-Type が無いか対応していない場合は，c.Bind で読んでいたときと同じく不正なボディとして扱う
+func decodeConditionPayload(r *http.Request, v interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return fmt.Errorf("bad request body")
+	}
+	switch mediaType {
+	case echo.MIMEApplicationJSON, mimeApplicationMsgpack, mimeApplicationXMsgpack, mimeApplicationVndMsgpack:
+	default:
+		return fmt.Errorf("bad request body")
+	}
+
+	reader, err := newConditionPayloadReader(r)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(conditionPayloadMaxSize)+1))
+	if err != nil {
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return errConditionPayloadTooLarge
+		}
+		return fmt.Errorf("bad request body")
+	}
+	if len(body) > conditionPayloadMaxSize {
+		return errConditionPayloadTooLarge
+	}
+
+	if mediaType == echo.MIMEApplicationJSON {
+		err = json.Unmarshal(body, v)
+	} else {
+		decoder := msgpack.NewDecoder(bytes.NewReader(body))
+		decoder.SetCustomStructTag("json")
+		err = decoder.Decode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("bad request body")
+	}
+	return nil
+}
+
+// 読み込みに失敗した理由に応じたレスポンスを返す
+func respondConditionPayloadError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errConditionPayloadTooLarge):
+		return c.String(http.StatusRequestEntityTooLarge, "payload too large")
+	case errors.Is(err, errConditionPayloadUnsupportedEncoding):
+		return c.String(http.StatusUnsupportedMediaType, err.Error())
+	default:
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	conditionSearchDefaultLimit = 20
+	conditionSearchMaxLimit     = 100
+	conditionSearchMaxTerms     = 8
+	conditionSearchMaxMessages  = 1000
+	conditionMessageInsertBatch = 500
+)
+
+// コンディションのメッセージの辞書
+// メッセージの種類は少ないため，全文検索はこの辞書に対して行い，一致したメッセージを持つコンディションを引く
+//
+// MariaDB には ngram パーサーがないため，`tokens` にはメッセージを1文字と2文字に区切ったものを
+// 16進数にして空白区切りで入れ，FULLTEXT インデックスで ngram 相当の検索をする
+type ConditionMessage struct {
+	ID      int    `db:"id"`
+	Message string `db:"message"`
+	Tokens  string `db:"tokens"`
+}
+
+type ConditionSearchHighlight struct {
+	Start int `json:"start"` // メッセージ中の文字単位の位置
+	End   int `json:"end"`
+}
+
+type SearchIsuConditionResponse struct {
+	GetIsuConditionResponse
+	Highlights []ConditionSearchHighlight `json:"highlights"`
+}
+
+type conditionSearchRow struct {
+	IsuCondition
+	IsuName string `db:"isu_name"`
+}
+
+// 辞書に登録済みのメッセージ
+// 他のアプリケーションサーバーが登録したものは知らなくてもよい．重複は INSERT IGNORE で弾く
+type conditionMessageCache struct {
+	mu       sync.RWMutex
+	messages map[string]struct{}
+}
+
+var conditionMessages = &conditionMessageCache{messages: map[string]struct{}{}}
+
+func (cm *conditionMessageCache) has(message string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	_, ok := cm.messages[message]
+	return ok
+}
+
+func (cm *conditionMessageCache) add(messages []string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for _, message := range messages {
+		cm.messages[message] = struct{}{}
+	}
+}
+
+func (cm *conditionMessageCache) reset() {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	cm.messages = map[string]struct{}{}
+}
+
+// 辞書の内容を読み込む
+// 辞書が空でコンディションがある場合は，既存のコンディションから辞書を作る
+func (cm *conditionMessageCache) Load(db *sqlx.DB) error {
+	messages := []string{}
+	err := db.Select(&messages, "SELECT `message` FROM `condition_message`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if len(messages) == 0 {
+		return rebuildConditionMessages(db)
+	}
+
+	cm.reset()
+	cm.add(messages)
+	return nil
+}
+
+// 検索のための正規化
+func normalizeConditionMessage(s string) []rune {
+	return []rune(strings.ToLower(s))
+}
+
+func conditionMessageUnigramToken(r rune) string {
+	return "u" + hex.EncodeToString([]byte(string(r)))
+}
+
+func conditionMessageBigramToken(r1 rune, r2 rune) string {
+	return "b" + hex.EncodeToString([]byte(string([]rune{r1, r2})))
+}
+
+// メッセージを FULLTEXT インデックスに入れるトークン列に変換
+func tokenizeConditionMessage(message string) string {
+	runes := normalizeConditionMessage(message)
+	seen := map[string]struct{}{}
+	tokens := []string{}
+	appendToken := func(token string) {
+		if _, ok := seen[token]; ok {
+			return
+		}
+		seen[token] = struct{}{}
+		tokens = append(tokens, token)
+	}
+	for i, r := range runes {
+		appendToken(conditionMessageUnigramToken(r))
+		if i+1 < len(runes) {
+			appendToken(conditionMessageBigramToken(r, runes[i+1]))
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// 検索語を BOOLEAN MODE の検索式に変換
+// 1文字の語は1文字のトークンで，それ以外は2文字のトークンを全て含むもので絞り込む
+func conditionSearchExpression(terms []string) string {
+	required := []string{}
+	for _, term := range terms {
+		runes := normalizeConditionMessage(term)
+		if len(runes) == 1 {
+			required = append(required, "+"+conditionMessageUnigramToken(runes[0]))
+			continue
+		}
+		for i := 0; i+1 < len(runes); i++ {
+			required = append(required, "+"+conditionMessageBigramToken(runes[i], runes[i+1]))
+		}
+	}
+	return strings.Join(required, " ")
+}
+
+// 未登録のメッセージを辞書に登録する
+// コミットが成功したら registered を conditionMessages に追加すること
+func registerConditionMessages(tx *sqlx.Tx, messages []string) (registered []string, err error) {
+	seen := map[string]struct{}{}
+	for _, message := range messages {
+		if _, ok := seen[message]; ok || conditionMessages.has(message) {
+			continue
+		}
+		seen[message] = struct{}{}
+		registered = append(registered, message)
+	}
+	if len(registered) == 0 {
+		return nil, nil
+	}
+
+	err = insertConditionMessages(tx, registered)
+	if err != nil {
+		return nil, err
+	}
+	return registered, nil
+}
+
+func insertConditionMessages(db sqlx.Execer, messages []string) error {
+	for start := 0; start < len(messages); start += conditionMessageInsertBatch {
+		end := start + conditionMessageInsertBatch
+		if end > len(messages) {
+			end = len(messages)
+		}
+
+		query := "INSERT IGNORE INTO `condition_message` (`message`, `tokens`) VALUES "
+		args := []interface{}{}
+		for i, message := range messages[start:end] {
+			if i > 0 {
+				query += ","
+			}
+			query += "(?, ?)"
+			args = append(args, message, tokenizeConditionMessage(message))
+		}
+		_, err := db.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
+
+// 全てのコンディションからメッセージの辞書を作り直す
+// 辞書はプライマリに置き，メッセージは全てのシャードから集める
+func rebuildConditionMessages(db *sqlx.DB) error {
+	seen := map[string]struct{}{}
+	messages := []string{}
+	for _, shard := range conditionShards.All() {
+		shardMessages := []string{}
+		err := shard.DB.Select(&shardMessages, "SELECT DISTINCT `message` FROM `isu_condition`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		for _, message := range shardMessages {
+			if _, ok := seen[message]; ok {
+				continue
+			}
+			seen[message] = struct{}{}
+			messages = append(messages, message)
+		}
+	}
+
+	err := insertConditionMessages(db, messages)
+	if err != nil {
+		return err
+	}
+
+	conditionMessages.reset()
+	conditionMessages.add(messages)
+	return nil
+}
+
+// 指定したISUのコンディションからメッセージが一致するものを新しい順に limit 件取得する
+// ISUをシャード毎に分けて検索し，結果を併せてから並べ直す
+func searchShardedConditions(isus []Isu, messages []string, endTime time.Time, limit int) ([]conditionSearchRow, error) {
+	isuNames := map[string]string{}
+	jiaIsuUUIDs := make([]string, 0, len(isus))
+	for _, isu := range isus {
+		isuNames[isu.JIAIsuUUID] = isu.Name
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+
+	rows := []conditionSearchRow{}
+	shards, groups := conditionShards.Group(jiaIsuUUIDs)
+	for i, shard := range shards {
+		query := "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` IN (?) AND `message` IN (?)"
+		args := []interface{}{groups[i], messages}
+		if !endTime.IsZero() {
+			query += " AND `timestamp` < ?"
+			args = append(args, endTime)
+		}
+		query += " ORDER BY `timestamp` DESC, `id` DESC LIMIT ?"
+		args = append(args, limit)
+
+		query, args, err := sqlx.In(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		conditions := []IsuCondition{}
+		err = shard.DB.Select(&conditions, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+		for _, condition := range conditions {
+			rows = append(rows, conditionSearchRow{IsuCondition: condition, IsuName: isuNames[condition.JIAIsuUUID]})
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Timestamp.Equal(rows[j].Timestamp) {
+			return rows[i].Timestamp.After(rows[j].Timestamp)
+		}
+		return rows[i].ID > rows[j].ID
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+// メッセージ中で検索語に一致する箇所を探す
+// 全ての検索語を含まない場合は nil を返す
+func findConditionSearchHighlights(message string, terms []string) []ConditionSearchHighlight {
+	runes := normalizeConditionMessage(message)
+	text := string(runes)
+
+	highlights := []ConditionSearchHighlight{}
+	for _, term := range terms {
+		needle := string(normalizeConditionMessage(term))
+		found := false
+		for offset := 0; offset < len(text); {
+			index := strings.Index(text[offset:], needle)
+			if index < 0 {
+				break
+			}
+			found = true
+			start := utf8.RuneCountInString(text[:offset+index])
+			highlights = append(highlights, ConditionSearchHighlight{Start: start, End: start + utf8.RuneCountInString(needle)})
+			offset += index + len(needle)
+		}
+		if !found {
+			return nil
+		}
+	}
+	sort.Slice(highlights, func(i, j int) bool {
+		return highlights[i].Start < highlights[j].Start
+	})
+	return highlights
+}
+
+// 検索語に一致するメッセージと，その中で一致した箇所を取得
+func searchConditionMessages(db *sqlx.DB, terms []string) (map[string][]ConditionSearchHighlight, error) {
+	messages := []string{}
+	err := db.Select(&messages,
+		"SELECT `message` FROM `condition_message`"+
+			"	WHERE MATCH(`tokens`) AGAINST(? IN BOOLEAN MODE) LIMIT ?",
+		conditionSearchExpression(terms), conditionSearchMaxMessages)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	// 2文字のトークンは順序を問わず一致するので，実際に含まれているものだけに絞る
+	res := map[string][]ConditionSearchHighlight{}
+	for _, message := range messages {
+		if highlights := findConditionSearchHighlights(message, terms); highlights != nil {
+			res[message] = highlights
+		}
+	}
+	return res, nil
+}
+
+// GET /api/condition/search
+// 自分のISUのコンディションをメッセージで検索
+func searchIsuConditions(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	terms := strings.Fields(c.QueryParam("q"))
+	if len(terms) == 0 {
+		return c.String(http.StatusBadRequest, "missing: q")
+	}
+	if len(terms) > conditionSearchMaxTerms {
+		return c.String(http.StatusBadRequest, "bad format: q")
+	}
+
+	jiaIsuUUID := c.QueryParam("jia_isu_uuid")
+
+	var endTime time.Time
+	if endTimeStr := c.QueryParam("end_time"); endTimeStr != "" {
+		endTimeInt64, err := strconv.ParseInt(endTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: end_time")
+		}
+		endTime = time.Unix(endTimeInt64, 0)
+	}
+
+	limit := conditionSearchDefaultLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > conditionSearchMaxLimit {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	if jiaIsuUUID != "" {
+		var count int
+		err = db.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+			jiaUserID, jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		if count == 0 {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+	}
+
+	highlightsByMessage, err := searchConditionMessages(db, terms)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res := []SearchIsuConditionResponse{}
+	if len(highlightsByMessage) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+	messages := make([]string, 0, len(highlightsByMessage))
+	for message := range highlightsByMessage {
+		messages = append(messages, message)
+	}
+
+	isus := []Isu{}
+	if jiaIsuUUID != "" {
+		err = db.Select(&isus, "SELECT `jia_isu_uuid`, `name` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+			jiaUserID, jiaIsuUUID)
+	} else {
+		err = db.Select(&isus, "SELECT `jia_isu_uuid`, `name` FROM `isu` WHERE `jia_user_id` = ?", jiaUserID)
+	}
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(isus) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	rows, err := searchShardedConditions(isus, messages, endTime, limit)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	for _, row := range rows {
+		conditionLevel, err := profile.conditionLevel(row.Condition)
+		if err != nil {
+			continue
+		}
+		res = append(res, SearchIsuConditionResponse{
+			GetIsuConditionResponse: GetIsuConditionResponse{
+				JIAIsuUUID:     row.JIAIsuUUID,
+				IsuName:        row.IsuName,
+				Timestamp:      row.Timestamp.Unix(),
+				IsSitting:      row.IsSitting,
+				Condition:      row.Condition,
+				ConditionLevel: conditionLevel,
+				Message:        row.Message,
+			},
+			Highlights: highlightsByMessage[row.Message],
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 範囲外のタイムスタンプを持つコンディションの扱い
+	conditionTimestampAccept     = "accept"     // そのまま保存する
+	conditionTimestampReject     = "reject"     // リクエストを拒否する
+	conditionTimestampClamp      = "clamp"      // 範囲内に丸めて保存する
+	conditionTimestampQuarantine = "quarantine" // コンディションとしては保存せず，隔離して所有者が確認できるようにする
+
+	conditionTimestampReasonFuture = "future"
+	conditionTimestampReasonPast   = "past"
+
+	defaultConditionMaxFutureSkew   = time.Minute * 5
+	defaultConditionPastAllowance   = time.Hour * 24
+	conditionQuarantineDefaultLimit = 20
+	conditionQuarantineMaxLimit     = 100
+	conditionQuarantineInsertBatch  = 500
+)
+
+var (
+	conditionTimestamps = conditionTimestampPolicy{
+		FutureAction:  conditionTimestampAccept,
+		MaxFutureSkew: defaultConditionMaxFutureSkew,
+		PastAction:    conditionTimestampAccept,
+		PastAllowance: defaultConditionPastAllowance,
+	}
+
+	errConditionTimestampRejected = errors.New("bad format: timestamp")
+)
+
+// 受け取ったコンディションのタイムスタンプの検査方法
+// 未来は受け取った時刻から MaxFutureSkew より先，過去はISUの登録から PastAllowance より前を範囲外とする
+type conditionTimestampPolicy struct {
+	FutureAction  string
+	MaxFutureSkew time.Duration
+	PastAction    string
+	PastAllowance time.Duration
+}
+
+type IsuConditionQuarantine struct {
+	ID         int       `db:"id"`
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	Timestamp  int64     `db:"timestamp"`
+	IsSitting  bool      `db:"is_sitting"`
+	Condition  string    `db:"condition"`
+	Message    string    `db:"message"`
+	Reason     string    `db:"reason"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type IsuConditionQuarantineResponse struct {
+	ID         int    `json:"id"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Timestamp  int64  `json:"timestamp"`
+	IsSitting  bool   `json:"is_sitting"`
+	Condition  string `json:"condition"`
+	Message    string `json:"message"`
+	Reason     string `json:"reason"`
+	ReceivedAt int64  `json:"received_at"`
+}
+
+// 隔離するコンディションと隔離の理由
+type quarantinedCondition struct {
+	PostIsuConditionRequest
+	Reason string
+}
+
+func isValidConditionTimestampAction(action string) bool {
+	switch action {
+	case conditionTimestampAccept, conditionTimestampReject, conditionTimestampClamp, conditionTimestampQuarantine:
+		return true
+	}
+	return false
+}
+
+// 環境変数からタイムスタンプの検査方法を読み込む
+func conditionTimestampPolicyFromEnv() (conditionTimestampPolicy, error) {
+	policy := conditionTimestampPolicy{
+		FutureAction: getEnv("CONDITION_FUTURE_TIMESTAMP_ACTION", conditionTimestampAccept),
+		PastAction:   getEnv("CONDITION_PAST_TIMESTAMP_ACTION", conditionTimestampAccept),
+	}
+	if !isValidConditionTimestampAction(policy.FutureAction) {
+		return policy, fmt.Errorf("bad format: CONDITION_FUTURE_TIMESTAMP_ACTION: %v", policy.FutureAction)
+	}
+	if !isValidConditionTimestampAction(policy.PastAction) {
+		return policy, fmt.Errorf("bad format: CONDITION_PAST_TIMESTAMP_ACTION: %v", policy.PastAction)
+	}
+
+	var err error
+	if policy.MaxFutureSkew, err = getEnvDuration("CONDITION_MAX_FUTURE_SKEW", defaultConditionMaxFutureSkew); err != nil {
+		return policy, err
+	}
+	// 登録前のコンディションを一切認めない場合に 0 を指定できるよう，秒で指定する
+	policy.PastAllowance = defaultConditionPastAllowance
+	if val := os.Getenv("CONDITION_PAST_ALLOWANCE_SECONDS"); val != "" {
+		seconds, err := strconv.ParseInt(val, 10, 64)
+		if err != nil || seconds < 0 {
+			return policy, fmt.Errorf("bad format: CONDITION_PAST_ALLOWANCE_SECONDS: %v", val)
+		}
+		policy.PastAllowance = time.Duration(seconds) * time.Second
+	}
+	return policy, nil
+}
+
+// コンディションのタイムスタンプを検査し，保存するものと隔離するものに分ける
+// 拒否すべきコンディションがある場合は errConditionTimestampRejected を返す
+func (p conditionTimestampPolicy) apply(req []PostIsuConditionRequest, registeredAt time.Time, now time.Time) ([]PostIsuConditionRequest, []quarantinedCondition, error) {
+	if p.FutureAction == conditionTimestampAccept && p.PastAction == conditionTimestampAccept {
+		return req, nil, nil
+	}
+
+	maxTimestamp := now.Add(p.MaxFutureSkew).Unix()
+	minTimestamp := registeredAt.Add(-p.PastAllowance).Unix()
+
+	accepted := make([]PostIsuConditionRequest, 0, len(req))
+	quarantined := []quarantinedCondition{}
+	for _, cond := range req {
+		action, reason, bound := conditionTimestampAccept, "", int64(0)
+		if cond.Timestamp > maxTimestamp {
+			action, reason, bound = p.FutureAction, conditionTimestampReasonFuture, now.Unix()
+		} else if cond.Timestamp < minTimestamp {
+			action, reason, bound = p.PastAction, conditionTimestampReasonPast, minTimestamp
+		}
+
+		switch action {
+		case conditionTimestampReject:
+			return nil, nil, errConditionTimestampRejected
+		case conditionTimestampClamp:
+			cond.Timestamp = bound
+			accepted = append(accepted, cond)
+		case conditionTimestampQuarantine:
+			quarantined = append(quarantined, quarantinedCondition{PostIsuConditionRequest: cond, Reason: reason})
+		default:
+			accepted = append(accepted, cond)
+		}
+	}
+	return accepted, quarantined, nil
+}
+
+// 隔離したコンディションを保存する
+func insertQuarantinedConditions(tx *sqlx.Tx, jiaIsuUUID string, quarantined []quarantinedCondition) error {
+	for start := 0; start < len(quarantined); start += conditionQuarantineInsertBatch {
+		end := start + conditionQuarantineInsertBatch
+		if end > len(quarantined) {
+			end = len(quarantined)
+		}
+
+		query := "INSERT INTO `isu_condition_quarantine`" +
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`, `reason`) VALUES "
+		args := []interface{}{}
+		for i, cond := range quarantined[start:end] {
+			if i > 0 {
+				query += ","
+			}
+			query += "(?, ?, ?, ?, ?, ?)"
+			args = append(args, jiaIsuUUID, cond.Timestamp, cond.IsSitting, cond.Condition, cond.Message, cond.Reason)
+		}
+		_, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
+
+// GET /api/isu/:jia_isu_uuid/quarantine
+// タイムスタンプが範囲外だったため隔離されたコンディションを新しい順に取得
+func getIsuConditionQuarantine(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	limit := conditionQuarantineDefaultLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > conditionQuarantineMaxLimit {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+	var beforeID int64
+	if beforeIDStr := c.QueryParam("before_id"); beforeIDStr != "" {
+		beforeID, err = strconv.ParseInt(beforeIDStr, 10, 64)
+		if err != nil || beforeID <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: before_id")
+		}
+	}
+
+	var count int
+	err = db.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	shardDB := conditionShards.Shard(jiaIsuUUID).DB
+	quarantined := []IsuConditionQuarantine{}
+	if beforeID > 0 {
+		err = shardDB.Select(&quarantined,
+			"SELECT * FROM `isu_condition_quarantine` WHERE `jia_isu_uuid` = ? AND `id` < ? ORDER BY `id` DESC LIMIT ?",
+			jiaIsuUUID, beforeID, limit)
+	} else {
+		err = shardDB.Select(&quarantined,
+			"SELECT * FROM `isu_condition_quarantine` WHERE `jia_isu_uuid` = ? ORDER BY `id` DESC LIMIT ?",
+			jiaIsuUUID, limit)
+	}
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := make([]IsuConditionQuarantineResponse, 0, len(quarantined))
+	for _, q := range quarantined {
+		res = append(res, IsuConditionQuarantineResponse{
+			ID:         q.ID,
+			JIAIsuUUID: q.JIAIsuUUID,
+			Timestamp:  q.Timestamp,
+			IsSitting:  q.IsSitting,
+			Condition:  q.Condition,
+			Message:    q.Message,
+			Reason:     q.Reason,
+			ReceivedAt: q.CreatedAt.Unix(),
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
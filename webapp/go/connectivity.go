@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	connectivityOnline  = "online"
+	connectivityLate    = "late"
+	connectivityOffline = "offline"
+
+	defaultIsuExpectedPostInterval = time.Minute
+	connectivityLateIntervals      = 2
+	connectivityOfflineIntervals   = 10
+	connectivityMonitorInterval    = time.Second * 10
+	connectivityEventLimit         = 20
+)
+
+var (
+	isuExpectedPostInterval = defaultIsuExpectedPostInterval // ISUがコンディションを送ってくる想定の間隔
+)
+
+// ISUの接続状況
+// `last_ingested_at` はコンディションのタイムスタンプではなく，サーバーが受け付けた時刻
+type IsuConnectivity struct {
+	JIAIsuUUID     string    `db:"jia_isu_uuid"`
+	Status         string    `db:"status"`
+	LastIngestedAt time.Time `db:"last_ingested_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+// 接続状況の遷移
+type IsuConnectivityEvent struct {
+	ID             int       `db:"id" json:"-"`
+	JIAIsuUUID     string    `db:"jia_isu_uuid" json:"-"`
+	PreviousStatus string    `db:"previous_status" json:"previous_status"`
+	Status         string    `db:"status" json:"status"`
+	CreatedAt      time.Time `db:"created_at" json:"-"`
+	Timestamp      int64     `db:"-" json:"timestamp"`
+}
+
+type GetIsuResponse struct {
+	Isu
+	Connectivity       string                 `json:"connectivity"`
+	LastIngestedAt     *int64                 `json:"last_ingested_at"`
+	ConnectivityEvents []IsuConnectivityEvent `json:"connectivity_events"`
+	ActivationStatus   string                 `json:"activation_status"`
+	ActivationError    *string                `json:"activation_error"`
+}
+
+// 最後にコンディションを受け付けてからの経過時間から接続状況を計算
+// 一度もコンディションを受け付けていないISUは登録時刻から計算する
+func calculateConnectivity(lastIngestedAt time.Time, now time.Time) string {
+	elapsed := now.Sub(lastIngestedAt)
+	switch {
+	case elapsed > isuExpectedPostInterval*connectivityOfflineIntervals:
+		return connectivityOffline
+	case elapsed > isuExpectedPostInterval*connectivityLateIntervals:
+		return connectivityLate
+	default:
+		return connectivityOnline
+	}
+}
+
+// ISUの最終受付時刻を取得
+// 一度も受け付けていなければ登録時刻を返す
+func (ic *IsuConnectivity) lastIngestedAtOr(isu Isu) (time.Time, *int64) {
+	if ic == nil {
+		return isu.CreatedAt, nil
+	}
+	lastIngestedAt := ic.LastIngestedAt.Unix()
+	return ic.LastIngestedAt, &lastIngestedAt
+}
+
+// ユーザーの所有するISUの接続状況を取得
+func getIsuConnectivitiesByUser(db *sqlx.DB, jiaUserID string) (map[string]*IsuConnectivity, error) {
+	connectivities := []*IsuConnectivity{}
+	err := db.Select(&connectivities,
+		"SELECT ic.* FROM `isu_connectivity` ic INNER JOIN `isu` i ON ic.`jia_isu_uuid` = i.`jia_isu_uuid`"+
+			"	WHERE i.`jia_user_id` = ?",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := make(map[string]*IsuConnectivity, len(connectivities))
+	for _, connectivity := range connectivities {
+		res[connectivity.JIAIsuUUID] = connectivity
+	}
+	return res, nil
+}
+
+// ISUの接続状況と直近の遷移を取得
+func getIsuConnectivity(db *sqlx.DB, jiaIsuUUID string) (*IsuConnectivity, []IsuConnectivityEvent, error) {
+	var connectivity IsuConnectivity
+	err := db.Get(&connectivity, "SELECT * FROM `isu_connectivity` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	events := []IsuConnectivityEvent{}
+	err = db.Select(&events,
+		"SELECT * FROM `isu_connectivity_event` WHERE `jia_isu_uuid` = ? ORDER BY `created_at` DESC, `id` DESC LIMIT ?",
+		jiaIsuUUID, connectivityEventLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	for i := range events {
+		events[i].Timestamp = events[i].CreatedAt.Unix()
+	}
+
+	if connectivity.JIAIsuUUID == "" {
+		return nil, events, nil
+	}
+	return &connectivity, events, nil
+}
+
+// コンディションを受け付けたことを記録し，オンラインでなかった場合は遷移も記録する
+func recordIsuIngest(tx *sqlx.Tx, jiaIsuUUID string, now time.Time) error {
+	var previousStatus string
+	err := tx.Get(&previousStatus, "SELECT `status` FROM `isu_connectivity` WHERE `jia_isu_uuid` = ? FOR UPDATE", jiaIsuUUID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO `isu_connectivity` (`jia_isu_uuid`, `status`, `last_ingested_at`) VALUES (?, ?, ?)"+
+			"	ON DUPLICATE KEY UPDATE `status` = VALUES(`status`), `last_ingested_at` = VALUES(`last_ingested_at`)",
+		jiaIsuUUID, connectivityOnline, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	if previousStatus != "" && previousStatus != connectivityOnline {
+		err = insertIsuConnectivityEvent(tx, jiaIsuUUID, previousStatus, connectivityOnline)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertIsuConnectivityEvent(tx *sqlx.Tx, jiaIsuUUID string, previousStatus string, status string) error {
+	_, err := tx.Exec(
+		"INSERT INTO `isu_connectivity_event` (`jia_isu_uuid`, `previous_status`, `status`) VALUES (?, ?, ?)",
+		jiaIsuUUID, previousStatus, status)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 一定時間コンディションが届いていないISUの接続状況を更新し，遷移を記録する
+// 複数のアプリケーションサーバーで同時に動いても遷移が重複しないよう，状態を条件に更新する
+func updateIsuConnectivities(db *sqlx.DB, now time.Time) error {
+	transitions := []struct {
+		from      string
+		to        string
+		threshold time.Duration
+	}{
+		{connectivityOnline, connectivityLate, isuExpectedPostInterval * connectivityLateIntervals},
+		{connectivityLate, connectivityOffline, isuExpectedPostInterval * connectivityOfflineIntervals},
+		{connectivityOnline, connectivityOffline, isuExpectedPostInterval * connectivityOfflineIntervals},
+	}
+
+	for _, transition := range transitions {
+		staleBefore := now.Add(-transition.threshold)
+		jiaIsuUUIDs := []string{}
+		err := db.Select(&jiaIsuUUIDs,
+			"SELECT `jia_isu_uuid` FROM `isu_connectivity` WHERE `status` = ? AND `last_ingested_at` < ?",
+			transition.from, staleBefore)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+
+		for _, jiaIsuUUID := range jiaIsuUUIDs {
+			err = updateIsuConnectivity(db, jiaIsuUUID, transition.from, transition.to, staleBefore)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// 選んでから更新するまでにコンディションが届いたISUは更新しない
+func updateIsuConnectivity(db *sqlx.DB, jiaIsuUUID string, from string, to string, staleBefore time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE `isu_connectivity` SET `status` = ? WHERE `jia_isu_uuid` = ? AND `status` = ? AND `last_ingested_at` < ?",
+		to, jiaIsuUUID, from, staleBefore)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	err = insertIsuConnectivityEvent(tx, jiaIsuUUID, from, to)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 接続状況を定期的に更新する
+func runConnectivityMonitor(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := updateIsuConnectivities(db, time.Now()); err != nil {
+			log.Errorf("failed to update connectivities: %v", err)
+		}
+	}
+}
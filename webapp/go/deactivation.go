@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	deactivationStatusPending = "pending_deactivation"
+	deactivationStatusFailed  = "failed"
+
+	deactivationWorkerInterval = time.Second
+	deactivationBatchSize      = 20
+	deactivationMaxAttempts    = 10
+	deactivationLease          = time.Minute
+)
+
+var (
+	// 削除されたユーザーのISUをすぐに処理するようワーカーに知らせる
+	deactivationWakeup = make(chan struct{}, 1)
+)
+
+// 所有者が削除されたISUを deactivate を待つISUとして登録する
+// JIAに依頼できたものは行を消し，諦めたものは failed として残す
+func insertPendingIsuDeactivations(tx *sqlx.Tx, jiaIsuUUIDs []string, now time.Time) error {
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		_, err := tx.Exec(
+			"INSERT INTO `isu_deactivation` (`jia_isu_uuid`, `status`, `next_attempt_at`) VALUES (?, ?, ?)"+
+				"	ON DUPLICATE KEY UPDATE `status` = VALUES(`status`), `attempts` = 0, `last_error` = NULL,"+
+				"	`next_attempt_at` = VALUES(`next_attempt_at`)",
+			jiaIsuUUID, deactivationStatusPending, now)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
+
+// ISUが登録し直された場合は deactivate しない
+func cancelIsuDeactivation(tx *sqlx.Tx, jiaIsuUUID string) error {
+	_, err := tx.Exec("DELETE FROM `isu_deactivation` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// ワーカーに deactivate するISUが増えたことを知らせる
+func notifyDeactivationWorker() {
+	select {
+	case deactivationWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// 期限の来た deactivate 待ちのISUを処理する
+func processPendingDeactivations(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	jiaIsuUUIDs := []string{}
+	err := db.Select(&jiaIsuUUIDs,
+		"SELECT `jia_isu_uuid` FROM `isu_deactivation` WHERE `status` = ? AND `next_attempt_at` <= ?"+
+			"	ORDER BY `next_attempt_at` LIMIT ?",
+		deactivationStatusPending, now, deactivationBatchSize)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		err = processPendingDeactivation(ctx, db, jiaIsuUUID, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func processPendingDeactivation(ctx context.Context, db *sqlx.DB, jiaIsuUUID string, now time.Time) error {
+	// 複数のアプリケーションサーバーで同時に処理しないよう，期限を延ばせた場合のみ処理する
+	result, err := db.Exec(
+		"UPDATE `isu_deactivation` SET `next_attempt_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ? AND `next_attempt_at` <= ?",
+		now.Add(deactivationLease), jiaIsuUUID, deactivationStatusPending, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	deactivateErr := jiaAPIClient.Deactivate(ctx, getJIAServiceURL(db), jiaIsuUUID)
+	if deactivateErr != nil {
+		return recordDeactivationFailure(db, jiaIsuUUID, deactivateErr, time.Now())
+	}
+
+	_, err = db.Exec("DELETE FROM `isu_deactivation` WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		jiaIsuUUID, deactivationStatusPending)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// deactivate の失敗を記録し，activate と同じ間隔で再試行の予定を立てる
+func recordDeactivationFailure(db *sqlx.DB, jiaIsuUUID string, deactivateErr error, now time.Time) error {
+	var attempts int
+	err := db.Get(&attempts, "SELECT `attempts` FROM `isu_deactivation` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		// 処理中にISUが登録し直された
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	// サーキットブレーカーが開いている間は JIA に問い合わせていないので回数に数えない
+	if !errors.Is(deactivateErr, errJIACircuitOpen) {
+		attempts++
+	}
+	status := deactivationStatusPending
+	if attempts >= deactivationMaxAttempts || isPermanentActivationError(deactivateErr) {
+		status = deactivationStatusFailed
+		log.Warnf("gave up deactivating isu %v: %v", jiaIsuUUID, deactivateErr)
+	}
+
+	_, err = db.Exec(
+		"UPDATE `isu_deactivation` SET `status` = ?, `attempts` = ?, `last_error` = ?, `next_attempt_at` = ?"+
+			"	WHERE `jia_isu_uuid` = ? AND `status` = ?",
+		status, attempts, truncateAuditValue(deactivateErr.Error(), activationErrorMaxLength), now.Add(activationRetryDelay(attempts)),
+		jiaIsuUUID, deactivationStatusPending)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// deactivate 待ちのISUを定期的に処理する
+func runDeactivationWorker(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deactivationWakeup:
+		}
+		if err := processPendingDeactivations(context.Background(), db, time.Now()); err != nil {
+			log.Errorf("failed to process pending deactivations: %v", err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build embed_frontend
+// +build embed_frontend
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// ビルド前に ../public をこのディレクトリの public にコピーしておく
+//
+//go:embed public
+var frontendFS embed.FS
+
+func init() {
+	sub, err := fs.Sub(frontendFS, "public")
+	if err != nil {
+		panic(err)
+	}
+	embeddedFrontend = sub
+}
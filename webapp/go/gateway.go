@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	gatewayContextID         = "gateway_id"
+	gatewayConditionMaxIsu   = 500
+	gatewayConditionAccepted = "accepted"
+	gatewayConditionRejected = "rejected"
+)
+
+var (
+	// ゲートウェイのIDとトークン．空の場合はゲートウェイ向けAPIを無効にする
+	gatewayAPITokens = map[string]string{}
+)
+
+// 複数のISUのコンディションをまとめて送るゲートウェイからのリクエスト
+type PostGatewayConditionRequest struct {
+	JIAIsuUUID string                    `json:"jia_isu_uuid"`
+	Conditions []PostIsuConditionRequest `json:"conditions"`
+}
+
+type GatewayConditionResult struct {
+	JIAIsuUUID       string  `json:"jia_isu_uuid"`
+	Status           string  `json:"status"`
+	ConditionCount   int     `json:"condition_count"`
+	QuarantinedCount int     `json:"quarantined_count"`
+	Error            *string `json:"error"`
+}
+
+type PostGatewayConditionResponse struct {
+	Accepted int                      `json:"accepted"`
+	Rejected int                      `json:"rejected"`
+	Results  []GatewayConditionResult `json:"results"`
+}
+
+// GATEWAY_API_TOKENS を読み込む
+// `gateway_id:token` をカンマ区切りで並べる
+func parseGatewayAPITokens(s string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad format: GATEWAY_API_TOKENS")
+		}
+		if _, ok := tokens[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate gateway id: %v", kv[0])
+		}
+		tokens[kv[0]] = kv[1]
+	}
+	return tokens, nil
+}
+
+// ゲートウェイのトークンを確認し，一致したゲートウェイのIDを返す
+func checkGatewayToken(c echo.Context) (string, int, error) {
+	if len(gatewayAPITokens) == 0 {
+		return "", http.StatusNotFound, fmt.Errorf("not found")
+	}
+
+	token := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	gatewayID := ""
+	// どのトークンに一致したかで処理時間が変わらないよう全て比較する
+	for id, gatewayToken := range gatewayAPITokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(gatewayToken)) == 1 {
+			gatewayID = id
+		}
+	}
+	if gatewayID == "" {
+		return "", http.StatusUnauthorized, fmt.Errorf("unauthorized")
+	}
+	return gatewayID, 0, nil
+}
+
+// ゲートウェイ向けAPIの認証を行うミドルウェア
+// Authorizationヘッダーのトークンからゲートウェイを特定する
+func gatewayAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		gatewayID, errStatusCode, err := checkGatewayToken(c)
+		if err != nil {
+			return c.String(errStatusCode, err.Error())
+		}
+
+		c.Set(gatewayContextID, gatewayID)
+		return next(c)
+	}
+}
+
+// 登録されているISUとその登録日時を1度のクエリで調べる
+func getIsuRegisteredAt(q sqlx.Queryer, jiaIsuUUIDs []string) (map[string]time.Time, error) {
+	res := map[string]time.Time{}
+	if len(jiaIsuUUIDs) == 0 {
+		return res, nil
+	}
+
+	query, args, err := sqlx.In("SELECT `jia_isu_uuid`, `created_at` FROM `isu` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	registered := []Isu{}
+	err = sqlx.Select(q, &registered, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for _, isu := range registered {
+		res[isu.JIAIsuUUID] = isu.CreatedAt
+	}
+	return res, nil
+}
+
+// POST /api/gateway/condition
+// ゲートウェイから複数のISUのコンディションをまとめて受け取る
+// 不正なISUの分だけを拒否し，結果をISU毎に返す
+func postGatewayCondition(c echo.Context) error {
+	req := []PostGatewayConditionRequest{}
+	err := decodeConditionPayload(c.Request(), &req)
+	if err != nil {
+		return respondConditionPayloadError(c, err)
+	}
+	if len(req) == 0 || len(req) > gatewayConditionMaxIsu {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+
+	results := make([]GatewayConditionResult, len(req))
+	reject := func(i int, reason string) {
+		results[i].Status = gatewayConditionRejected
+		results[i].Error = &reason
+	}
+	seen := map[string]struct{}{}
+	jiaIsuUUIDs := []string{}
+	for i, isuReq := range req {
+		results[i] = GatewayConditionResult{
+			JIAIsuUUID:     isuReq.JIAIsuUUID,
+			Status:         gatewayConditionAccepted,
+			ConditionCount: len(isuReq.Conditions),
+		}
+		if isuReq.JIAIsuUUID == "" {
+			reject(i, "missing: jia_isu_uuid")
+			continue
+		}
+		if _, ok := seen[isuReq.JIAIsuUUID]; ok {
+			reject(i, "duplicate: jia_isu_uuid")
+			continue
+		}
+		seen[isuReq.JIAIsuUUID] = struct{}{}
+		if len(isuReq.Conditions) == 0 {
+			reject(i, "missing: conditions")
+			continue
+		}
+		for _, cond := range isuReq.Conditions {
+			if !isValidConditionFormat(cond.Condition) {
+				reject(i, "bad format: condition")
+				break
+			}
+		}
+		if results[i].Error == nil {
+			jiaIsuUUIDs = append(jiaIsuUUIDs, isuReq.JIAIsuUUID)
+		}
+	}
+
+	registeredAt, err := getIsuRegisteredAt(db, jiaIsuUUIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	accepted := []int{}
+	conditions := make([][]PostIsuConditionRequest, len(req))
+	quarantined := make([][]quarantinedCondition, len(req))
+	for i := range req {
+		if results[i].Error != nil {
+			continue
+		}
+		isuRegisteredAt, ok := registeredAt[req[i].JIAIsuUUID]
+		if !ok {
+			reject(i, "not found: isu")
+			continue
+		}
+		conditions[i], quarantined[i], err = conditionTimestamps.apply(req[i].Conditions, isuRegisteredAt, now)
+		if err != nil {
+			reject(i, err.Error())
+			continue
+		}
+		results[i].QuarantinedCount = len(quarantined[i])
+		accepted = append(accepted, i)
+	}
+	// 他のリクエストと行ロックの順序が揃うよう，ISUの順に保存する
+	sort.Slice(accepted, func(a, b int) bool {
+		return req[accepted[a]].JIAIsuUUID < req[accepted[b]].JIAIsuUUID
+	})
+
+	if len(accepted) > 0 {
+		tx, err := db.Beginx()
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		defer tx.Rollback()
+
+		// シャード毎にトランザクションを1つずつ使う
+		shardTxs := map[*conditionShard]*sqlx.Tx{}
+		ownedShardTxs := []*sqlx.Tx{}
+		defer func() {
+			for _, shardTx := range ownedShardTxs {
+				shardTx.Rollback()
+			}
+		}()
+
+		acceptedIsuUUIDs := make([]string, 0, len(accepted))
+		acceptedConditions := make([][]PostIsuConditionRequest, 0, len(accepted))
+		for _, i := range accepted {
+			acceptedIsuUUIDs = append(acceptedIsuUUIDs, req[i].JIAIsuUUID)
+			acceptedConditions = append(acceptedConditions, conditions[i])
+		}
+		placements, err := conditionShards.Lock(tx, acceptedIsuUUIDs)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		latest := make([]LatestIsuCondition, 0, len(accepted))
+		registeredMessages := []string{}
+		for _, i := range accepted {
+			shard := placements[req[i].JIAIsuUUID]
+			shardTx, ok := shardTxs[shard]
+			if !ok {
+				var owned bool
+				shardTx, owned, err = shard.beginTx(tx)
+				if err != nil {
+					c.Logger().Error(err)
+					return c.NoContent(http.StatusInternalServerError)
+				}
+				shardTxs[shard] = shardTx
+				if owned {
+					ownedShardTxs = append(ownedShardTxs, shardTx)
+				}
+			}
+
+			err = insertQuarantinedConditions(shardTx, req[i].JIAIsuUUID, quarantined[i])
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			latestCondition, messages, err := insertIsuConditions(tx, shardTx, req[i].JIAIsuUUID, conditions[i], now)
+			if err != nil {
+				c.Logger().Error(err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			if latestCondition != nil {
+				latest = append(latest, *latestCondition)
+			}
+			registeredMessages = append(registeredMessages, messages...)
+		}
+
+		for _, shardTx := range ownedShardTxs {
+			err = shardTx.Commit()
+			if err != nil {
+				c.Logger().Errorf("db error: %v", err)
+				return c.NoContent(http.StatusInternalServerError)
+			}
+		}
+		err = tx.Commit()
+		if err != nil && len(ownedShardTxs) > 0 {
+			// プライマリ以外のシャードのISUのコンディションは保存済みなので，再送させて重複させないよう受け付けたことにする
+			// プライマリに置くISUのコンディションは失われたので，そのISUだけ拒否して再送させる
+			c.Logger().Errorf("db error: %v", err)
+			storedIsuUUIDs := []string{}
+			storedConditions := [][]PostIsuConditionRequest{}
+			for n, i := range accepted {
+				if placements[req[i].JIAIsuUUID].isPrimary() {
+					reject(i, "failed to save conditions")
+					continue
+				}
+				storedIsuUUIDs = append(storedIsuUUIDs, acceptedIsuUUIDs[n])
+				storedConditions = append(storedConditions, acceptedConditions[n])
+			}
+			latest, registeredMessages, err = retryIsuConditionSummaries(storedIsuUUIDs, storedConditions, now)
+			if err != nil {
+				c.Logger().Errorf("failed to save summary of stored conditions: %v", err)
+			}
+		} else if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, latestCondition := range latest {
+			latestConditions.Set(latestCondition)
+		}
+		conditionMessages.add(registeredMessages)
+	}
+
+	res := PostGatewayConditionResponse{Results: results}
+	for _, result := range results {
+		if result.Error == nil {
+			res.Accepted++
+		} else {
+			res.Rejected++
+		}
+	}
+	return c.JSON(http.StatusAccepted, res)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	graphCompareMaxIsu = 10
+	graphHours         = 24
+)
+
+type GraphCompareResponse struct {
+	StartAt   int64                    `json:"start_at"`
+	EndAt     int64                    `json:"end_at"`
+	Isus      []*GraphCompareSeries    `json:"isus"`
+	Aggregate []*GraphCompareDataPoint `json:"aggregate"`
+}
+
+// ISU毎のグラフ
+// 全てのISUで同じ時間帯の要素が同じ位置に並ぶ
+type GraphCompareSeries struct {
+	JIAIsuUUID string                   `json:"jia_isu_uuid"`
+	Name       string                   `json:"name"`
+	Graph      []*GraphCompareDataPoint `json:"graph"`
+}
+
+type GraphCompareDataPoint struct {
+	StartAt        int64           `json:"start_at"`
+	EndAt          int64           `json:"end_at"`
+	Data           *GraphDataPoint `json:"data"`
+	ConditionCount int             `json:"condition_count"`
+}
+
+// 1時間毎にコンディションを集め，グラフの要素を計算する
+func newGraphCompareDataPoints(profile *ScoringProfile, graphDate time.Time, conditionsByHour [][]IsuCondition) ([]*GraphCompareDataPoint, error) {
+	res := make([]*GraphCompareDataPoint, 0, len(conditionsByHour))
+	for i, conditions := range conditionsByHour {
+		startAt := graphDate.Add(time.Hour * time.Duration(i))
+		point := &GraphCompareDataPoint{
+			StartAt:        startAt.Unix(),
+			EndAt:          startAt.Add(time.Hour).Unix(),
+			ConditionCount: len(conditions),
+		}
+		if len(conditions) > 0 {
+			data, err := calculateGraphDataPoint(profile, conditions)
+			if err != nil {
+				return nil, err
+			}
+			point.Data = &data
+		}
+		res = append(res, point)
+	}
+	return res, nil
+}
+
+// 複数のISUのグラフと，それらをまとめたグラフを1度のクエリで計算する
+// まとめたグラフは，各ISUのスコアの平均ではなく全てのコンディションから計算する
+func generateIsuGraphCompareResponse(profile *ScoringProfile, isuList []Isu, graphDate time.Time) (*GraphCompareResponse, error) {
+	endAt := graphDate.Add(time.Hour * graphHours)
+
+	indexes := map[string]int{}
+	jiaIsuUUIDs := []string{}
+	conditionsByIsu := make([][][]IsuCondition, len(isuList))
+	for i, isu := range isuList {
+		indexes[isu.JIAIsuUUID] = i
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+		conditionsByIsu[i] = make([][]IsuCondition, graphHours)
+	}
+	aggregate := make([][]IsuCondition, graphHours)
+
+	shards, groups := conditionShards.Group(jiaIsuUUIDs)
+	for i, shard := range shards {
+		err := selectConditionsInRange(shard.DB, groups[i], graphDate, endAt, func(condition IsuCondition) {
+			hour := int(condition.Timestamp.Sub(graphDate) / time.Hour)
+			i := indexes[condition.JIAIsuUUID]
+			conditionsByIsu[i][hour] = append(conditionsByIsu[i][hour], condition)
+			aggregate[hour] = append(aggregate[hour], condition)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := &GraphCompareResponse{
+		StartAt: graphDate.Unix(),
+		EndAt:   endAt.Unix(),
+		Isus:    []*GraphCompareSeries{},
+	}
+	for i, isu := range isuList {
+		graph, err := newGraphCompareDataPoints(profile, graphDate, conditionsByIsu[i])
+		if err != nil {
+			return nil, err
+		}
+		res.Isus = append(res.Isus, &GraphCompareSeries{
+			JIAIsuUUID: isu.JIAIsuUUID,
+			Name:       isu.Name,
+			Graph:      graph,
+		})
+	}
+	aggregateGraph, err := newGraphCompareDataPoints(profile, graphDate, aggregate)
+	if err != nil {
+		return nil, err
+	}
+	res.Aggregate = aggregateGraph
+	return res, nil
+}
+
+// 期間内のISUのコンディションを順に読む
+func selectConditionsInRange(db *sqlx.DB, jiaIsuUUIDs []string, startAt time.Time, endAt time.Time, f func(IsuCondition)) error {
+	query, args, err := sqlx.In(
+		"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` IN (?) AND ? <= `timestamp` AND `timestamp` < ?",
+		jiaIsuUUIDs, startAt, endAt)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var condition IsuCondition
+		err = rows.StructScan(&condition)
+		if err != nil {
+			return err
+		}
+		f(condition)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// GET /api/graph/compare
+// 複数のISUのコンディショングラフを並べて比較するための情報を取得
+func getIsuGraphCompare(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUIDs := []string{}
+	seen := map[string]struct{}{}
+	for _, jiaIsuUUID := range c.QueryParams()["isu"] {
+		if _, ok := seen[jiaIsuUUID]; ok || jiaIsuUUID == "" {
+			continue
+		}
+		seen[jiaIsuUUID] = struct{}{}
+		jiaIsuUUIDs = append(jiaIsuUUIDs, jiaIsuUUID)
+	}
+	if len(jiaIsuUUIDs) == 0 {
+		return c.String(http.StatusBadRequest, "missing: isu")
+	}
+	if len(jiaIsuUUIDs) > graphCompareMaxIsu {
+		return c.String(http.StatusBadRequest, "bad format: isu")
+	}
+
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return c.String(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: datetime")
+	}
+	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	query, args, err := sqlx.In(
+		"SELECT `id`, `jia_isu_uuid`, `name` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` IN (?)",
+		jiaUserID, jiaIsuUUIDs)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	found := []Isu{}
+	err = db.Select(&found, query, args...)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if len(found) != len(jiaIsuUUIDs) {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	// 指定された順に並べる
+	isuByUUID := map[string]Isu{}
+	for _, isu := range found {
+		isuByUUID[isu.JIAIsuUUID] = isu
+	}
+	isuList := make([]Isu, 0, len(jiaIsuUUIDs))
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		isuList = append(isuList, isuByUUID[jiaIsuUUID])
+	}
+
+	res, err := generateIsuGraphCompareResponse(profile, isuList, date)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,821 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	isuGroupMaxCount          = 100
+	isuGroupNameMaxLength     = 255
+	isuGroupMaxTags           = 10
+	isuGroupMaxIsu            = 100
+	isuGroupConditionMaxLimit = 100
+	isuGroupMemberColumns     = "`id`, `jia_isu_uuid`, `name`, `character`, `jia_user_id`, `created_at`, `updated_at`"
+
+	auditActionCreateIsuGroup = "create_isu_group"
+	auditActionUpdateIsuGroup = "update_isu_group"
+	auditActionDeleteIsuGroup = "delete_isu_group"
+)
+
+var (
+	errIsuGroupIsuNotFound = errors.New("not found: isu")
+)
+
+// ユーザーが定義したISUのグループ
+// 指定した全てのタグを持つISUと，個別に指定したISUがメンバーになる
+type IsuGroup struct {
+	ID        int64     `db:"id"`
+	JIAUserID string    `db:"jia_user_id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type IsuGroupRequest struct {
+	Name        string   `json:"name"`
+	Tags        []string `json:"tags"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+}
+
+type IsuGroupResponse struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Tags        []string `json:"tags"`
+	JIAIsuUUIDs []string `json:"jia_isu_uuids"`
+	IsuCount    int      `json:"isu_count"`
+}
+
+type IsuGroupConditionLevelCount struct {
+	Info     int `json:"info"`
+	Warning  int `json:"warning"`
+	Critical int `json:"critical"`
+	None     int `json:"none"` // コンディションをまだ受け取っていない
+}
+
+type IsuGroupConnectivityCount struct {
+	Online  int `json:"online"`
+	Late    int `json:"late"`
+	Offline int `json:"offline"`
+}
+
+type IsuGroupIsuSummary struct {
+	JIAIsuUUID         string                   `json:"jia_isu_uuid"`
+	Name               string                   `json:"name"`
+	Connectivity       string                   `json:"connectivity"`
+	LatestIsuCondition *GetIsuConditionResponse `json:"latest_isu_condition"`
+}
+
+type IsuGroupSummaryResponse struct {
+	ID             int64                       `json:"id"`
+	Name           string                      `json:"name"`
+	IsuCount       int                         `json:"isu_count"`
+	SittingCount   int                         `json:"sitting_count"`
+	ConditionLevel IsuGroupConditionLevelCount `json:"condition_level"`
+	Connectivity   IsuGroupConnectivityCount   `json:"connectivity"`
+	Isus           []*IsuGroupIsuSummary       `json:"isus"`
+}
+
+// リクエストボディからグループの定義を取得
+// 返すエラーのメッセージはそのままレスポンスとして使う
+func parseIsuGroupRequest(c echo.Context) (*IsuGroupRequest, error) {
+	var req IsuGroupRequest
+	err := c.Bind(&req)
+	if err != nil {
+		return nil, fmt.Errorf("bad request body")
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || utf8.RuneCountInString(req.Name) > isuGroupNameMaxLength {
+		return nil, fmt.Errorf("bad format: name")
+	}
+
+	req.Tags, err = normalizeIsuTags(req.Tags, isuGroupMaxTags)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]struct{}{}
+	jiaIsuUUIDs := []string{}
+	for _, jiaIsuUUID := range req.JIAIsuUUIDs {
+		if jiaIsuUUID == "" {
+			return nil, fmt.Errorf("bad format: jia_isu_uuids")
+		}
+		if _, ok := seen[jiaIsuUUID]; ok {
+			continue
+		}
+		seen[jiaIsuUUID] = struct{}{}
+		jiaIsuUUIDs = append(jiaIsuUUIDs, jiaIsuUUID)
+	}
+	if len(jiaIsuUUIDs) > isuGroupMaxIsu {
+		return nil, fmt.Errorf("bad format: jia_isu_uuids")
+	}
+	req.JIAIsuUUIDs = jiaIsuUUIDs
+
+	return &req, nil
+}
+
+// グループのタグと個別に指定したISUを置き換える
+// 個別に指定したISUは全てユーザーのものでなければならない
+func replaceIsuGroupDefinition(tx *sqlx.Tx, jiaUserID string, groupID int64, req *IsuGroupRequest) error {
+	if len(req.JIAIsuUUIDs) > 0 {
+		query, args, err := sqlx.In("SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` IN (?)",
+			jiaUserID, req.JIAIsuUUIDs)
+		if err != nil {
+			return err
+		}
+		var count int
+		err = tx.Get(&count, query, args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		if count != len(req.JIAIsuUUIDs) {
+			return errIsuGroupIsuNotFound
+		}
+	}
+
+	for _, table := range []string{"isu_group_tag", "isu_group_isu"} {
+		_, err := tx.Exec("DELETE FROM `"+table+"` WHERE `group_id` = ?", groupID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	for _, tag := range req.Tags {
+		_, err := tx.Exec("INSERT INTO `isu_group_tag` (`group_id`, `tag`) VALUES (?, ?)", groupID, tag)
+		if err != nil {
+			if isDuplicateTagError(err) {
+				return errIsuTagDuplicated
+			}
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	for _, jiaIsuUUID := range req.JIAIsuUUIDs {
+		_, err := tx.Exec("INSERT INTO `isu_group_isu` (`group_id`, `jia_isu_uuid`) VALUES (?, ?)", groupID, jiaIsuUUID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
+
+// グループのタグと個別に指定したISU
+func getIsuGroupDefinition(db sqlx.Queryer, groupID int64) ([]string, []string, error) {
+	tags := []string{}
+	err := sqlx.Select(db, &tags, "SELECT `tag` FROM `isu_group_tag` WHERE `group_id` = ? ORDER BY `tag`", groupID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	jiaIsuUUIDs := []string{}
+	err = sqlx.Select(db, &jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu_group_isu` WHERE `group_id` = ? ORDER BY `jia_isu_uuid`", groupID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	return tags, jiaIsuUUIDs, nil
+}
+
+// グループに属するユーザーのISUを登録順に取得する
+// 画像は含まない
+func getIsuGroupMembers(db sqlx.Queryer, jiaUserID string, groupID int64, tags []string) ([]Isu, error) {
+	query := "SELECT " + isuGroupMemberColumns + " FROM `isu` WHERE `jia_user_id` = ?" +
+		" AND (`jia_isu_uuid` IN (SELECT `jia_isu_uuid` FROM `isu_group_isu` WHERE `group_id` = ?)"
+	args := []interface{}{jiaUserID, groupID}
+	if len(tags) > 0 {
+		tagWhere, tagArgs := isuTagCondition(tags)
+		query += " OR " + tagWhere
+		args = append(args, tagArgs...)
+	}
+	query += ") ORDER BY `id`"
+
+	isus := []Isu{}
+	err := sqlx.Select(db, &isus, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return isus, nil
+}
+
+func (g *IsuGroup) toResponse(db sqlx.Queryer) (*IsuGroupResponse, error) {
+	tags, jiaIsuUUIDs, err := getIsuGroupDefinition(db, g.ID)
+	if err != nil {
+		return nil, err
+	}
+	members, err := getIsuGroupMembers(db, g.JIAUserID, g.ID, tags)
+	if err != nil {
+		return nil, err
+	}
+	return &IsuGroupResponse{
+		ID:          g.ID,
+		Name:        g.Name,
+		Tags:        tags,
+		JIAIsuUUIDs: jiaIsuUUIDs,
+		IsuCount:    len(members),
+	}, nil
+}
+
+// パスパラメータのグループを取得
+// 他のユーザーのグループは存在しないものとして扱う
+func getIsuGroupFromParam(c echo.Context, db sqlx.Queryer, jiaUserID string) (*IsuGroup, int, error) {
+	groupID, err := strconv.ParseInt(c.Param("group_id"), 10, 64)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("bad format: group_id")
+	}
+
+	var group IsuGroup
+	err = sqlx.Get(db, &group, "SELECT * FROM `isu_group` WHERE `id` = ? AND `jia_user_id` = ?", groupID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, http.StatusNotFound, fmt.Errorf("not found: group")
+		}
+		return nil, http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
+	}
+	return &group, http.StatusOK, nil
+}
+
+// getIsuGroupFromParam のエラーをレスポンスに変換
+func respondIsuGroupError(c echo.Context, statusCode int, err error) error {
+	if statusCode == http.StatusInternalServerError {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.String(statusCode, err.Error())
+}
+
+// GET /api/group
+// 自分のISUのグループを取得
+func getIsuGroups(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	readerDB := readDB(c, db)
+	groups := []IsuGroup{}
+	err = readerDB.Select(&groups, "SELECT * FROM `isu_group` WHERE `jia_user_id` = ? ORDER BY `id`", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []*IsuGroupResponse{}
+	for _, group := range groups {
+		groupRes, err := group.toResponse(readerDB)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		res = append(res, groupRes)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// POST /api/group
+// ISUのグループを作成
+func postIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditTarget(c, jiaUserID, "")
+
+	req, err := parseIsuGroupRequest(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	// 同時に作成しても上限を超えないよう，ユーザーの行をロックしてから数える
+	var userCount int
+	err = tx.Get(&userCount, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ? FOR UPDATE", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var groupCount int
+	err = tx.Get(&groupCount, "SELECT COUNT(*) FROM `isu_group` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if groupCount >= isuGroupMaxCount {
+		return c.String(http.StatusConflict, "too many groups")
+	}
+
+	result, err := tx.Exec("INSERT INTO `isu_group` (`jia_user_id`, `name`) VALUES (?, ?)", jiaUserID, req.Name)
+	if err != nil {
+		mysqlErr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "duplicated: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	groupID, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditDetail(c, fmt.Sprintf("group %d", groupID))
+
+	err = replaceIsuGroupDefinition(tx, jiaUserID, groupID, req)
+	if err != nil {
+		if errors.Is(err, errIsuGroupIsuNotFound) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errors.Is(err, errIsuTagDuplicated) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var group IsuGroup
+	err = tx.Get(&group, "SELECT * FROM `isu_group` WHERE `id` = ?", groupID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	res, err := group.toResponse(tx)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, res)
+}
+
+// GET /api/group/:group_id
+// ISUのグループを取得
+func getIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	readerDB := readDB(c, db)
+	group, statusCode, err := getIsuGroupFromParam(c, readerDB, jiaUserID)
+	if err != nil {
+		return respondIsuGroupError(c, statusCode, err)
+	}
+
+	res, err := group.toResponse(readerDB)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// PUT /api/group/:group_id
+// ISUのグループの名前とメンバーの条件を置き換える
+func putIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditTarget(c, jiaUserID, "")
+
+	req, err := parseIsuGroupRequest(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	group, statusCode, err := getIsuGroupFromParam(c, tx, jiaUserID)
+	if err != nil {
+		return respondIsuGroupError(c, statusCode, err)
+	}
+	setAuditDetail(c, fmt.Sprintf("group %d", group.ID))
+
+	_, err = tx.Exec("UPDATE `isu_group` SET `name` = ? WHERE `id` = ?", req.Name, group.ID)
+	if err != nil {
+		mysqlErr, ok := err.(*mysql.MySQLError)
+		if ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			return c.String(http.StatusConflict, "duplicated: group")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = replaceIsuGroupDefinition(tx, jiaUserID, group.ID, req)
+	if err != nil {
+		if errors.Is(err, errIsuGroupIsuNotFound) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+		if errors.Is(err, errIsuTagDuplicated) {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	group.Name = req.Name
+	res, err := group.toResponse(tx)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// DELETE /api/group/:group_id
+// ISUのグループを削除．メンバーのISUはそのまま
+func deleteIsuGroup(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditTarget(c, jiaUserID, "")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	group, statusCode, err := getIsuGroupFromParam(c, tx, jiaUserID)
+	if err != nil {
+		return respondIsuGroupError(c, statusCode, err)
+	}
+	setAuditDetail(c, fmt.Sprintf("group %d", group.ID))
+
+	for _, table := range []string{"isu_group_tag", "isu_group_isu"} {
+		_, err = tx.Exec("DELETE FROM `"+table+"` WHERE `group_id` = ?", group.ID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	_, err = tx.Exec("DELETE FROM `isu_group` WHERE `id` = ?", group.ID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// パスパラメータのグループとそのメンバーを取得
+func getIsuGroupAndMembersFromParam(c echo.Context, db *sqlx.DB, jiaUserID string) (*IsuGroup, []Isu, int, error) {
+	group, statusCode, err := getIsuGroupFromParam(c, db, jiaUserID)
+	if err != nil {
+		return nil, nil, statusCode, err
+	}
+	tags, _, err := getIsuGroupDefinition(db, group.ID)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	members, err := getIsuGroupMembers(db, jiaUserID, group.ID, tags)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	return group, members, http.StatusOK, nil
+}
+
+// GET /api/group/:group_id/summary
+// グループのISUの最新のコンディションと接続状況をまとめて取得
+func getIsuGroupSummary(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	readerDB := readDB(c, db)
+	group, members, statusCode, err := getIsuGroupAndMembersFromParam(c, readerDB, jiaUserID)
+	if err != nil {
+		return respondIsuGroupError(c, statusCode, err)
+	}
+
+	connectivities, err := getIsuConnectivitiesByUser(readerDB, jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	res := IsuGroupSummaryResponse{
+		ID:       group.ID,
+		Name:     group.Name,
+		IsuCount: len(members),
+		Isus:     []*IsuGroupIsuSummary{},
+	}
+	for _, isu := range members {
+		summary := &IsuGroupIsuSummary{
+			JIAIsuUUID: isu.JIAIsuUUID,
+			Name:       isu.Name,
+		}
+
+		lastIngestedAt, _ := connectivities[isu.JIAIsuUUID].lastIngestedAtOr(isu)
+		summary.Connectivity = calculateConnectivity(lastIngestedAt, now)
+		switch summary.Connectivity {
+		case connectivityOnline:
+			res.Connectivity.Online++
+		case connectivityLate:
+			res.Connectivity.Late++
+		case connectivityOffline:
+			res.Connectivity.Offline++
+		}
+
+		lastCondition, ok := latestConditions.Get(isu.JIAIsuUUID)
+		if !ok {
+			res.ConditionLevel.None++
+			res.Isus = append(res.Isus, summary)
+			continue
+		}
+		summary.LatestIsuCondition, err = lastCondition.toResponse(profile, isu.Name)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		switch summary.LatestIsuCondition.ConditionLevel {
+		case conditionLevelInfo:
+			res.ConditionLevel.Info++
+		case conditionLevelWarning:
+			res.ConditionLevel.Warning++
+		case conditionLevelCritical:
+			res.ConditionLevel.Critical++
+		}
+		if summary.LatestIsuCondition.IsSitting {
+			res.SittingCount++
+		}
+		res.Isus = append(res.Isus, summary)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/group/:group_id/graph
+// グループのISUのグラフと，それらをまとめたグラフを取得
+// ISUが多い場合はページに分け，まとめたグラフはそのページのISUだけから計算する
+func getIsuGroupGraph(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	datetimeStr := c.QueryParam("datetime")
+	if datetimeStr == "" {
+		return c.String(http.StatusBadRequest, "missing: datetime")
+	}
+	datetimeInt64, err := strconv.ParseInt(datetimeStr, 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: datetime")
+	}
+	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	afterID := 0
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		afterID, err = strconv.Atoi(cursorStr)
+		if err != nil || afterID <= 0 {
+			return c.String(http.StatusBadRequest, "bad format: cursor")
+		}
+	}
+
+	_, members, statusCode, err := getIsuGroupAndMembersFromParam(c, readDB(c, db), jiaUserID)
+	if err != nil {
+		return respondIsuGroupError(c, statusCode, err)
+	}
+
+	// 比較するグラフと同じく1度に計算するISUの数を抑え，残りは続きのページとして返す
+	// メンバーはIDの順に並んでいるので，前のページの最後のIDより後から取り出す
+	start := sort.Search(len(members), func(i int) bool {
+		return members[i].ID > afterID
+	})
+	members = members[start:]
+	if len(members) > graphCompareMaxIsu {
+		members = members[:graphCompareMaxIsu]
+		c.Response().Header().Set(isuListNextCursorHeader, strconv.Itoa(members[len(members)-1].ID))
+	}
+
+	res, err := generateIsuGraphCompareResponse(profile, members, date)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// シャード上のISUのコンディションから，コンディションレベルが一致するものを新しい順に limit 件取得する
+func selectShardConditionsByLevel(db *sqlx.DB, profile *ScoringProfile, isuNames map[string]string, jiaIsuUUIDs []string, endTime time.Time,
+	conditionLevel map[string]interface{}, startTime time.Time, limit int) ([]*GetIsuConditionResponse, error) {
+
+	query := "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` IN (?) AND `timestamp` < ?"
+	args := []interface{}{jiaIsuUUIDs, endTime}
+	if !startTime.IsZero() {
+		query += " AND ? <= `timestamp`"
+		args = append(args, startTime)
+	}
+	query += " ORDER BY `timestamp` DESC, `id` DESC"
+	query, args, err := sqlx.In(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	res := []*GetIsuConditionResponse{}
+	for len(res) < limit && rows.Next() {
+		var condition IsuCondition
+		err = rows.StructScan(&condition)
+		if err != nil {
+			return nil, err
+		}
+		cLevel, err := profile.conditionLevel(condition.Condition)
+		if err != nil {
+			continue
+		}
+		if _, ok := conditionLevel[cLevel]; !ok {
+			continue
+		}
+		res = append(res, &GetIsuConditionResponse{
+			JIAIsuUUID:     condition.JIAIsuUUID,
+			IsuName:        isuNames[condition.JIAIsuUUID],
+			Timestamp:      condition.Timestamp.Unix(),
+			IsSitting:      condition.IsSitting,
+			Condition:      condition.Condition,
+			ConditionLevel: cLevel,
+			Message:        condition.Message,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return res, nil
+}
+
+// GET /api/group/:group_id/condition
+// グループのISUのコンディションを新しい順に取得
+func getIsuGroupConditions(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	endTimeInt64, err := strconv.ParseInt(c.QueryParam("end_time"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: end_time")
+	}
+	endTime := time.Unix(endTimeInt64, 0)
+	conditionLevelCSV := c.QueryParam("condition_level")
+	if conditionLevelCSV == "" {
+		return c.String(http.StatusBadRequest, "missing: condition_level")
+	}
+	conditionLevel := map[string]interface{}{}
+	for _, level := range strings.Split(conditionLevelCSV, ",") {
+		conditionLevel[level] = struct{}{}
+	}
+
+	var startTime time.Time
+	if startTimeStr := c.QueryParam("start_time"); startTimeStr != "" {
+		startTimeInt64, err := strconv.ParseInt(startTimeStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: start_time")
+		}
+		startTime = time.Unix(startTimeInt64, 0)
+	}
+
+	limit := conditionLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > isuGroupConditionMaxLimit {
+			return c.String(http.StatusBadRequest, "bad format: limit")
+		}
+	}
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	_, members, statusCode, err := getIsuGroupAndMembersFromParam(c, readDB(c, db), jiaUserID)
+	if err != nil {
+		return respondIsuGroupError(c, statusCode, err)
+	}
+	res := []*GetIsuConditionResponse{}
+	if len(members) == 0 {
+		return c.JSON(http.StatusOK, res)
+	}
+
+	isuNames := map[string]string{}
+	jiaIsuUUIDs := make([]string, 0, len(members))
+	for _, isu := range members {
+		isuNames[isu.JIAIsuUUID] = isu.Name
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+
+	// シャード毎に limit 件ずつ取得し，併せてから並べ直す
+	shards, groups := conditionShards.Group(jiaIsuUUIDs)
+	for i, shard := range shards {
+		conditions, err := selectShardConditionsByLevel(readDB(c, shard.DB), profile, isuNames, groups[i], endTime, conditionLevel, startTime, limit)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		res = append(res, conditions...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Timestamp > res[j].Timestamp
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
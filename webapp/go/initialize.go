@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	defaultInitialDataPath        = "../sql/1_InitData.sql"
+	initialDataCompressedSuffix   = ".gz"
+	initialDataProgressInterval   = time.Second * 5
+	initialDataMaxStatementLength = 64 * 1024 * 1024
+)
+
+// 初期化時に中身を空にするテーブル
+// テーブルを追加した場合はここにも追加すること
+// `condition_message` は各アプリケーションサーバーが登録済みのメッセージを覚えているため空にしない
+// シャードに振り分けるテーブルはプライマリ以外のシャードでも空にする
+var resetTables = []string{
+	"isu",
+	"isu_condition",
+	"isu_condition_quarantine",
+	"isu_latest_condition",
+	"isu_connectivity",
+	"isu_connectivity_event",
+	"isu_maintenance",
+	"isu_activation",
+	"isu_shard",
+	"isu_deactivation",
+	"isu_tag",
+	"isu_group",
+	"isu_group_tag",
+	"isu_group_isu",
+	"scoring_profile",
+	"isu_association_config",
+	"audit_log",
+	"user",
+	"user_disabled",
+	"user_export",
+	"user_export_chunk",
+}
+
+// 初期化の各段階にかかった時間
+type initializeTiming struct {
+	Reset time.Duration
+	Seed  time.Duration
+}
+
+// Server-Timing ヘッダーの値
+func (t initializeTiming) serverTiming() string {
+	return fmt.Sprintf("reset;dur=%d, seed;dur=%d", t.Reset.Milliseconds(), t.Seed.Milliseconds())
+}
+
+// 全てのテーブルを空にしてから初期データを投入する
+// mysql コマンドやシェルには依存しない
+func resetAndSeed(ctx context.Context) (initializeTiming, error) {
+	var timing initializeTiming
+
+	// セッション変数を変更するため，アプリケーションの接続プールとは別の接続を使う
+	loader, err := mySQLConnectionData.ConnectDB()
+	if err != nil {
+		return timing, fmt.Errorf("failed to connect db: %v", err)
+	}
+	defer loader.Close()
+	loader.SetMaxOpenConns(1)
+
+	conn, err := loader.Connx(ctx)
+	if err != nil {
+		return timing, fmt.Errorf("db error: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SET FOREIGN_KEY_CHECKS = 0, UNIQUE_CHECKS = 0")
+	if err != nil {
+		return timing, fmt.Errorf("db error: %v", err)
+	}
+
+	startedAt := time.Now()
+	for _, table := range resetTables {
+		_, err = conn.ExecContext(ctx, "TRUNCATE TABLE `"+table+"`")
+		if err != nil {
+			return timing, fmt.Errorf("failed to truncate %v: %v", table, err)
+		}
+	}
+	err = truncateRemoteShards()
+	if err != nil {
+		return timing, err
+	}
+	timing.Reset = time.Since(startedAt)
+	log.Infof("initialize: truncated %d tables in %v", len(resetTables), timing.Reset)
+
+	startedAt = time.Now()
+	err = seedInitialData(ctx, conn)
+	if err != nil {
+		return timing, err
+	}
+	// 初期データは全てプライマリに入るので，配置先のシャードに移す
+	err = distributeInitialConditions(db)
+	if err != nil {
+		return timing, err
+	}
+	timing.Seed = time.Since(startedAt)
+
+	return timing, nil
+}
+
+// 初期データのダンプの場所
+// INITIAL_DATA_PATH が無ければ，作業ディレクトリではなく実行ファイルの場所から探す
+// `go run` のように実行ファイルの隣に無い場合は作業ディレクトリからの相対パスを使う
+func resolveInitialDataPath() string {
+	if path := os.Getenv("INITIAL_DATA_PATH"); path != "" {
+		return path
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return defaultInitialDataPath
+	}
+	path := filepath.Join(filepath.Dir(exe), defaultInitialDataPath)
+	for _, candidate := range []string{path + initialDataCompressedSuffix, path} {
+		if _, err := os.Stat(candidate); err == nil {
+			return path
+		}
+	}
+	return defaultInitialDataPath
+}
+
+// 初期データのダンプを開く
+// 圧縮されたものがあればそれを優先する
+func openInitialData() (io.ReadCloser, string, error) {
+	initialDataPath := resolveInitialDataPath()
+	initialDataCompressedPath := initialDataPath + initialDataCompressedSuffix
+	f, err := os.Open(initialDataCompressedPath)
+	if err == nil {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, "", fmt.Errorf("failed to read %v: %v", initialDataCompressedPath, err)
+		}
+		return &gzipFile{Reader: gz, file: f}, initialDataCompressedPath, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, "", err
+	}
+
+	f, err = os.Open(initialDataPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, initialDataPath, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// 読み込んだバイト数を数える
+type countingReader struct {
+	r     io.Reader
+	count int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
+
+// 初期データのダンプを読みながら INSERT 文を順に実行する
+// ダンプの INSERT 文は複数行をまとめたものなので，そのままバッチとして実行する
+func seedInitialData(ctx context.Context, conn *sqlx.Conn) error {
+	f, path, err := openInitialData()
+	if err != nil {
+		return fmt.Errorf("failed to open initial data: %v", err)
+	}
+	defer f.Close()
+
+	counter := &countingReader{r: f}
+	r := bufio.NewReaderSize(counter, 1024*1024)
+
+	startedAt := time.Now()
+	lastReportedAt := startedAt
+	statements := 0
+	for {
+		statement, err := readSQLStatement(r)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read %v: %v", path, err)
+		}
+
+		if strings.HasPrefix(statement, "INSERT ") {
+			_, execErr := conn.ExecContext(ctx, statement)
+			if execErr != nil {
+				return fmt.Errorf("failed to load initial data: %v", execErr)
+			}
+			statements++
+		}
+
+		if time.Since(lastReportedAt) >= initialDataProgressInterval {
+			log.Infof("initialize: loaded %d statements (%d MiB read) in %v", statements, counter.count/1024/1024, time.Since(startedAt))
+			lastReportedAt = time.Now()
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	log.Infof("initialize: loaded %d statements (%d MiB read) from %v in %v", statements, counter.count/1024/1024, path, time.Since(startedAt))
+	return nil
+}
+
+// ダンプから文を一つ読み込む
+// 文字列リテラル中の `;` は区切りとみなさず，行頭の `--` コメントは読み飛ばす
+func readSQLStatement(r *bufio.Reader) (string, error) {
+	var sb strings.Builder
+	var quote byte
+	escaped := false
+	lineStart := true
+
+	for {
+		if sb.Len() > initialDataMaxStatementLength {
+			return "", fmt.Errorf("statement too long")
+		}
+
+		b, err := r.ReadByte()
+		if err != nil {
+			return strings.TrimSpace(sb.String()), err
+		}
+
+		if quote != 0 {
+			sb.WriteByte(b)
+			switch {
+			case escaped:
+				escaped = false
+			case b == '\\':
+				escaped = true
+			case b == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		if lineStart && sb.Len() == 0 && b == '-' {
+			next, err := r.Peek(1)
+			if err == nil && next[0] == '-' {
+				_, err = r.ReadString('\n')
+				if err != nil {
+					return "", err
+				}
+				continue
+			}
+		}
+		lineStart = b == '\n'
+
+		switch b {
+		case '\'', '"', '`':
+			quote = b
+		case ';':
+			return strings.TrimSpace(sb.String()), nil
+		case '\n', '\r', ' ', '\t':
+			if sb.Len() == 0 {
+				lineStart = true
+				continue
+			}
+		}
+		sb.WriteByte(b)
+	}
+}
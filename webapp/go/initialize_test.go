@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAllSQLStatements(t *testing.T, dump string) []string {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(dump))
+	statements := []string{}
+	for {
+		statement, err := readSQLStatement(r)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+		if errors.Is(err, io.EOF) {
+			return statements
+		}
+	}
+}
+
+func TestReadSQLStatement(t *testing.T) {
+	tests := []struct {
+		name string
+		dump string
+		want []string
+	}{
+		{
+			name: "statements",
+			dump: "INSERT INTO `a` VALUES (1);\nINSERT INTO `b` VALUES (2);\n",
+			want: []string{"INSERT INTO `a` VALUES (1)", "INSERT INTO `b` VALUES (2)"},
+		},
+		{
+			name: "multiple lines",
+			dump: "INSERT INTO `a` VALUES\n  (1),\n  (2);\n",
+			want: []string{"INSERT INTO `a` VALUES\n  (1),\n  (2)"},
+		},
+		{
+			name: "semicolon in literals",
+			dump: "INSERT INTO `a;b` VALUES ('x;y', \"z;w\");",
+			want: []string{"INSERT INTO `a;b` VALUES ('x;y', \"z;w\")"},
+		},
+		{
+			name: "escaped quotes",
+			dump: `INSERT INTO a VALUES ('it\'s;', 'back\\');INSERT INTO b VALUES ('');`,
+			want: []string{`INSERT INTO a VALUES ('it\'s;', 'back\\')`, `INSERT INTO b VALUES ('')`},
+		},
+		{
+			name: "comments",
+			dump: "-- MySQL dump\n--\nINSERT INTO `a` VALUES ('--');\n  -- indented\nINSERT INTO `b` VALUES (1);\n",
+			want: []string{"INSERT INTO `a` VALUES ('--')", "INSERT INTO `b` VALUES (1)"},
+		},
+		{
+			name: "negative number",
+			dump: "INSERT INTO `a` VALUES\n-1;",
+			want: []string{"INSERT INTO `a` VALUES\n-1"},
+		},
+		{
+			name: "without trailing semicolon",
+			dump: "INSERT INTO `a` VALUES (1);\nINSERT INTO `b` VALUES (2)\n",
+			want: []string{"INSERT INTO `a` VALUES (1)", "INSERT INTO `b` VALUES (2)"},
+		},
+		{
+			name: "crlf",
+			dump: "-- comment\r\nINSERT INTO `a` VALUES (1);\r\n",
+			want: []string{"INSERT INTO `a` VALUES (1)"},
+		},
+		{
+			name: "empty",
+			dump: "",
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readAllSQLStatements(t, tt.dump)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSQLStatementTooLong(t *testing.T) {
+	r := bufio.NewReader(io.MultiReader(
+		strings.NewReader("INSERT INTO `a` VALUES ('"),
+		io.LimitReader(letterReader{}, initialDataMaxStatementLength+1),
+	))
+	_, err := readSQLStatement(r)
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("err = %v, want statement too long", err)
+	}
+}
+
+type letterReader struct{}
+
+func (letterReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
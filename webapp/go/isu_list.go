@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	isuListMaxLimit         = 100
+	isuListNextCursorHeader = "X-Next-Cursor"
+
+	isuListSortID              = "id"
+	isuListSortName            = "name"
+	isuListSortLatestCondition = "latest_condition"
+)
+
+// GET /api/isu の絞り込み・並び替え・ページングの条件
+type isuListFilter struct {
+	Query          string
+	Character      string
+	Tags           []string
+	ConditionLevel map[string]interface{}
+	StaleFor       time.Duration
+	Sort           string
+	Desc           bool
+	Cursor         *isuListCursor
+	Limit          int
+}
+
+// 前のページの最後のISUの並び替えのキー
+// ISUが一覧から外れても続きから取得できるよう，ISUそのものではなくキーの位置で続きを決める
+type isuListCursor struct {
+	Sort      string `json:"sort"`
+	Desc      bool   `json:"desc"`
+	Name      string `json:"name,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	ID        int    `json:"id"`
+}
+
+func newIsuListCursor(res GetIsuListResponse, sortKey string, desc bool) *isuListCursor {
+	cursor := &isuListCursor{Sort: sortKey, Desc: desc, ID: res.ID}
+	switch sortKey {
+	case isuListSortName:
+		cursor.Name = res.Name
+	case isuListSortLatestCondition:
+		if res.LatestIsuCondition != nil {
+			cursor.Timestamp = res.LatestIsuCondition.Timestamp
+		}
+	}
+	return cursor
+}
+
+func (cursor *isuListCursor) encode() (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// クエリパラメータから一覧の条件を取得
+// 返すエラーのメッセージはそのままレスポンスとして使う
+func parseIsuListFilter(c echo.Context) (*isuListFilter, error) {
+	filter := &isuListFilter{
+		Query:     c.QueryParam("q"),
+		Character: c.QueryParam("character"),
+		Sort:      isuListSortID,
+		Desc:      true,
+	}
+
+	if tagCSV := c.QueryParam("tag"); tagCSV != "" {
+		tags, err := normalizeIsuTags(strings.Split(tagCSV, ","), isuTagMaxCount)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: tag")
+		}
+		filter.Tags = tags
+	}
+
+	if conditionLevelCSV := c.QueryParam("condition_level"); conditionLevelCSV != "" {
+		filter.ConditionLevel = map[string]interface{}{}
+		for _, level := range strings.Split(conditionLevelCSV, ",") {
+			switch level {
+			case conditionLevelInfo, conditionLevelWarning, conditionLevelCritical:
+				filter.ConditionLevel[level] = struct{}{}
+			default:
+				return nil, fmt.Errorf("bad format: condition_level")
+			}
+		}
+	}
+
+	if staleForStr := c.QueryParam("stale_for"); staleForStr != "" {
+		staleFor, err := time.ParseDuration(staleForStr)
+		if err != nil || staleFor <= 0 {
+			return nil, fmt.Errorf("bad format: stale_for")
+		}
+		filter.StaleFor = staleFor
+	}
+
+	if sortStr := c.QueryParam("sort"); sortStr != "" {
+		switch sortStr {
+		case isuListSortID, isuListSortName, isuListSortLatestCondition:
+			filter.Sort = sortStr
+		default:
+			return nil, fmt.Errorf("bad format: sort")
+		}
+	}
+
+	switch c.QueryParam("order") {
+	case "":
+	case "asc":
+		filter.Desc = false
+	case "desc":
+		filter.Desc = true
+	default:
+		return nil, fmt.Errorf("bad format: order")
+	}
+
+	if cursorStr := c.QueryParam("cursor"); cursorStr != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursorStr)
+		if err != nil {
+			return nil, fmt.Errorf("bad format: cursor")
+		}
+		cursor := &isuListCursor{}
+		err = json.Unmarshal(b, cursor)
+		// 並び順の違うカーソルでは続きの位置が決まらない
+		if err != nil || cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+			return nil, fmt.Errorf("bad format: cursor")
+		}
+		filter.Cursor = cursor
+	}
+
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > isuListMaxLimit {
+			return nil, fmt.Errorf("bad format: limit")
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// ISUを取得するSQLの条件部分を組み立てる
+func (f *isuListFilter) where(jiaUserID string) (string, []interface{}) {
+	where := "`jia_user_id` = ?"
+	args := []interface{}{jiaUserID}
+
+	if f.Query != "" {
+		replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		where += " AND `name` LIKE ?"
+		args = append(args, "%"+replacer.Replace(f.Query)+"%")
+	}
+	if f.Character != "" {
+		where += " AND `character` = ?"
+		args = append(args, f.Character)
+	}
+	if len(f.Tags) > 0 {
+		tagWhere, tagArgs := isuTagCondition(f.Tags)
+		where += " AND " + tagWhere
+		args = append(args, tagArgs...)
+	}
+
+	return where, args
+}
+
+// 最新のコンディションを元に絞り込み，並び替えてからページングする
+// 次のページがある場合はそのカーソルも返す
+func (f *isuListFilter) apply(responseList []GetIsuListResponse, now time.Time) ([]GetIsuListResponse, string, error) {
+	filtered := []GetIsuListResponse{}
+	for _, res := range responseList {
+		if f.ConditionLevel != nil {
+			if res.LatestIsuCondition == nil {
+				continue
+			}
+			if _, ok := f.ConditionLevel[res.LatestIsuCondition.ConditionLevel]; !ok {
+				continue
+			}
+		}
+		if f.StaleFor > 0 && res.LatestIsuCondition != nil &&
+			!time.Unix(res.LatestIsuCondition.Timestamp, 0).Before(now.Add(-f.StaleFor)) {
+			continue
+		}
+		filtered = append(filtered, res)
+	}
+
+	sort.SliceStable(filtered, func(i, j int) bool {
+		return f.less(newIsuListCursor(filtered[i], f.Sort, f.Desc), newIsuListCursor(filtered[j], f.Sort, f.Desc))
+	})
+
+	if f.Cursor != nil {
+		start := sort.Search(len(filtered), func(i int) bool {
+			return f.less(f.Cursor, newIsuListCursor(filtered[i], f.Sort, f.Desc))
+		})
+		filtered = filtered[start:]
+	}
+
+	if f.Limit == 0 || len(filtered) <= f.Limit {
+		return filtered, "", nil
+	}
+
+	page := filtered[:f.Limit]
+	nextCursor, err := newIsuListCursor(page[len(page)-1], f.Sort, f.Desc).encode()
+	if err != nil {
+		return nil, "", err
+	}
+	return page, nextCursor, nil
+}
+
+// 並び替えたときに a が b より前に来るか
+// キーが同じ場合はIDで決める
+func (f *isuListFilter) less(a, b *isuListCursor) bool {
+	if f.Desc {
+		a, b = b, a
+	}
+	switch f.Sort {
+	case isuListSortName:
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+	case isuListSortLatestCondition:
+		if a.Timestamp != b.Timestamp {
+			return a.Timestamp < b.Timestamp
+		}
+	}
+	return a.ID < b.ID
+}
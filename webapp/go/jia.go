@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultJIARequestTimeout    = time.Second * 5
+	defaultJIAMaxRetries        = 2
+	defaultJIARetryBaseDelay    = time.Millisecond * 100
+	defaultJIAMaxConnsPerHost   = 32
+	defaultJIABreakerThreshold  = 5
+	defaultJIABreakerCooldown   = time.Second * 10
+	jiaResponseBodyLimit        = 1024 * 1024
+	jiaIdleConnTimeout          = time.Second * 90
+	circuitBreakerStateClosed   = "closed"
+	circuitBreakerStateOpen     = "open"
+	circuitBreakerStateHalfOpen = "half_open"
+)
+
+var (
+	errJIACircuitOpen = errors.New("JIAService circuit breaker is open")
+
+	jiaAPIClient *jiaClient
+)
+
+// JIAのAPIが 202 Accepted 以外を返したときのエラー
+type jiaServiceError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *jiaServiceError) Error() string {
+	return fmt.Sprintf("JIAService returned error: status code %v, message: %v", e.StatusCode, e.Message)
+}
+
+// 再試行すれば成功する可能性がある失敗か
+func (e *jiaServiceError) temporary() bool {
+	switch e.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+type jiaClientConfig struct {
+	Timeout          time.Duration // 1回のリクエストのタイムアウト
+	MaxRetries       int           // 冪等なリクエストを再試行する最大回数
+	RetryBaseDelay   time.Duration // 再試行の待ち時間の基準．試行毎に倍にしてジッターを加える
+	MaxConnsPerHost  int
+	BreakerThreshold int           // 連続で失敗するとサーキットブレーカーが開く回数
+	BreakerCooldown  time.Duration // サーキットブレーカーが開いてから試行を再開するまでの時間
+}
+
+// 環境変数からJIAクライアントの設定を読み込む
+func jiaClientConfigFromEnv() (jiaClientConfig, error) {
+	var cfg jiaClientConfig
+	var err error
+	if cfg.Timeout, err = getEnvDuration("JIA_REQUEST_TIMEOUT", defaultJIARequestTimeout); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxRetries, err = getEnvInt("JIA_MAX_RETRIES", defaultJIAMaxRetries); err != nil {
+		return cfg, err
+	}
+	if cfg.RetryBaseDelay, err = getEnvDuration("JIA_RETRY_BASE_DELAY", defaultJIARetryBaseDelay); err != nil {
+		return cfg, err
+	}
+	if cfg.MaxConnsPerHost, err = getEnvInt("JIA_MAX_CONNS_PER_HOST", defaultJIAMaxConnsPerHost); err != nil {
+		return cfg, err
+	}
+	if cfg.BreakerThreshold, err = getEnvInt("JIA_BREAKER_THRESHOLD", defaultJIABreakerThreshold); err != nil {
+		return cfg, err
+	}
+	if cfg.BreakerCooldown, err = getEnvDuration("JIA_BREAKER_COOLDOWN", defaultJIABreakerCooldown); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// 連続した失敗を検知してJIAへのリクエストを一時的に止める
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, state: circuitBreakerStateClosed}
+}
+
+// リクエストを送ってよいか
+// 開いてから cooldown が経過していれば，様子見として1件だけ通す
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitBreakerStateOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		cb.state = circuitBreakerStateHalfOpen
+		return true
+	case circuitBreakerStateHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+func (cb *circuitBreaker) success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.state = circuitBreakerStateClosed
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) failure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.failures++
+	if cb.state == circuitBreakerStateHalfOpen || (cb.threshold > 0 && cb.failures >= cb.threshold) {
+		cb.state = circuitBreakerStateOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// JIAのAPIクライアント
+type jiaClient struct {
+	httpClient *http.Client
+	cfg        jiaClientConfig
+	breaker    *circuitBreaker
+}
+
+func newJIAClient(cfg jiaClientConfig) *jiaClient {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.Timeout,
+			KeepAlive: time.Second * 30,
+		}).DialContext,
+		MaxIdleConns:        cfg.MaxConnsPerHost,
+		MaxIdleConnsPerHost: cfg.MaxConnsPerHost,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		IdleConnTimeout:     jiaIdleConnTimeout,
+	}
+
+	return &jiaClient{
+		httpClient: &http.Client{Transport: transport},
+		cfg:        cfg,
+		breaker:    newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+	}
+}
+
+// 再試行までの待ち時間
+// 試行毎に倍にし，同時に再試行が集中しないようジッターを加える
+func (jc *jiaClient) backoff(attempt int) time.Duration {
+	delay := jc.cfg.RetryBaseDelay << uint(attempt)
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// JIAにリクエストを送り，期待したステータスコードのレスポンスボディを返す
+// idempotent なリクエストは，通信エラーや一時的なエラーの場合に再試行する
+func (jc *jiaClient) do(ctx context.Context, method string, url string, body []byte, expectedStatus int, idempotent bool) ([]byte, error) {
+	maxAttempts := 1
+	if idempotent {
+		maxAttempts += jc.cfg.MaxRetries
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(jc.backoff(attempt - 1)):
+			}
+		}
+
+		if !jc.breaker.allow() {
+			return nil, errJIACircuitOpen
+		}
+
+		resBody, err := jc.doOnce(ctx, method, url, body, expectedStatus)
+		if err == nil {
+			jc.breaker.success()
+			return resBody, nil
+		}
+		lastErr = err
+
+		var jiaErr *jiaServiceError
+		if errors.As(err, &jiaErr) && !jiaErr.temporary() {
+			// JIAが正常に応答した上でのエラーなので，障害としては数えない
+			jc.breaker.success()
+			return nil, err
+		}
+		jc.breaker.failure()
+
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, lastErr
+}
+
+func (jc *jiaClient) doOnce(ctx context.Context, method string, url string, body []byte, expectedStatus int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, jc.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := jc.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request to JIAService: %v", err)
+	}
+	defer res.Body.Close()
+
+	resBody, err := ioutil.ReadAll(io.LimitReader(res.Body, jiaResponseBodyLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from JIAService: %v", err)
+	}
+
+	if res.StatusCode != expectedStatus {
+		return nil, &jiaServiceError{StatusCode: res.StatusCode, Message: string(resBody)}
+	}
+	return resBody, nil
+}
+
+// JIAにISUのactivateを依頼し，ISUの性格を取得
+// 同じISUを同じ送信先でactivateし直しても結果は変わらないため，冪等なリクエストとして扱う
+func (jc *jiaClient) Activate(ctx context.Context, jiaServiceURL string, jiaIsuUUID string) (*IsuFromJIA, error) {
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	resBody, err := jc.do(ctx, http.MethodPost, jiaServiceURL+"/api/activate", bodyJSON, http.StatusAccepted, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var isuFromJIA IsuFromJIA
+	err = json.Unmarshal(resBody, &isuFromJIA)
+	if err != nil {
+		return nil, err
+	}
+
+	return &isuFromJIA, nil
+}
+
+// JIAにISUのdeactivateを依頼し，コンディションの送信を止めてもらう
+// 既にdeactivateされたISUに送っても結果は変わらないため，冪等なリクエストとして扱う
+//
+// POST /api/deactivate は extra/jiaapi-mock にのみあり，本来のJIAのサービスには無い
+// 404 はISUが見つからない場合と合わせて，deactivate するものが無いとみなす
+func (jc *jiaClient) Deactivate(ctx context.Context, jiaServiceURL string, jiaIsuUUID string) error {
+	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
+	bodyJSON, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	_, err = jc.do(ctx, http.MethodPost, jiaServiceURL+"/api/deactivate", bodyJSON, http.StatusAccepted, true)
+	var jiaErr *jiaServiceError
+	if errors.As(err, &jiaErr) && jiaErr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// JIAのAPIのエラーをレスポンスに変換
+// サーキットブレーカーが開いている場合は 503 を返す
+func respondJIAError(c echo.Context, err error) error {
+	statusCode := jiaErrorStatusCode(err)
+	if errors.Is(err, errJIACircuitOpen) {
+		return c.String(statusCode, "JIAService is unavailable")
+	}
+	var jiaErr *jiaServiceError
+	if errors.As(err, &jiaErr) {
+		return c.String(statusCode, "JIAService returned error")
+	}
+	return c.NoContent(statusCode)
+}
+
+// JIAとの通信の失敗に対応するステータスコード
+// JIAがエラーを返した場合はそのステータスコードを使う
+func jiaErrorStatusCode(err error) int {
+	if errors.Is(err, errJIACircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	var jiaErr *jiaServiceError
+	if errors.As(err, &jiaErr) {
+		return jiaErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// activate できなかったISUの登録を取り消す
+// 登録時に作ったシャードの配置と activate の状態も同じトランザクションで消す
+func deleteUnactivatedIsu(jiaUserID string, jiaIsuUUID string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"DELETE FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ? AND `character` = ''",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return nil
+	}
+	for _, table := range []string{"isu_activation", "isu_shard"} {
+		err = deleteIsuRows(tx, table, []string{jiaIsuUUID})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	latestConditionSyncInterval = time.Second
+	latestConditionInsertBatch  = 1000
+	// `updated_at` より後にコミットされる更新があるため，前回の同期より少し前から読み直す
+	latestConditionSyncOverlap = time.Second * 10
+	// それでも取りこぼした更新は，定期的に全て読み直して取り込む
+	latestConditionReloadInterval = time.Minute
+)
+
+// ISUごとの最新のコンディション
+// `isu_latest_condition` テーブルを正とし，プロセス内にも同じ内容を保持する
+type LatestIsuCondition struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	Timestamp  time.Time `db:"timestamp"`
+	IsSitting  bool      `db:"is_sitting"`
+	Condition  string    `db:"condition"`
+	Message    string    `db:"message"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+// 最新コンディションのプロセス内キャッシュ
+// 他のアプリケーションサーバーでの更新は `updated_at` を見て定期的に取り込み，定期的に全て読み直す
+type latestConditionCache struct {
+	mu         sync.RWMutex
+	conditions map[string]LatestIsuCondition
+	syncedAt   time.Time
+}
+
+var latestConditions = &latestConditionCache{conditions: map[string]LatestIsuCondition{}}
+
+// ISUの最新のコンディションを取得
+func (lc *latestConditionCache) Get(jiaIsuUUID string) (LatestIsuCondition, bool) {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+	cond, ok := lc.conditions[jiaIsuUUID]
+	return cond, ok
+}
+
+// 既存のものより新しい場合のみ最新のコンディションを差し替える
+func (lc *latestConditionCache) Set(cond LatestIsuCondition) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.setLocked(cond)
+}
+
+func (lc *latestConditionCache) setLocked(cond LatestIsuCondition) {
+	if current, ok := lc.conditions[cond.JIAIsuUUID]; ok && current.Timestamp.After(cond.Timestamp) {
+		return
+	}
+	lc.conditions[cond.JIAIsuUUID] = cond
+	if cond.UpdatedAt.After(lc.syncedAt) {
+		lc.syncedAt = cond.UpdatedAt
+	}
+}
+
+// 削除したISUの最新のコンディションを忘れる
+// 他のアプリケーションサーバーには伝わらないが，ISUが存在しなければ参照されない
+func (lc *latestConditionCache) Delete(jiaIsuUUIDs []string) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		delete(lc.conditions, jiaIsuUUID)
+	}
+}
+
+// キャッシュの内容をDBの内容で置き換える
+func (lc *latestConditionCache) Load(db *sqlx.DB) error {
+	conditions := []LatestIsuCondition{}
+	err := db.Select(&conditions, "SELECT * FROM `isu_latest_condition`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.conditions = make(map[string]LatestIsuCondition, len(conditions))
+	lc.syncedAt = time.Time{}
+	for _, cond := range conditions {
+		lc.setLocked(cond)
+	}
+	return nil
+}
+
+// 前回の同期以降にDB上で更新された最新コンディションを取り込む
+// 遅れてコミットされた更新を拾うため，前回の同期より少し前から読む．既に持っているものは古くならない
+func (lc *latestConditionCache) Sync(db *sqlx.DB) error {
+	lc.mu.RLock()
+	syncedAt := lc.syncedAt
+	lc.mu.RUnlock()
+
+	conditions := []LatestIsuCondition{}
+	err := db.Select(&conditions, "SELECT * FROM `isu_latest_condition` WHERE `updated_at` >= ?",
+		syncedAt.Add(-latestConditionSyncOverlap))
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for _, cond := range conditions {
+		lc.setLocked(cond)
+	}
+	return nil
+}
+
+// 他のアプリケーションサーバーによる更新を定期的に取り込む
+// 同期の重なりより長く遅れた更新や他のサーバーでの削除も反映されるよう，定期的に全て読み直す
+func (lc *latestConditionCache) RunSync(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastReloadedAt := time.Now()
+	for now := range ticker.C {
+		var err error
+		if now.Sub(lastReloadedAt) >= latestConditionReloadInterval {
+			err = lc.Load(db)
+			lastReloadedAt = now
+		} else {
+			err = lc.Sync(db)
+		}
+		if err != nil {
+			log.Errorf("failed to sync latest conditions: %v", err)
+		}
+	}
+}
+
+// 受け取ったコンディションのうち最も新しいものを `isu_latest_condition` に反映
+// 既に保存されているものより古い場合は更新しない
+func upsertLatestIsuCondition(tx *sqlx.Tx, jiaIsuUUID string, req []PostIsuConditionRequest) (LatestIsuCondition, error) {
+	latest := req[0]
+	for _, cond := range req[1:] {
+		if cond.Timestamp > latest.Timestamp {
+			latest = cond
+		}
+	}
+
+	// `timestamp` を先に更新すると他のカラムの比較が壊れるため最後に更新する
+	_, err := tx.Exec(
+		"INSERT INTO `isu_latest_condition`"+
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
+			"	VALUES (?, ?, ?, ?, ?)"+
+			"	ON DUPLICATE KEY UPDATE"+
+			"	`is_sitting` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`is_sitting`), `is_sitting`),"+
+			"	`condition` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`condition`), `condition`),"+
+			"	`message` = IF(VALUES(`timestamp`) >= `timestamp`, VALUES(`message`), `message`),"+
+			"	`timestamp` = GREATEST(VALUES(`timestamp`), `timestamp`)",
+		jiaIsuUUID, time.Unix(latest.Timestamp, 0), latest.IsSitting, latest.Condition, latest.Message)
+	if err != nil {
+		return LatestIsuCondition{}, fmt.Errorf("db error: %v", err)
+	}
+
+	var cond LatestIsuCondition
+	err = tx.Get(&cond, "SELECT * FROM `isu_latest_condition` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		return LatestIsuCondition{}, fmt.Errorf("db error: %v", err)
+	}
+	return cond, nil
+}
+
+// `isu_condition` から `isu_latest_condition` を作り直す
+// 初期データの投入などで `isu_condition` が直接書き換えられた後に呼ぶ
+// `isu_condition` は各シャードに，`isu_latest_condition` はプライマリにある
+// ISU毎の最新の時刻は `jia_isu_uuid_timestamp` インデックスを使って1度の集計で求める
+func rebuildLatestIsuConditions(db *sqlx.DB) error {
+	latest := []LatestIsuCondition{}
+	for _, shard := range conditionShards.All() {
+		shardLatest := []LatestIsuCondition{}
+		err := shard.DB.Select(&shardLatest,
+			"SELECT c.`jia_isu_uuid`, c.`timestamp`, c.`is_sitting`, c.`condition`, c.`message`"+
+				"	FROM `isu_condition` c"+
+				"	INNER JOIN ("+
+				"		SELECT c1.`jia_isu_uuid`, MAX(c1.`id`) AS `id` FROM `isu_condition` c1"+
+				"		INNER JOIN ("+
+				"			SELECT `jia_isu_uuid`, MAX(`timestamp`) AS `timestamp` FROM `isu_condition` GROUP BY `jia_isu_uuid`"+
+				"		) m ON c1.`jia_isu_uuid` = m.`jia_isu_uuid` AND c1.`timestamp` = m.`timestamp`"+
+				"		GROUP BY c1.`jia_isu_uuid`"+
+				"	) latest ON c.`id` = latest.`id`")
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		latest = append(latest, shardLatest...)
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `isu_latest_condition`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	for start := 0; start < len(latest); start += latestConditionInsertBatch {
+		end := start + latestConditionInsertBatch
+		if end > len(latest) {
+			end = len(latest)
+		}
+
+		query := "INSERT INTO `isu_latest_condition`" +
+			"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`) VALUES "
+		args := []interface{}{}
+		for i, cond := range latest[start:end] {
+			if i > 0 {
+				query += ","
+			}
+			query += "(?, ?, ?, ?, ?)"
+			args = append(args, cond.JIAIsuUUID, cond.Timestamp, cond.IsSitting, cond.Condition, cond.Message)
+		}
+		_, err = tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	return latestConditions.Load(db)
+}
+
+// 最新コンディションをAPIのレスポンス形式に変換
+func (cond LatestIsuCondition) toResponse(profile *ScoringProfile, isuName string) (*GetIsuConditionResponse, error) {
+	conditionLevel, err := profile.conditionLevel(cond.Condition)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GetIsuConditionResponse{
+		JIAIsuUUID:     cond.JIAIsuUUID,
+		IsuName:        isuName,
+		Timestamp:      cond.Timestamp.Unix(),
+		IsSitting:      cond.IsSitting,
+		Condition:      cond.Condition,
+		ConditionLevel: conditionLevel,
+		Message:        cond.Message,
+	}, nil
+}
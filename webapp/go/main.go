@@ -1,17 +1,15 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
-	"os/exec"
 	"sort"
 	"strconv"
 	"strings"
@@ -28,12 +26,14 @@ import (
 
 const (
 	sessionName                 = "isucondition_go"
+	sessionContextUserID        = "session_jia_user_id"
 	conditionLimit              = 20
 	frontendContentsPath        = "../public"
 	jiaJWTSigningKeyPath        = "../ec256-public.pem"
 	defaultIconFilePath         = "../NoImage.jpg"
 	defaultJIAServiceURL        = "http://localhost:5000"
 	mysqlErrNumDuplicateEntry   = 1062
+	mysqlErrNumParseError       = 1064
 	conditionLevelInfo          = "info"
 	conditionLevelWarning       = "warning"
 	conditionLevelCritical      = "critical"
@@ -77,7 +77,12 @@ type GetIsuListResponse struct {
 	JIAIsuUUID         string                   `json:"jia_isu_uuid"`
 	Name               string                   `json:"name"`
 	Character          string                   `json:"character"`
+	Tags               []string                 `json:"tags"`
 	LatestIsuCondition *GetIsuConditionResponse `json:"latest_isu_condition"`
+	Connectivity       string                   `json:"connectivity"`
+	LastIngestedAt     *int64                   `json:"last_ingested_at"`
+	ActivationStatus   string                   `json:"activation_status"`
+	ActivationError    *string                  `json:"activation_error"`
 }
 
 type IsuCondition struct {
@@ -111,10 +116,11 @@ type GetMeResponse struct {
 }
 
 type GraphResponse struct {
-	StartAt             int64           `json:"start_at"`
-	EndAt               int64           `json:"end_at"`
-	Data                *GraphDataPoint `json:"data"`
-	ConditionTimestamps []int64         `json:"condition_timestamps"`
+	StartAt             int64                     `json:"start_at"`
+	EndAt               int64                     `json:"end_at"`
+	Data                *GraphDataPoint           `json:"data"`
+	ConditionTimestamps []int64                   `json:"condition_timestamps"`
+	Maintenances        []*IsuMaintenanceResponse `json:"maintenances"`
 }
 
 type GraphDataPoint struct {
@@ -178,6 +184,32 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
+// 環境変数から正の時間を取得
+func getEnvDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad format: %v: %v", key, val)
+	}
+	return d, nil
+}
+
+// 環境変数から0以上の整数を取得
+func getEnvInt(key string, defaultValue int) (int, error) {
+	val := os.Getenv(key)
+	if val == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad format: %v: %v", key, val)
+	}
+	return n, nil
+}
+
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
 	return &MySQLConnectionEnv{
 		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
@@ -207,38 +239,116 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebalance" {
+		rebalance(os.Args[2:])
+		return
+	}
+
 	e := echo.New()
 	e.Debug = true
 	e.Logger.SetLevel(log.DEBUG)
 
+	ipExtractor, err := parseTrustedProxies(getEnv("TRUSTED_PROXIES", defaultTrustedProxies))
+	if err != nil {
+		e.Logger.Fatalf("failed to load trusted proxies: %v", err)
+		return
+	}
+	e.IPExtractor = ipExtractor
+
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(readYourWrites)
+
+	openAPIValidation := getEnv("OPENAPI_VALIDATION", openAPIValidationRequest)
+	switch openAPIValidation {
+	case openAPIValidationOff:
+	case openAPIValidationRequest, openAPIValidationResponse:
+		validator, err := newOpenAPIValidator(openAPIDocument, openAPIValidation == openAPIValidationResponse)
+		if err != nil {
+			e.Logger.Fatalf("failed to load OpenAPI document: %v", err)
+			return
+		}
+		e.Use(validator.Middleware())
+	default:
+		e.Logger.Fatalf("bad format: OPENAPI_VALIDATION: %v", openAPIValidation)
+		return
+	}
 
 	e.POST("/initialize", postInitialize)
 
-	e.POST("/api/auth", postAuthentication)
-	e.POST("/api/signout", postSignout)
+	e.POST("/api/auth", postAuthentication, auditLog(auditActionSignIn))
+	e.POST("/api/signout", postSignout, auditLog(auditActionSignOut))
 	e.GET("/api/user/me", getMe)
+	e.DELETE("/api/user/me", deleteMe, auditLog(auditActionDeleteUser))
+	e.GET("/api/user/export", getUserExport)
+	e.GET("/api/user/export/:export_id", getUserExportDownload)
+	e.GET("/api/user/scoring_profile", getMyScoringProfile)
+	e.PUT("/api/user/scoring_profile", putMyScoringProfile, auditLog(auditActionUpdateScoringProfile))
+	e.DELETE("/api/user/scoring_profile", deleteMyScoringProfile, auditLog(auditActionDeleteScoringProfile))
+	e.GET("/api/user/scoring_profile/:version", getMyScoringProfileVersion)
+	e.GET("/api/audit", getMyAuditLogs)
 	e.GET("/api/isu", getIsuList)
-	e.POST("/api/isu", postIsu)
+	e.POST("/api/isu", postIsu, auditLog(auditActionRegisterIsu))
 	e.GET("/api/isu/:jia_isu_uuid", getIsuID)
 	e.GET("/api/isu/:jia_isu_uuid/icon", getIsuIcon)
 	e.GET("/api/isu/:jia_isu_uuid/graph", getIsuGraph)
+	e.GET("/api/graph/compare", getIsuGraphCompare)
+	e.GET("/api/occupancy", getFleetOccupancy)
+	e.GET("/api/isu/:jia_isu_uuid/maintenance", getIsuMaintenances)
+	e.POST("/api/isu/:jia_isu_uuid/maintenance", postIsuMaintenance)
+	e.GET("/api/isu/:jia_isu_uuid/occupancy", getIsuOccupancy)
+	e.GET("/api/isu/:jia_isu_uuid/quarantine", getIsuConditionQuarantine)
+	e.GET("/api/isu/:jia_isu_uuid/tag", getIsuTag)
+	e.PUT("/api/isu/:jia_isu_uuid/tag", putIsuTag, auditLog(auditActionUpdateIsuTag))
+	e.GET("/api/tag", getTags)
+	e.GET("/api/group", getIsuGroups)
+	e.POST("/api/group", postIsuGroup, auditLog(auditActionCreateIsuGroup))
+	e.GET("/api/group/:group_id", getIsuGroup)
+	e.PUT("/api/group/:group_id", putIsuGroup, auditLog(auditActionUpdateIsuGroup))
+	e.DELETE("/api/group/:group_id", deleteIsuGroup, auditLog(auditActionDeleteIsuGroup))
+	e.GET("/api/group/:group_id/summary", getIsuGroupSummary)
+	e.GET("/api/group/:group_id/graph", getIsuGroupGraph)
+	e.GET("/api/group/:group_id/condition", getIsuGroupConditions)
+	e.GET("/api/condition/search", searchIsuConditions)
 	e.GET("/api/condition/:jia_isu_uuid", getIsuConditions)
 	e.GET("/api/trend", getTrend)
+	e.GET("/api/trend/history", getTrendHistory)
+	e.GET("/api/openapi.json", getOpenAPI)
 
 	e.POST("/api/condition/:jia_isu_uuid", postIsuCondition)
+	e.POST("/api/gateway/condition", postGatewayCondition, gatewayAuth)
+
+	admin := e.Group("/api/admin", adminAuth)
+	admin.GET("/user", getAdminUsers)
+	admin.POST("/user/:jia_user_id/disable", postAdminDisableUser, auditLog(auditActionAdminDisableUser))
+	admin.POST("/user/:jia_user_id/enable", postAdminEnableUser, auditLog(auditActionAdminEnableUser))
+	admin.GET("/isu", getAdminIsuList)
+	admin.GET("/isu/:jia_isu_uuid/stats", getAdminIsuStats)
+	admin.POST("/isu/:jia_isu_uuid/activate", postAdminReactivateIsu, auditLog(auditActionAdminReactivateIsu))
+	admin.PUT("/config/jia_service_url", putAdminJIAServiceURL, auditLog(auditActionAdminUpdateJIAService))
+	admin.GET("/config/scoring_profile", getAdminScoringProfile)
+	admin.PUT("/config/scoring_profile", putAdminScoringProfile, auditLog(auditActionAdminUpdateScoringProfile))
+	admin.GET("/audit", getAdminAuditLogs)
 
 	e.GET("/", getIndex)
 	e.GET("/isu/:jia_isu_uuid", getIndex)
 	e.GET("/isu/:jia_isu_uuid/condition", getIndex)
 	e.GET("/isu/:jia_isu_uuid/graph", getIndex)
 	e.GET("/register", getIndex)
-	e.Static("/assets", frontendContentsPath+"/assets")
+	e.GET("/assets/*", getFrontendAsset)
+
+	frontendAssets, err = loadFrontendAssets()
+	if err != nil {
+		e.Logger.Fatalf("failed to load frontend assets: %v", err)
+		return
+	}
 
 	mySQLConnectionData = NewMySQLConnectionEnv()
 
-	var err error
 	db, err = mySQLConnectionData.ConnectDB()
 	if err != nil {
 		e.Logger.Fatalf("failed to connect db: %v", err)
@@ -247,14 +357,187 @@ func main() {
 	db.SetMaxOpenConns(10)
 	defer db.Close()
 
+	schemaMigrationMode := getEnv("SCHEMA_MIGRATION", schemaMigrationModeCheck)
+	err = prepareSchema(context.Background(), db, schemaMigrationMode)
+	if err != nil {
+		e.Logger.Fatalf("failed to prepare schema: %v", err)
+		return
+	}
+
+	shards, err := connectConditionShards(mySQLConnectionData, os.Getenv("MYSQL_SHARDS"))
+	if err != nil {
+		e.Logger.Fatalf("failed to connect shards: %v", err)
+		return
+	}
+	conditionShards = newConditionShardRouter(shards)
+	for _, shard := range conditionShards.Remote() {
+		defer shard.DB.Close()
+		err = prepareSchema(context.Background(), shard.DB, schemaMigrationMode)
+		if err != nil {
+			e.Logger.Fatalf("failed to prepare schema on shard %v: %v", shard.ID, err)
+			return
+		}
+	}
+	err = conditionShards.Load(db)
+	if err != nil {
+		e.Logger.Fatalf("failed to load isu shard placements: %v", err)
+		return
+	}
+	go conditionShards.RunSync(db, shardPlacementSyncInterval)
+
+	replicaMaxLag, readYourWritesWindow, err = replicaSettingsFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to load replica settings: %v", err)
+		return
+	}
+	replicas, err = connectReplicas(mySQLConnectionData, conditionShards, os.Getenv("MYSQL_REPLICAS"))
+	if err != nil {
+		e.Logger.Fatalf("failed to connect replicas: %v", err)
+		return
+	}
+	for _, replica := range replicas.All() {
+		defer replica.DB.Close()
+	}
+	err = replicas.Verify()
+	if err != nil {
+		e.Logger.Fatalf("failed to check replicas: %v", err)
+	}
+	replicas.CheckHealth()
+	go replicas.RunHealthCheck(replicaHealthCheckInterval)
+
+	err = latestConditions.Load(db)
+	if err != nil {
+		e.Logger.Fatalf("failed to load latest conditions: %v", err)
+		return
+	}
+	go latestConditions.RunSync(db, latestConditionSyncInterval)
+
+	err = conditionMessages.Load(db)
+	if err != nil {
+		e.Logger.Fatalf("failed to load condition messages: %v", err)
+		return
+	}
+
+	err = scoringProfiles.Load(db)
+	if err != nil {
+		e.Logger.Fatalf("failed to load scoring profiles: %v", err)
+		return
+	}
+	go scoringProfiles.RunSync(db, scoringProfileSyncInterval)
+
+	if intervalStr := os.Getenv("ISU_EXPECTED_POST_INTERVAL"); intervalStr != "" {
+		isuExpectedPostInterval, err = time.ParseDuration(intervalStr)
+		if err != nil || isuExpectedPostInterval <= 0 {
+			e.Logger.Fatalf("bad format: ISU_EXPECTED_POST_INTERVAL: %v", intervalStr)
+			return
+		}
+	}
+	go runConnectivityMonitor(db, connectivityMonitorInterval)
+
+	adminAPIToken = os.Getenv("ADMIN_API_TOKEN")
+	conditionTimestamps, err = conditionTimestampPolicyFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to load condition timestamp policy: %v", err)
+		return
+	}
+	gatewayAPITokens, err = parseGatewayAPITokens(os.Getenv("GATEWAY_API_TOKENS"))
+	if err != nil {
+		e.Logger.Fatalf("failed to load gateway tokens: %v", err)
+		return
+	}
+
+	jiaConfig, err := jiaClientConfigFromEnv()
+	if err != nil {
+		e.Logger.Fatalf("failed to load JIA client config: %v", err)
+		return
+	}
+	jiaAPIClient = newJIAClient(jiaConfig)
+
+	isuActivationMode = getEnv("ISU_ACTIVATION_MODE", isuActivationModeSync)
+	if isuActivationMode != isuActivationModeSync && isuActivationMode != isuActivationModeAsync {
+		e.Logger.Fatalf("bad format: ISU_ACTIVATION_MODE: %v", isuActivationMode)
+		return
+	}
+	go runActivationWorker(db, activationWorkerInterval)
+	go runDeactivationWorker(db, deactivationWorkerInterval)
+	go runUserExportWorker(db, userExportWorkerInterval)
+
+	conditionPayloadMaxSize, err = getEnvInt("POST_ISU_CONDITION_MAX_BODY_SIZE", defaultConditionPayloadMaxSize)
+	if err != nil || conditionPayloadMaxSize == 0 {
+		e.Logger.Fatalf("bad format: POST_ISU_CONDITION_MAX_BODY_SIZE: %v", os.Getenv("POST_ISU_CONDITION_MAX_BODY_SIZE"))
+		return
+	}
+
 	postIsuConditionTargetBaseURL = os.Getenv("POST_ISUCONDITION_TARGET_BASE_URL")
 	if postIsuConditionTargetBaseURL == "" {
 		e.Logger.Fatalf("missing: POST_ISUCONDITION_TARGET_BASE_URL")
 		return
 	}
 
-	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
-	e.Logger.Fatal(e.Start(serverPort))
+	e.Logger.Fatal(startServer(e))
+}
+
+// `migrate` サブコマンドを実行
+func migrate(args []string) {
+	if len(args) > 0 && args[0] == "schema" {
+		schema, err := generateSchema()
+		if err != nil {
+			log.Fatalf("failed to generate schema: %v", err)
+		}
+		fmt.Print(schema)
+		return
+	}
+
+	var err error
+	db, err = NewMySQLConnectionEnv().ConnectDB()
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	err = runMigrateCommand(db, args)
+	if err != nil {
+		log.Fatalf("failed to migrate: %v", err)
+	}
+
+	shards, err := connectConditionShards(NewMySQLConnectionEnv(), os.Getenv("MYSQL_SHARDS"))
+	if err != nil {
+		log.Fatalf("failed to connect shards: %v", err)
+	}
+	for _, shard := range shards {
+		if shard.isPrimary() {
+			continue
+		}
+		fmt.Printf("shard %v:\n", shard.ID)
+		err = runMigrateCommand(shard.DB, args)
+		shard.DB.Close()
+		if err != nil {
+			log.Fatalf("failed to migrate shard %v: %v", shard.ID, err)
+		}
+	}
+}
+
+func rebalance(args []string) {
+	var err error
+	db, err = NewMySQLConnectionEnv().ConnectDB()
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	shards, err := connectConditionShards(NewMySQLConnectionEnv(), os.Getenv("MYSQL_SHARDS"))
+	if err != nil {
+		log.Fatalf("failed to connect shards: %v", err)
+	}
+	conditionShards = newConditionShardRouter(shards)
+	for _, shard := range conditionShards.Remote() {
+		defer shard.DB.Close()
+	}
+
+	err = runRebalanceCommand(db, args)
+	if err != nil {
+		log.Fatalf("failed to rebalance: %v", err)
+	}
 }
 
 func getSession(r *http.Request) (*sessions.Session, error) {
@@ -266,6 +549,11 @@ func getSession(r *http.Request) (*sessions.Session, error) {
 }
 
 func getUserIDFromSession(c echo.Context) (string, int, error) {
+	// API仕様の検証の前に確認済みであれば，もう一度DBを引かない
+	if jiaUserID, ok := c.Get(sessionContextUserID).(string); ok {
+		return jiaUserID, 0, nil
+	}
+
 	session, err := getSession(c.Request())
 	if err != nil {
 		return "", http.StatusInternalServerError, fmt.Errorf("failed to get session: %v", err)
@@ -278,7 +566,8 @@ func getUserIDFromSession(c echo.Context) (string, int, error) {
 	jiaUserID := _jiaUserID.(string)
 	var count int
 
-	err = db.Get(&count, "SELECT COUNT(*) FROM `user` WHERE `jia_user_id` = ?",
+	err = db.Get(&count, "SELECT COUNT(*) FROM `user` u LEFT JOIN `user_disabled` d ON u.`jia_user_id` = d.`jia_user_id`"+
+		"	WHERE u.`jia_user_id` = ? AND d.`jia_user_id` IS NULL",
 		jiaUserID)
 	if err != nil {
 		return "", http.StatusInternalServerError, fmt.Errorf("db error: %v", err)
@@ -288,12 +577,13 @@ func getUserIDFromSession(c echo.Context) (string, int, error) {
 		return "", http.StatusUnauthorized, fmt.Errorf("not found: user")
 	}
 
+	c.Set(sessionContextUserID, jiaUserID)
 	return jiaUserID, 0, nil
 }
 
-func getJIAServiceURL(tx *sqlx.Tx) string {
+func getJIAServiceURL(q sqlx.Queryer) string {
 	var config Config
-	err := tx.Get(&config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
+	err := sqlx.Get(q, &config, "SELECT * FROM `isu_association_config` WHERE `name` = ?", "jia_service_url")
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			log.Print(err)
@@ -312,12 +602,28 @@ func postInitialize(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
 
-	cmd := exec.Command("../sql/init.sh")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stderr
-	err = cmd.Run()
+	timing, err := resetAndSeed(c.Request().Context())
 	if err != nil {
-		c.Logger().Errorf("exec init.sh error: %v", err)
+		c.Logger().Errorf("failed to initialize data: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	c.Response().Header().Set("Server-Timing", timing.serverTiming())
+
+	err = rebuildLatestIsuConditions(db)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = rebuildConditionMessages(db)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = scoringProfiles.Load(db)
+	if err != nil {
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
@@ -370,6 +676,7 @@ func postAuthentication(c echo.Context) error {
 	if !ok {
 		return c.String(http.StatusBadRequest, "invalid JWT payload")
 	}
+	setAuditTarget(c, jiaUserID, "")
 
 	_, err = db.Exec("INSERT IGNORE INTO user (`jia_user_id`) VALUES (?)", jiaUserID)
 	if err != nil {
@@ -377,6 +684,17 @@ func postAuthentication(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	var disabledCount int
+	err = db.Get(&disabledCount, "SELECT COUNT(*) FROM `user_disabled` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if disabledCount > 0 {
+		setAuditDetail(c, "disabled user")
+		return c.String(http.StatusForbidden, "forbidden")
+	}
+
 	session, err := getSession(c.Request())
 	if err != nil {
 		c.Logger().Error(err)
@@ -396,7 +714,7 @@ func postAuthentication(c echo.Context) error {
 // POST /api/signout
 // サインアウト
 func postSignout(c echo.Context) error {
-	_, errStatusCode, err := getUserIDFromSession(c)
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
 	if err != nil {
 		if errStatusCode == http.StatusUnauthorized {
 			return c.String(http.StatusUnauthorized, "you are not signed in")
@@ -405,6 +723,7 @@ func postSignout(c echo.Context) error {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	setAuditTarget(c, jiaUserID, "")
 
 	session, err := getSession(c.Request())
 	if err != nil {
@@ -452,55 +771,62 @@ func getIsuList(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	tx, err := db.Beginx()
+	filter, err := parseIsuListFilter(c)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
 	}
-	defer tx.Rollback()
 
+	readerDB := readDB(c, db)
+	where, args := filter.where(jiaUserID)
 	isuList := []Isu{}
-	err = tx.Select(
+	err = readerDB.Select(
 		&isuList,
-		"SELECT * FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
-		jiaUserID)
+		"SELECT * FROM `isu` WHERE "+where+" ORDER BY `id` DESC",
+		args...)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	connectivities, err := getIsuConnectivitiesByUser(readerDB, jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	activations, err := getIsuActivationsByUser(readerDB, jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tags, err := getIsuTagsByUser(readerDB, jiaUserID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	now := time.Now()
 	responseList := []GetIsuListResponse{}
 	for _, isu := range isuList {
-		var lastCondition IsuCondition
-		foundLastCondition := true
-		err = tx.Get(&lastCondition, "SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC LIMIT 1",
-			isu.JIAIsuUUID)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				foundLastCondition = false
-			} else {
-				c.Logger().Errorf("db error: %v", err)
-				return c.NoContent(http.StatusInternalServerError)
-			}
-		}
-
 		var formattedCondition *GetIsuConditionResponse
-		if foundLastCondition {
-			conditionLevel, err := calculateConditionLevel(lastCondition.Condition)
+		if lastCondition, ok := latestConditions.Get(isu.JIAIsuUUID); ok {
+			formattedCondition, err = lastCondition.toResponse(profile, isu.Name)
 			if err != nil {
 				c.Logger().Error(err)
 				return c.NoContent(http.StatusInternalServerError)
 			}
+		}
 
-			formattedCondition = &GetIsuConditionResponse{
-				JIAIsuUUID:     lastCondition.JIAIsuUUID,
-				IsuName:        isu.Name,
-				Timestamp:      lastCondition.Timestamp.Unix(),
-				IsSitting:      lastCondition.IsSitting,
-				Condition:      lastCondition.Condition,
-				ConditionLevel: conditionLevel,
-				Message:        lastCondition.Message,
-			}
+		lastIngestedAt, lastIngestedAtUnix := connectivities[isu.JIAIsuUUID].lastIngestedAtOr(isu)
+		activationStatus, activationError := activations[isu.JIAIsuUUID].state(isu.Character)
+		isuTags := tags[isu.JIAIsuUUID]
+		if isuTags == nil {
+			isuTags = []string{}
 		}
 
 		res := GetIsuListResponse{
@@ -508,15 +834,23 @@ func getIsuList(c echo.Context) error {
 			JIAIsuUUID:         isu.JIAIsuUUID,
 			Name:               isu.Name,
 			Character:          isu.Character,
-			LatestIsuCondition: formattedCondition}
+			Tags:               isuTags,
+			LatestIsuCondition: formattedCondition,
+			Connectivity:       calculateConnectivity(lastIngestedAt, now),
+			LastIngestedAt:     lastIngestedAtUnix,
+			ActivationStatus:   activationStatus,
+			ActivationError:    activationError}
 		responseList = append(responseList, res)
 	}
 
-	err = tx.Commit()
+	responseList, nextCursor, err := filter.apply(responseList, now)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
+		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if nextCursor != "" {
+		c.Response().Header().Set(isuListNextCursorHeader, nextCursor)
+	}
 
 	return c.JSON(http.StatusOK, responseList)
 }
@@ -538,6 +872,7 @@ func postIsu(c echo.Context) error {
 
 	jiaIsuUUID := c.FormValue("jia_isu_uuid")
 	isuName := c.FormValue("isu_name")
+	setAuditTarget(c, jiaUserID, jiaIsuUUID)
 	fh, err := c.FormFile("image")
 	if err != nil {
 		if !errors.Is(err, http.ErrMissingFile) {
@@ -569,6 +904,8 @@ func postIsu(c echo.Context) error {
 		}
 	}
 
+	// JIAの応答を待つ間トランザクションを保持しないよう，先にISUを登録してコミットする
+	// activate が済むまで `character` は空文字列のままにしておく
 	tx, err := db.Beginx()
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
@@ -577,12 +914,13 @@ func postIsu(c echo.Context) error {
 	defer tx.Rollback()
 
 	_, err = tx.Exec("INSERT INTO `isu`"+
-		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`) VALUES (?, ?, ?, ?)",
+		"	(`jia_isu_uuid`, `name`, `image`, `jia_user_id`, `character`) VALUES (?, ?, ?, ?, '')",
 		jiaIsuUUID, isuName, image, jiaUserID)
 	if err != nil {
 		mysqlErr, ok := err.(*mysql.MySQLError)
 
 		if ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry) {
+			setAuditDetail(c, "duplicated: isu")
 			return c.String(http.StatusConflict, "duplicated: isu")
 		}
 
@@ -590,54 +928,78 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	targetURL := getJIAServiceURL(tx) + "/api/activate"
-	body := JIAServiceRequest{postIsuConditionTargetBaseURL, jiaIsuUUID}
-	bodyJSON, err := json.Marshal(body)
+	shard, err := conditionShards.Assign(tx, jiaIsuUUID)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	reqJIA, err := http.NewRequest(http.MethodPost, targetURL, bytes.NewBuffer(bodyJSON))
+	err = cancelIsuDeactivation(tx, jiaIsuUUID)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	reqJIA.Header.Set("Content-Type", "application/json")
-	res, err := http.DefaultClient.Do(reqJIA)
-	if err != nil {
-		c.Logger().Errorf("failed to request to JIAService: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	if isuActivationMode == isuActivationModeAsync {
+		// activate はワーカーに任せ，すぐに応答する
+		err = insertPendingIsuActivation(tx, jiaIsuUUID, time.Now())
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		var isu Isu
+		err = tx.Get(
+			&isu,
+			"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+			jiaUserID, jiaIsuUUID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		conditionShards.Set(jiaIsuUUID, shard)
+		notifyActivationWorker()
+
+		setAuditDetail(c, activationStatusPending)
+		return c.JSON(http.StatusAccepted, PostIsuResponse{Isu: isu, ActivationStatus: activationStatusPending})
 	}
-	defer res.Body.Close()
 
-	resBody, err := ioutil.ReadAll(res.Body)
+	jiaServiceURL := getJIAServiceURL(tx)
+
+	err = tx.Commit()
 	if err != nil {
-		c.Logger().Error(err)
+		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	conditionShards.Set(jiaIsuUUID, shard)
 
-	if res.StatusCode != http.StatusAccepted {
-		c.Logger().Errorf("JIAService returned error: status code %v, message: %v", res.StatusCode, string(resBody))
-		return c.String(res.StatusCode, "JIAService returned error")
-	}
-
-	var isuFromJIA IsuFromJIA
-	err = json.Unmarshal(resBody, &isuFromJIA)
+	isuFromJIA, err := jiaAPIClient.Activate(c.Request().Context(), jiaServiceURL, jiaIsuUUID)
 	if err != nil {
 		c.Logger().Error(err)
-		return c.NoContent(http.StatusInternalServerError)
+		setAuditDetail(c, err.Error())
+
+		// activate できなかったISUは登録を取り消す
+		cleanupErr := deleteUnactivatedIsu(jiaUserID, jiaIsuUUID)
+		if cleanupErr != nil {
+			c.Logger().Error(cleanupErr)
+		}
+
+		return respondJIAError(c, err)
 	}
 
-	_, err = tx.Exec("UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
+	_, err = db.Exec("UPDATE `isu` SET `character` = ? WHERE  `jia_isu_uuid` = ?", isuFromJIA.Character, jiaIsuUUID)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
 	var isu Isu
-	err = tx.Get(
+	err = db.Get(
 		&isu,
 		"SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
 		jiaUserID, jiaIsuUUID)
@@ -646,13 +1008,7 @@ func postIsu(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
-
-	return c.JSON(http.StatusCreated, isu)
+	return c.JSON(http.StatusCreated, PostIsuResponse{Isu: isu, ActivationStatus: activationStatusActive})
 }
 
 // GET /api/isu/:jia_isu_uuid
@@ -670,8 +1026,8 @@ func getIsuID(c echo.Context) error {
 
 	jiaIsuUUID := c.Param("jia_isu_uuid")
 
-	var res Isu
-	err = db.Get(&res, "SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+	var isu Isu
+	err = db.Get(&isu, "SELECT * FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
 		jiaUserID, jiaIsuUUID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -682,6 +1038,28 @@ func getIsuID(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	connectivity, events, err := getIsuConnectivity(db, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	lastIngestedAt, lastIngestedAtUnix := connectivity.lastIngestedAtOr(isu)
+
+	activation, err := getIsuActivation(db, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	activationStatus, activationError := activation.state(isu.Character)
+
+	res := GetIsuResponse{
+		Isu:                isu,
+		Connectivity:       calculateConnectivity(lastIngestedAt, time.Now()),
+		LastIngestedAt:     lastIngestedAtUnix,
+		ConnectivityEvents: events,
+		ActivationStatus:   activationStatus,
+		ActivationError:    activationError,
+	}
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -738,8 +1116,12 @@ func getIsuGraph(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "bad format: datetime")
 	}
 	date := time.Unix(datetimeInt64, 0).Truncate(time.Hour)
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
 
-	tx, err := db.Beginx()
+	tx, err := readDB(c, db).Beginx()
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -757,7 +1139,7 @@ func getIsuGraph(c echo.Context) error {
 		return c.String(http.StatusNotFound, "not found: isu")
 	}
 
-	res, err := generateIsuGraphResponse(tx, jiaIsuUUID, date)
+	res, err := generateIsuGraphResponse(tx, readDB(c, conditionShards.Shard(jiaIsuUUID).DB), profile, jiaIsuUUID, date)
 	if err != nil {
 		c.Logger().Error(err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -773,17 +1155,24 @@ func getIsuGraph(c echo.Context) error {
 }
 
 // グラフのデータ点を一日分生成
-func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
+// コンディションは conditionDB から読む
+func generateIsuGraphResponse(tx *sqlx.Tx, conditionDB *sqlx.DB, profile *ScoringProfile, jiaIsuUUID string, graphDate time.Time) ([]GraphResponse, error) {
 	dataPoints := []GraphDataPointWithInfo{}
 	conditionsInThisHour := []IsuCondition{}
 	timestampsInThisHour := []int64{}
 	var startTimeInThisHour time.Time
 	var condition IsuCondition
 
-	rows, err := tx.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` ASC", jiaIsuUUID)
+	maintenances, err := getIsuMaintenancesByHour(tx, jiaIsuUUID, graphDate, graphDate.Add(time.Hour*24))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conditionDB.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` ASC", jiaIsuUUID)
 	if err != nil {
 		return nil, fmt.Errorf("db error: %v", err)
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		err = rows.StructScan(&condition)
@@ -794,7 +1183,7 @@ func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Tim
 		truncatedConditionTime := condition.Timestamp.Truncate(time.Hour)
 		if truncatedConditionTime != startTimeInThisHour {
 			if len(conditionsInThisHour) > 0 {
-				data, err := calculateGraphDataPoint(conditionsInThisHour)
+				data, err := calculateGraphDataPoint(profile, conditionsInThisHour)
 				if err != nil {
 					return nil, err
 				}
@@ -816,7 +1205,7 @@ func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Tim
 	}
 
 	if len(conditionsInThisHour) > 0 {
-		data, err := calculateGraphDataPoint(conditionsInThisHour)
+		data, err := calculateGraphDataPoint(profile, conditionsInThisHour)
 		if err != nil {
 			return nil, err
 		}
@@ -864,11 +1253,17 @@ func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Tim
 			}
 		}
 
+		maintenancesInThisHour := maintenances[thisTime.Unix()]
+		if maintenancesInThisHour == nil {
+			maintenancesInThisHour = []*IsuMaintenanceResponse{}
+		}
+
 		resp := GraphResponse{
 			StartAt:             thisTime.Unix(),
 			EndAt:               thisTime.Add(time.Hour).Unix(),
 			Data:                data,
 			ConditionTimestamps: timestamps,
+			Maintenances:        maintenancesInThisHour,
 		}
 		responseList = append(responseList, resp)
 
@@ -879,14 +1274,13 @@ func generateIsuGraphResponse(tx *sqlx.Tx, jiaIsuUUID string, graphDate time.Tim
 }
 
 // 複数のISUのコンディションからグラフの一つのデータ点を計算
-func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, error) {
+func calculateGraphDataPoint(profile *ScoringProfile, isuConditions []IsuCondition) (GraphDataPoint, error) {
 	conditionsCount := map[string]int{"is_broken": 0, "is_dirty": 0, "is_overweight": 0}
 	rawScore := 0
 	for _, condition := range isuConditions {
-		badConditionsCount := 0
-
-		if !isValidConditionFormat(condition.Condition) {
-			return GraphDataPoint{}, fmt.Errorf("invalid condition format")
+		conditionLevel, err := profile.conditionLevel(condition.Condition)
+		if err != nil {
+			return GraphDataPoint{}, err
 		}
 
 		for _, condStr := range strings.Split(condition.Condition, ",") {
@@ -895,17 +1289,10 @@ func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, erro
 			conditionName := keyValue[0]
 			if keyValue[1] == "true" {
 				conditionsCount[conditionName] += 1
-				badConditionsCount++
 			}
 		}
 
-		if badConditionsCount >= 3 {
-			rawScore += scoreConditionLevelCritical
-		} else if badConditionsCount >= 1 {
-			rawScore += scoreConditionLevelWarning
-		} else {
-			rawScore += scoreConditionLevelInfo
-		}
+		rawScore += profile.levelScore(conditionLevel)
 	}
 
 	sittingCount := 0
@@ -917,7 +1304,7 @@ func calculateGraphDataPoint(isuConditions []IsuCondition) (GraphDataPoint, erro
 
 	isuConditionsLength := len(isuConditions)
 
-	score := rawScore * 100 / 3 / isuConditionsLength
+	score := profile.score(rawScore, isuConditionsLength)
 
 	sittingPercentage := sittingCount * 100 / isuConditionsLength
 	isBrokenPercentage := conditionsCount["is_broken"] * 100 / isuConditionsLength
@@ -977,9 +1364,13 @@ func getIsuConditions(c echo.Context) error {
 		}
 		startTime = time.Unix(startTimeInt64, 0)
 	}
+	profile, errStatusCode, err := scoringProfileForRequest(c, jiaUserID)
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
 
 	var isuName string
-	err = db.Get(&isuName,
+	err = readDB(c, db).Get(&isuName,
 		"SELECT name FROM `isu` WHERE `jia_isu_uuid` = ? AND `jia_user_id` = ?",
 		jiaIsuUUID, jiaUserID,
 	)
@@ -992,7 +1383,7 @@ func getIsuConditions(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	conditionsResponse, err := getIsuConditionsFromDB(db, jiaIsuUUID, endTime, conditionLevel, startTime, conditionLimit, isuName)
+	conditionsResponse, err := getIsuConditionsFromDB(readDB(c, conditionShards.Shard(jiaIsuUUID).DB), profile, jiaIsuUUID, endTime, conditionLevel, startTime, conditionLimit, isuName)
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1001,7 +1392,7 @@ func getIsuConditions(c echo.Context) error {
 }
 
 // ISUのコンディションをDBから取得
-func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time,
+func getIsuConditionsFromDB(db *sqlx.DB, profile *ScoringProfile, jiaIsuUUID string, endTime time.Time, conditionLevel map[string]interface{}, startTime time.Time,
 	limit int, isuName string) ([]*GetIsuConditionResponse, error) {
 
 	conditions := []IsuCondition{}
@@ -1029,7 +1420,7 @@ func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, c
 
 	conditionsResponse := []*GetIsuConditionResponse{}
 	for _, c := range conditions {
-		cLevel, err := calculateConditionLevel(c.Condition)
+		cLevel, err := profile.conditionLevel(c.Condition)
 		if err != nil {
 			continue
 		}
@@ -1055,30 +1446,42 @@ func getIsuConditionsFromDB(db *sqlx.DB, jiaIsuUUID string, endTime time.Time, c
 	return conditionsResponse, nil
 }
 
-// ISUのコンディションの文字列からコンディションレベルを計算
-func calculateConditionLevel(condition string) (string, error) {
-	var conditionLevel string
-
-	warnCount := strings.Count(condition, "=true")
-	switch warnCount {
-	case 0:
-		conditionLevel = conditionLevelInfo
-	case 1, 2:
-		conditionLevel = conditionLevelWarning
-	case 3:
-		conditionLevel = conditionLevelCritical
-	default:
-		return "", fmt.Errorf("unexpected warn count")
-	}
-
-	return conditionLevel, nil
-}
-
 // GET /api/trend
 // ISUの性格毎の最新のコンディション情報
 func getTrend(c echo.Context) error {
-	characterList := []Isu{}
-	err := db.Select(&characterList, "SELECT `character` FROM `isu` GROUP BY `character`")
+	character := c.QueryParam("character")
+
+	var since time.Time
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		sinceInt64, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: since")
+		}
+		since = time.Unix(sinceInt64, 0)
+	}
+
+	summary := false
+	if summaryStr := c.QueryParam("summary"); summaryStr != "" {
+		var err error
+		summary, err = strconv.ParseBool(summaryStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: summary")
+		}
+	}
+
+	// 誰でも見られるので，デプロイメント全体の設定を使う
+	profile, errStatusCode, err := scoringProfileForRequest(c, "")
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	readerDB := readDB(c, db)
+	isuList := []Isu{}
+	if character == "" {
+		err = readerDB.Select(&isuList, "SELECT `id`, `jia_isu_uuid`, `character` FROM `isu` WHERE `character` <> '' ORDER BY `character`")
+	} else {
+		err = readerDB.Select(&isuList, "SELECT `id`, `jia_isu_uuid`, `character` FROM `isu` WHERE `character` = ?", character)
+	}
 	if err != nil {
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -1086,52 +1489,36 @@ func getTrend(c echo.Context) error {
 
 	res := []TrendResponse{}
 
-	for _, character := range characterList {
-		isuList := []Isu{}
-		err = db.Select(&isuList,
-			"SELECT * FROM `isu` WHERE `character` = ?",
-			character.Character,
-		)
-		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
-		}
+	for i := 0; i < len(isuList); {
+		character := isuList[i].Character
 
 		characterInfoIsuConditions := []*TrendCondition{}
 		characterWarningIsuConditions := []*TrendCondition{}
 		characterCriticalIsuConditions := []*TrendCondition{}
-		for _, isu := range isuList {
-			conditions := []IsuCondition{}
-			err = db.Select(&conditions,
-				"SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY timestamp DESC",
-				isu.JIAIsuUUID,
-			)
+		for ; i < len(isuList) && isuList[i].Character == character; i++ {
+			isu := isuList[i]
+			isuLastCondition, ok := latestConditions.Get(isu.JIAIsuUUID)
+			if !ok || isuLastCondition.Timestamp.Before(since) {
+				continue
+			}
+
+			conditionLevel, err := profile.conditionLevel(isuLastCondition.Condition)
 			if err != nil {
-				c.Logger().Errorf("db error: %v", err)
+				c.Logger().Error(err)
 				return c.NoContent(http.StatusInternalServerError)
 			}
-
-			if len(conditions) > 0 {
-				isuLastCondition := conditions[0]
-				conditionLevel, err := calculateConditionLevel(isuLastCondition.Condition)
-				if err != nil {
-					c.Logger().Error(err)
-					return c.NoContent(http.StatusInternalServerError)
-				}
-				trendCondition := TrendCondition{
-					ID:        isu.ID,
-					Timestamp: isuLastCondition.Timestamp.Unix(),
-				}
-				switch conditionLevel {
-				case "info":
-					characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
-				case "warning":
-					characterWarningIsuConditions = append(characterWarningIsuConditions, &trendCondition)
-				case "critical":
-					characterCriticalIsuConditions = append(characterCriticalIsuConditions, &trendCondition)
-				}
+			trendCondition := TrendCondition{
+				ID:        isu.ID,
+				Timestamp: isuLastCondition.Timestamp.Unix(),
+			}
+			switch conditionLevel {
+			case "info":
+				characterInfoIsuConditions = append(characterInfoIsuConditions, &trendCondition)
+			case "warning":
+				characterWarningIsuConditions = append(characterWarningIsuConditions, &trendCondition)
+			case "critical":
+				characterCriticalIsuConditions = append(characterCriticalIsuConditions, &trendCondition)
 			}
-
 		}
 
 		sort.Slice(characterInfoIsuConditions, func(i, j int) bool {
@@ -1145,13 +1532,21 @@ func getTrend(c echo.Context) error {
 		})
 		res = append(res,
 			TrendResponse{
-				Character: character.Character,
+				Character: character,
 				Info:      characterInfoIsuConditions,
 				Warning:   characterWarningIsuConditions,
 				Critical:  characterCriticalIsuConditions,
 			})
 	}
 
+	if summary {
+		summaryList := []TrendSummaryResponse{}
+		for _, trend := range res {
+			summaryList = append(summaryList, summarizeTrend(profile, trend))
+		}
+		return c.JSON(http.StatusOK, summaryList)
+	}
+
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -1170,10 +1565,9 @@ func postIsuCondition(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "missing: jia_isu_uuid")
 	}
 
-	req := []PostIsuConditionRequest{}
-	err := c.Bind(&req)
+	req, err := decodePostIsuConditionRequest(c.Request())
 	if err != nil {
-		return c.String(http.StatusBadRequest, "bad request body")
+		return respondConditionPayloadError(c, err)
 	} else if len(req) == 0 {
 		return c.String(http.StatusBadRequest, "bad request body")
 	}
@@ -1185,42 +1579,161 @@ func postIsuCondition(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var count int
-	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	var registeredAt time.Time
+	err = tx.Get(&registeredAt, "SELECT `created_at` FROM `isu` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
 		c.Logger().Errorf("db error: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-	if count == 0 {
-		return c.String(http.StatusNotFound, "not found: isu")
-	}
 
 	for _, cond := range req {
-		timestamp := time.Unix(cond.Timestamp, 0)
-
 		if !isValidConditionFormat(cond.Condition) {
 			return c.String(http.StatusBadRequest, "bad request body")
 		}
+	}
+
+	now := time.Now()
+	accepted, quarantined, err := conditionTimestamps.apply(req, registeredAt, now)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	shards, err := conditionShards.Lock(tx, []string{jiaIsuUUID})
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	shardTx, ownedShardTx, err := shards[jiaIsuUUID].beginTx(tx)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if ownedShardTx {
+		defer shardTx.Rollback()
+	}
 
-		_, err = tx.Exec(
+	err = insertQuarantinedConditions(shardTx, jiaIsuUUID, quarantined)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	latestCondition, registeredMessages, err := insertIsuConditions(tx, shardTx, jiaIsuUUID, accepted, now)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	// コンディションを先に確定させる
+	if ownedShardTx {
+		err = shardTx.Commit()
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	err = tx.Commit()
+	if err != nil && ownedShardTx {
+		// コンディションは保存済みなので，ISUに再送させて重複させないよう受け付けたことにする
+		c.Logger().Errorf("db error: %v", err)
+		latest, messages, err := retryIsuConditionSummaries([]string{jiaIsuUUID}, [][]PostIsuConditionRequest{accepted}, now)
+		if err != nil {
+			c.Logger().Errorf("failed to save summary of stored conditions: %v", err)
+			return c.NoContent(http.StatusAccepted)
+		}
+		latestCondition, registeredMessages = nil, messages
+		if len(latest) > 0 {
+			latestCondition = &latest[0]
+		}
+	} else if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if latestCondition != nil {
+		latestConditions.Set(*latestCondition)
+	}
+	conditionMessages.add(registeredMessages)
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// ISUのコンディションを shardTx に保存し，最新のコンディションと接続状況を tx で更新する
+// コミットが成功したら，返した最新のコンディションとメッセージをそれぞれのキャッシュに反映すること
+// 保存するコンディションがない場合も接続状況は更新し，最新のコンディションは nil を返す
+func insertIsuConditions(tx *sqlx.Tx, shardTx *sqlx.Tx, jiaIsuUUID string, req []PostIsuConditionRequest, now time.Time) (*LatestIsuCondition, []string, error) {
+	for _, cond := range req {
+		timestamp := time.Unix(cond.Timestamp, 0)
+
+		_, err := shardTx.Exec(
 			"INSERT INTO `isu_condition`"+
 				"	(`jia_isu_uuid`, `timestamp`, `is_sitting`, `condition`, `message`)"+
 				"	VALUES (?, ?, ?, ?, ?)",
 			jiaIsuUUID, timestamp, cond.IsSitting, cond.Condition, cond.Message)
 		if err != nil {
-			c.Logger().Errorf("db error: %v", err)
-			return c.NoContent(http.StatusInternalServerError)
+			return nil, nil, fmt.Errorf("db error: %v", err)
 		}
+	}
+
+	return updateIsuConditionSummary(tx, jiaIsuUUID, req, now)
+}
 
+// 受け取ったコンディションから，プライマリに置く接続状況とメッセージ，最新のコンディションを更新する
+// 同じ内容で何度呼んでも結果は変わらない
+func updateIsuConditionSummary(tx *sqlx.Tx, jiaIsuUUID string, req []PostIsuConditionRequest, now time.Time) (*LatestIsuCondition, []string, error) {
+	err := recordIsuIngest(tx, jiaIsuUUID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(req) == 0 {
+		return nil, nil, nil
 	}
 
-	err = tx.Commit()
+	messages := make([]string, 0, len(req))
+	for _, cond := range req {
+		messages = append(messages, cond.Message)
+	}
+	registeredMessages, err := registerConditionMessages(tx, messages)
 	if err != nil {
-		c.Logger().Errorf("db error: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return nil, nil, err
 	}
 
-	return c.NoContent(http.StatusAccepted)
+	latestCondition, err := upsertLatestIsuCondition(tx, jiaIsuUUID, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &latestCondition, registeredMessages, nil
+}
+
+// シャードにコンディションを保存した後でプライマリのコミットに失敗した場合に，プライマリの内容だけを保存し直す
+// 返した最新のコンディションとメッセージは，それぞれのキャッシュに反映すること
+func retryIsuConditionSummaries(jiaIsuUUIDs []string, conditions [][]PostIsuConditionRequest, now time.Time) ([]LatestIsuCondition, []string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	latest := []LatestIsuCondition{}
+	registeredMessages := []string{}
+	for i, jiaIsuUUID := range jiaIsuUUIDs {
+		latestCondition, messages, err := updateIsuConditionSummary(tx, jiaIsuUUID, conditions[i], now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if latestCondition != nil {
+			latest = append(latest, *latestCondition)
+		}
+		registeredMessages = append(registeredMessages, messages...)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, nil, fmt.Errorf("db error: %v", err)
+	}
+	return latest, registeredMessages, nil
 }
 
 // ISUのコンディションの文字列がcsv形式になっているか検証
@@ -1256,7 +1769,3 @@ func isValidConditionFormat(conditionStr string) bool {
 
 	return (idxCondStr == len(conditionStr))
 }
-
-func getIndex(c echo.Context) error {
-	return c.File(frontendContentsPath + "/index.html")
-}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	maintenanceTypeCleaned      = "cleaned"
+	maintenanceTypeRepaired     = "repaired"
+	maintenanceTypeReplacedPart = "replaced_part"
+
+	maintenanceNoteMaxLength = 1024
+)
+
+type IsuMaintenance struct {
+	ID         int       `db:"id"`
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	Type       string    `db:"type"`
+	Note       string    `db:"note"`
+	Timestamp  time.Time `db:"timestamp"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type PostIsuMaintenanceRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	Note      string `json:"note"`
+}
+
+type IsuMaintenanceResponse struct {
+	ID         int    `json:"id"`
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	Type       string `json:"type"`
+	Timestamp  int64  `json:"timestamp"`
+	Note       string `json:"note"`
+}
+
+func (m IsuMaintenance) toResponse() *IsuMaintenanceResponse {
+	return &IsuMaintenanceResponse{
+		ID:         m.ID,
+		JIAIsuUUID: m.JIAIsuUUID,
+		Type:       m.Type,
+		Timestamp:  m.Timestamp.Unix(),
+		Note:       m.Note,
+	}
+}
+
+func isValidMaintenanceType(maintenanceType string) bool {
+	switch maintenanceType {
+	case maintenanceTypeCleaned, maintenanceTypeRepaired, maintenanceTypeReplacedPart:
+		return true
+	}
+	return false
+}
+
+// POST /api/isu/:jia_isu_uuid/maintenance
+// ISUのメンテナンス記録を登録
+func postIsuMaintenance(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	var req PostIsuMaintenanceRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	if !isValidMaintenanceType(req.Type) {
+		return c.String(http.StatusBadRequest, "bad format: type")
+	}
+	if req.Timestamp <= 0 {
+		return c.String(http.StatusBadRequest, "bad format: timestamp")
+	}
+	if len(req.Note) > maintenanceNoteMaxLength {
+		return c.String(http.StatusBadRequest, "bad format: note")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var count int
+	err = tx.Get(&count, "SELECT COUNT(*) FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if count == 0 {
+		return c.String(http.StatusNotFound, "not found: isu")
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO `isu_maintenance` (`jia_isu_uuid`, `type`, `note`, `timestamp`) VALUES (?, ?, ?, ?)",
+		jiaIsuUUID, req.Type, req.Note, time.Unix(req.Timestamp, 0))
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var maintenance IsuMaintenance
+	err = tx.Get(&maintenance, "SELECT * FROM `isu_maintenance` WHERE `id` = ?", id)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusCreated, maintenance.toResponse())
+}
+
+// GET /api/isu/:jia_isu_uuid/maintenance
+// ISUのメンテナンス記録を新しい順に取得
+func getIsuMaintenances(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+
+	var isuID int
+	err = db.Get(&isuID, "SELECT `id` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	maintenances := []IsuMaintenance{}
+	err = db.Select(&maintenances,
+		"SELECT * FROM `isu_maintenance` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp` DESC, `id` DESC",
+		jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []*IsuMaintenanceResponse{}
+	for _, maintenance := range maintenances {
+		res = append(res, maintenance.toResponse())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// グラフの期間内のメンテナンス記録を1時間毎にまとめて取得
+func getIsuMaintenancesByHour(tx *sqlx.Tx, jiaIsuUUID string, startAt time.Time, endAt time.Time) (map[int64][]*IsuMaintenanceResponse, error) {
+	maintenances := []IsuMaintenance{}
+	err := tx.Select(&maintenances,
+		"SELECT * FROM `isu_maintenance` WHERE `jia_isu_uuid` = ? AND ? <= `timestamp` AND `timestamp` < ?"+
+			"	ORDER BY `timestamp` ASC, `id` ASC",
+		jiaIsuUUID, startAt, endAt)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := map[int64][]*IsuMaintenanceResponse{}
+	for _, maintenance := range maintenances {
+		hour := maintenance.Timestamp.Truncate(time.Hour).Unix()
+		res[hour] = append(res[hour], maintenance.toResponse())
+	}
+	return res, nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	migrationLockName    = "isucondition_schema_migrations"
+	migrationLockTimeout = 60
+
+	schemaMigrationModeCheck = "check"
+	schemaMigrationModeAuto  = "auto"
+	schemaMigrationModeSkip  = "skip"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+var migrationFileNamePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var createTablePattern = regexp.MustCompile("(?i)CREATE TABLE (?:IF NOT EXISTS )?`(\\w+)`")
+
+// 適用済みのマイグレーションを記録するテーブル
+const schemaMigrationsTable = "CREATE TABLE IF NOT EXISTS `schema_migrations` (\n" +
+	"  `version` bigint PRIMARY KEY,\n" +
+	"  `name` VARCHAR(255) NOT NULL,\n" +
+	"  `applied_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)\n" +
+	") ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4"
+
+// 番号付きのスキーマ変更
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type appliedMigration struct {
+	Version   int64     `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// 埋め込まれたマイグレーションを番号順に読み込む
+// up と down は必ず対になっていなければならない
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := map[int64]*migration{}
+	for _, entry := range entries {
+		matches := migrationFileNamePattern.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name: %v", entry.Name())
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name: %v", entry.Name())
+		}
+
+		body, err := fs.ReadFile(migrationFS, path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := migrations[version]
+		if !ok {
+			m = &migration{Version: version, Name: matches[2]}
+			migrations[version] = m
+		} else if m.Name != matches[2] {
+			return nil, fmt.Errorf("duplicated migration version: %v", version)
+		}
+		if matches[3] == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	res := []migration{}
+	for _, m := range migrations {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%v must have both up and down", m.Version, m.Name)
+		}
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// マイグレーションのSQLを文ごとに分割
+// 行末の `;` を文の区切りとみなす
+func splitStatements(body string) []string {
+	statements := []string{}
+	var current strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(current.String()))
+			current.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(current.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// マイグレーションの実行中は他のアプリケーションサーバーが同時に実行しないようロックを取る
+type migrator struct {
+	conn       *sqlx.Conn
+	migrations []migration
+}
+
+func newMigrator(ctx context.Context, db *sqlx.DB) (*migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	var locked int
+	err = conn.GetContext(ctx, &locked, "SELECT GET_LOCK(?, ?)", migrationLockName, migrationLockTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	if locked != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("failed to get migration lock")
+	}
+
+	_, err = conn.ExecContext(ctx, schemaMigrationsTable)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	return &migrator{conn: conn, migrations: migrations}, nil
+}
+
+func (m *migrator) Close() error {
+	_, err := m.conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+	if err != nil {
+		m.conn.Close()
+		return fmt.Errorf("db error: %v", err)
+	}
+	return m.conn.Close()
+}
+
+func (m *migrator) applied(ctx context.Context) (map[int64]appliedMigration, error) {
+	return getAppliedMigrations(ctx, m.conn)
+}
+
+func getAppliedMigrations(ctx context.Context, q sqlx.QueryerContext) (map[int64]appliedMigration, error) {
+	applied := []appliedMigration{}
+	err := sqlx.SelectContext(ctx, q, &applied, "SELECT * FROM `schema_migrations` ORDER BY `version`")
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := make(map[int64]appliedMigration, len(applied))
+	for _, a := range applied {
+		res[a.Version] = a
+	}
+	return res, nil
+}
+
+// 未適用のマイグレーションを番号の小さい順に最大 steps 件適用する
+// steps が 0 以下の場合は全て適用する
+func (m *migrator) Up(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []migration{}
+	for _, mig := range m.migrations {
+		if steps > 0 && len(done) >= steps {
+			break
+		}
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+
+		for _, statement := range splitStatements(mig.Up) {
+			_, err = m.conn.ExecContext(ctx, statement)
+			if err != nil {
+				return done, fmt.Errorf("failed to apply migration %04d_%v: %v", mig.Version, mig.Name, err)
+			}
+		}
+		_, err = m.conn.ExecContext(ctx, "INSERT INTO `schema_migrations` (`version`, `name`) VALUES (?, ?)", mig.Version, mig.Name)
+		if err != nil {
+			return done, fmt.Errorf("db error: %v", err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// 適用済みのマイグレーションを番号の大きい順に steps 件取り消す
+func (m *migrator) Down(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []migration{}
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+
+		for _, statement := range splitStatements(mig.Down) {
+			_, err = m.conn.ExecContext(ctx, statement)
+			if err != nil {
+				return done, fmt.Errorf("failed to revert migration %04d_%v: %v", mig.Version, mig.Name, err)
+			}
+		}
+		_, err = m.conn.ExecContext(ctx, "DELETE FROM `schema_migrations` WHERE `version` = ?", mig.Version)
+		if err != nil {
+			return done, fmt.Errorf("db error: %v", err)
+		}
+		done = append(done, mig)
+	}
+	return done, nil
+}
+
+// DBのスキーマがこのバイナリの想定と一致しているか検証
+// 未適用のマイグレーションや，このバイナリが知らないマイグレーションが適用されていればエラーを返す
+func checkSchemaVersion(ctx context.Context, db *sqlx.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := getAppliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	pending := []string{}
+	known := map[int64]struct{}{}
+	for _, mig := range migrations {
+		known[mig.Version] = struct{}{}
+		if _, ok := applied[mig.Version]; !ok {
+			pending = append(pending, fmt.Sprintf("%04d_%v", mig.Version, mig.Name))
+		}
+	}
+	unknown := []string{}
+	for _, a := range applied {
+		if _, ok := known[a.Version]; !ok {
+			unknown = append(unknown, fmt.Sprintf("%04d_%v", a.Version, a.Name))
+		}
+	}
+	sort.Strings(unknown)
+
+	if len(pending) > 0 || len(unknown) > 0 {
+		return fmt.Errorf("schema mismatch: pending migrations %v, unknown migrations %v", pending, unknown)
+	}
+	return nil
+}
+
+// 起動時にスキーマを検証する
+// SCHEMA_MIGRATION=auto の場合は未適用のマイグレーションを適用してから検証する
+func prepareSchema(ctx context.Context, db *sqlx.DB, mode string) error {
+	switch mode {
+	case schemaMigrationModeSkip:
+		return nil
+	case schemaMigrationModeAuto:
+		m, err := newMigrator(ctx, db)
+		if err != nil {
+			return err
+		}
+		_, err = m.Up(ctx, 0)
+		closeErr := m.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	case schemaMigrationModeCheck:
+	default:
+		return fmt.Errorf("unknown schema migration mode: %v", mode)
+	}
+	return checkSchemaVersion(ctx, db)
+}
+
+// 全てのマイグレーションを適用した状態を作るSQL
+// webapp/sql/0_Schema.sql はこれで生成し，直接編集しない
+// 既存のテーブルを消してから作り直すので，mysql コマンドでそのまま流せる
+func generateSchema() (string, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("-- webapp/go/migrations から生成したスキーマ．直接編集しないこと\n")
+	sb.WriteString("-- webapp/go で `go run . migrate schema > ../sql/0_Schema.sql` を実行して生成する\n\n")
+
+	tables := []string{}
+	for _, mig := range migrations {
+		for _, matches := range createTablePattern.FindAllStringSubmatch(mig.Up, -1) {
+			tables = append(tables, matches[1])
+		}
+	}
+	for i := len(tables) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "DROP TABLE IF EXISTS `%v`;\n", tables[i])
+	}
+	sb.WriteString("DROP TABLE IF EXISTS `schema_migrations`;\n")
+
+	for _, mig := range migrations {
+		fmt.Fprintf(&sb, "\n-- %04d_%v\n", mig.Version, mig.Name)
+		for i, statement := range splitStatements(mig.Up) {
+			if i > 0 {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(statement)
+			if !strings.HasSuffix(statement, ";") {
+				sb.WriteString(";")
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	sb.WriteString("\n" + schemaMigrationsTable + ";\n\n")
+	sb.WriteString("INSERT INTO `schema_migrations` (`version`, `name`) VALUES\n")
+	for i, mig := range migrations {
+		fmt.Fprintf(&sb, "  (%d, '%v')", mig.Version, mig.Name)
+		if i < len(migrations)-1 {
+			sb.WriteString(",\n")
+		} else {
+			sb.WriteString(";\n")
+		}
+	}
+	return sb.String(), nil
+}
+
+// `migrate` サブコマンド
+//
+//	migrate up [steps]    未適用のマイグレーションを適用する (steps 省略時は全て)
+//	migrate down [steps]  適用済みのマイグレーションを取り消す (steps 省略時は1件)
+//	migrate status        マイグレーションの適用状況を表示する
+//	migrate schema        全てのマイグレーションを適用した状態を作るSQLを出力する (DBには接続しない)
+func runMigrateCommand(db *sqlx.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status|schema [steps]")
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps <= 0 {
+			return fmt.Errorf("bad format: steps")
+		}
+	}
+
+	ctx := context.Background()
+	m, err := newMigrator(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch args[0] {
+	case "up":
+		done, err := m.Up(ctx, steps)
+		for _, mig := range done {
+			fmt.Fprintf(os.Stdout, "applied: %04d_%v\n", mig.Version, mig.Name)
+		}
+		return err
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		done, err := m.Down(ctx, steps)
+		for _, mig := range done {
+			fmt.Fprintf(os.Stdout, "reverted: %04d_%v\n", mig.Version, mig.Name)
+		}
+		return err
+	case "status":
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if a, ok := applied[mig.Version]; ok {
+				fmt.Fprintf(os.Stdout, "applied  %04d_%v (%v)\n", mig.Version, mig.Name, a.AppliedAt.Format(time.RFC3339))
+			} else {
+				fmt.Fprintf(os.Stdout, "pending  %04d_%v\n", mig.Version, mig.Name)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %v", args[0])
+	}
+}
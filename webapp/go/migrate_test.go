@@ -0,0 +1,21 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// webapp/sql/0_Schema.sql がマイグレーションから生成したものと一致しているか
+func TestSchemaIsGeneratedFromMigrations(t *testing.T) {
+	want, err := generateSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile("../sql/0_Schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Fatal("../sql/0_Schema.sql is out of date: run `go run . migrate schema > ../sql/0_Schema.sql`")
+	}
+}
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS `isu_association_config`;
+DROP TABLE IF EXISTS `user`;
+DROP TABLE IF EXISTS `isu_condition`;
+DROP TABLE IF EXISTS `isu`;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS `isu_latest_condition`;
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS `isu_latest_condition` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `updated_at` (`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
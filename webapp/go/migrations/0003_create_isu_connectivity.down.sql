@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `isu_connectivity_event`;
+DROP TABLE IF EXISTS `isu_connectivity`;
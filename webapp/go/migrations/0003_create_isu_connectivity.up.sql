@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS `isu_connectivity` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(16) NOT NULL,
+  `last_ingested_at` DATETIME(6) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `status_last_ingested_at` (`status`, `last_ingested_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_connectivity_event` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `previous_status` VARCHAR(16) NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_isu_uuid_created_at` (`jia_isu_uuid`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS `isu_maintenance` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `type` VARCHAR(32) NOT NULL,
+  `note` TEXT NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
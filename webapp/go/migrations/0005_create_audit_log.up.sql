@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS `audit_log` (
+  `id` bigint AUTO_INCREMENT,
+  `action` VARCHAR(64) NOT NULL,
+  `actor` VARCHAR(255) NOT NULL,
+  `jia_isu_uuid` VARCHAR(255) NOT NULL,
+  `ip` VARCHAR(64) NOT NULL,
+  `user_agent` VARCHAR(1024) NOT NULL,
+  `result` VARCHAR(16) NOT NULL,
+  `status_code` INT NOT NULL,
+  `detail` TEXT NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `actor_id` (`actor`, `id`),
+  INDEX `jia_isu_uuid_id` (`jia_isu_uuid`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
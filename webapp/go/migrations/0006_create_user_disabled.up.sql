@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS `user_disabled` (
+  `jia_user_id` VARCHAR(255) PRIMARY KEY,
+  `disabled_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,2 @@
+ALTER TABLE `isu_condition` DROP INDEX `jia_isu_uuid_message`;
+DROP TABLE IF EXISTS `condition_message`;
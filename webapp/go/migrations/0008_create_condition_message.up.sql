@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS `condition_message` (
+  `id` bigint AUTO_INCREMENT,
+  `message` VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+  `tokens` TEXT NOT NULL,
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `message` (`message`),
+  FULLTEXT KEY `tokens` (`tokens`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+ALTER TABLE `isu_condition` ADD INDEX `jia_isu_uuid_message` (`jia_isu_uuid`, `message`);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `isu_condition_quarantine` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `timestamp` bigint NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `reason` VARCHAR(32) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_isu_uuid_id` (`jia_isu_uuid`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS `isu_shard` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `shard_id` VARCHAR(64) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `updated_at` (`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `user_export_chunk`;
+DROP TABLE IF EXISTS `user_export`;
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS `user_export` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `size` bigint NOT NULL DEFAULT 0,
+  `error` TEXT,
+  `lease_expires_at` DATETIME(6),
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `completed_at` DATETIME(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_user_id_id` (`jia_user_id`, `id`),
+  INDEX `status_lease_expires_at` (`status`, `lease_expires_at`),
+  INDEX `created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `user_export_chunk` (
+  `user_export_id` bigint NOT NULL,
+  `seq` INT NOT NULL,
+  `data` MEDIUMBLOB NOT NULL,
+  PRIMARY KEY(`user_export_id`, `seq`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS `isu_deactivation` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(32) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_error` TEXT,
+  `next_attempt_at` DATETIME(6) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `status_next_attempt_at` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS `isu_group_isu`;
+DROP TABLE IF EXISTS `isu_group_tag`;
+DROP TABLE IF EXISTS `isu_group`;
+DROP TABLE IF EXISTS `isu_tag`;
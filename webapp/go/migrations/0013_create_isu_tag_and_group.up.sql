@@ -0,0 +1,29 @@
+CREATE TABLE IF NOT EXISTS `isu_tag` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `tag` VARCHAR(64) NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `tag`),
+  INDEX `tag_jia_isu_uuid` (`tag`, `jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_group` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `jia_user_id_name` (`jia_user_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_group_tag` (
+  `group_id` bigint NOT NULL,
+  `tag` VARCHAR(64) NOT NULL,
+  PRIMARY KEY(`group_id`, `tag`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_group_isu` (
+  `group_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  PRIMARY KEY(`group_id`, `jia_isu_uuid`),
+  INDEX `jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS `scoring_profile` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL DEFAULT '',
+  `definition` TEXT,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_user_id_id` (`jia_user_id`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1 @@
+ALTER TABLE `isu_condition` DROP INDEX `jia_isu_uuid_timestamp`;
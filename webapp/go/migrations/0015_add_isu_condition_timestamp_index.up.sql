@@ -0,0 +1 @@
+ALTER TABLE `isu_condition` ADD INDEX `jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`);
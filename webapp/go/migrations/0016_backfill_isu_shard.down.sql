@@ -0,0 +1,2 @@
+-- 補った配置とその後に記録した配置は区別できないので，何もしない
+DO 0;
@@ -0,0 +1,2 @@
+-- `isu_shard` を作る前に登録したISUのコンディションはプライマリにある
+INSERT IGNORE INTO `isu_shard` (`jia_isu_uuid`, `shard_id`) SELECT `jia_isu_uuid`, 'primary' FROM `isu`;
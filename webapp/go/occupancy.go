@@ -0,0 +1,441 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	occupancyDefaultRange          = time.Hour * 24 * 7
+	occupancyMaxRange              = time.Hour * 24 * 31
+	occupancyDefaultLongSession    = time.Hour * 2
+	sittingSessionMaxGap           = time.Hour // これより間隔が空いたコンディションは同じ着席とみなさない
+	occupancyHeatmapWeekdays       = 7
+	occupancyHeatmapHours          = 24
+	occupancyDateFormat            = "2006-01-02"
+	occupancyMaxSessionsInResponse = 1000
+)
+
+var occupancyLocation = loadOccupancyLocation()
+
+// 日毎の集計はDBと同じ Asia/Tokyo で区切る
+func loadOccupancyLocation() *time.Location {
+	loc, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		return time.FixedZone("Asia/Tokyo", 9*60*60)
+	}
+	return loc
+}
+
+// 連続して着席していた期間
+// 着席していないコンディションを受け取った時点か，最後に着席していたコンディションの時点で終わったとみなす
+type SittingSession struct {
+	JIAIsuUUID string `json:"jia_isu_uuid"`
+	StartAt    int64  `json:"start_at"`
+	EndAt      int64  `json:"end_at"`
+	Duration   int64  `json:"duration"` // 秒
+	Ongoing    bool   `json:"ongoing"`  // 期間の最後のコンディションでも着席していた
+}
+
+type OccupancyDailyTotal struct {
+	Date           string `json:"date"`
+	SittingSeconds int64  `json:"sitting_seconds"`
+	SessionCount   int    `json:"session_count"`
+}
+
+// 曜日 × 時間帯毎の着席率
+type OccupancyHeatmapCell struct {
+	Weekday           int `json:"weekday"` // 0 が日曜日
+	Hour              int `json:"hour"`
+	ConditionCount    int `json:"condition_count"`
+	SittingPercentage int `json:"sitting_percentage"`
+}
+
+type OccupancyResponse struct {
+	StartAt          int64                  `json:"start_at"`
+	EndAt            int64                  `json:"end_at"`
+	SittingSeconds   int64                  `json:"sitting_seconds"`
+	SessionCount     int                    `json:"session_count"`
+	LongSessionCount int                    `json:"long_session_count"`
+	LongestSession   *SittingSession        `json:"longest_session"`
+	DailyTotals      []OccupancyDailyTotal  `json:"daily_totals"`
+	Heatmap          []OccupancyHeatmapCell `json:"heatmap"`
+}
+
+type IsuOccupancyResponse struct {
+	OccupancyResponse
+	Sessions []SittingSession `json:"sessions"`
+}
+
+type OccupancyIsuSummary struct {
+	JIAIsuUUID       string          `json:"jia_isu_uuid"`
+	Name             string          `json:"name"`
+	SittingSeconds   int64           `json:"sitting_seconds"`
+	SessionCount     int             `json:"session_count"`
+	LongSessionCount int             `json:"long_session_count"`
+	LongestSession   *SittingSession `json:"longest_session"`
+}
+
+type FleetOccupancyResponse struct {
+	OccupancyResponse
+	Isus []OccupancyIsuSummary `json:"isus"`
+}
+
+type occupancyCondition struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	Timestamp  time.Time `db:"timestamp"`
+	IsSitting  bool      `db:"is_sitting"`
+}
+
+// 期間内のコンディションから着席と着席率を集計する
+// ISU毎にタイムスタンプ順でコンディションを渡すこと
+type occupancyAnalyzer struct {
+	longSession time.Duration
+	sessions    []SittingSession
+	daily       map[string]*OccupancyDailyTotal
+	sitting     [occupancyHeatmapWeekdays][occupancyHeatmapHours]int
+	total       [occupancyHeatmapWeekdays][occupancyHeatmapHours]int
+
+	// 集計中のISUの状態
+	jiaIsuUUID   string
+	sittingSince time.Time
+	last         time.Time
+	lastSitting  bool
+}
+
+func newOccupancyAnalyzer(longSession time.Duration) *occupancyAnalyzer {
+	return &occupancyAnalyzer{
+		longSession: longSession,
+		sessions:    []SittingSession{},
+		daily:       map[string]*OccupancyDailyTotal{},
+	}
+}
+
+func (oa *occupancyAnalyzer) add(cond occupancyCondition) {
+	if cond.JIAIsuUUID != oa.jiaIsuUUID {
+		oa.flush(true)
+		oa.jiaIsuUUID = cond.JIAIsuUUID
+	} else if oa.lastSitting && cond.Timestamp.Sub(oa.last) > sittingSessionMaxGap {
+		// 間が空いた場合は最後に着席していた時点で終わったとみなす
+		oa.closeSession(oa.last, false)
+	}
+
+	t := cond.Timestamp.In(occupancyLocation)
+	oa.total[t.Weekday()][t.Hour()]++
+	if cond.IsSitting {
+		oa.sitting[t.Weekday()][t.Hour()]++
+		if !oa.lastSitting {
+			oa.sittingSince = cond.Timestamp
+		}
+	} else if oa.lastSitting {
+		oa.closeSession(cond.Timestamp, false)
+	}
+	oa.last = cond.Timestamp
+	oa.lastSitting = cond.IsSitting
+}
+
+// 集計中のISUの着席を終える
+func (oa *occupancyAnalyzer) flush(ongoing bool) {
+	if oa.lastSitting {
+		oa.closeSession(oa.last, ongoing)
+	}
+	oa.lastSitting = false
+}
+
+func (oa *occupancyAnalyzer) closeSession(endAt time.Time, ongoing bool) {
+	oa.sessions = append(oa.sessions, SittingSession{
+		JIAIsuUUID: oa.jiaIsuUUID,
+		StartAt:    oa.sittingSince.Unix(),
+		EndAt:      endAt.Unix(),
+		Duration:   int64(endAt.Sub(oa.sittingSince) / time.Second),
+		Ongoing:    ongoing,
+	})
+	oa.lastSitting = false
+
+	// 日をまたぐ着席はそれぞれの日に振り分ける
+	start := oa.sittingSince.In(occupancyLocation)
+	end := endAt.In(occupancyLocation)
+	oa.dailyTotal(start).SessionCount++
+	for start.Before(end) {
+		year, month, day := start.Date()
+		nextDay := time.Date(year, month, day+1, 0, 0, 0, 0, occupancyLocation)
+		if nextDay.After(end) {
+			nextDay = end
+		}
+		oa.dailyTotal(start).SittingSeconds += int64(nextDay.Sub(start) / time.Second)
+		start = nextDay
+	}
+}
+
+func (oa *occupancyAnalyzer) dailyTotal(t time.Time) *OccupancyDailyTotal {
+	date := t.Format(occupancyDateFormat)
+	total, ok := oa.daily[date]
+	if !ok {
+		total = &OccupancyDailyTotal{Date: date}
+		oa.daily[date] = total
+	}
+	return total
+}
+
+// 着席の一覧から合計と最長の着席を求める
+// 呼び出し元が sessions を並べ替えても変わらないよう，最長の着席はコピーを返す
+func summarizeSittingSessions(sessions []SittingSession, longSession time.Duration) (int64, int, *SittingSession) {
+	var sittingSeconds int64
+	longSessionCount := 0
+	var longest *SittingSession
+	for i := range sessions {
+		sittingSeconds += sessions[i].Duration
+		if sessions[i].Duration >= int64(longSession/time.Second) {
+			longSessionCount++
+		}
+		if longest == nil || sessions[i].Duration > longest.Duration {
+			session := sessions[i]
+			longest = &session
+		}
+	}
+	return sittingSeconds, longSessionCount, longest
+}
+
+func (oa *occupancyAnalyzer) response(startAt time.Time, endAt time.Time) OccupancyResponse {
+	oa.flush(true)
+
+	sittingSeconds, longSessionCount, longest := summarizeSittingSessions(oa.sessions, oa.longSession)
+	res := OccupancyResponse{
+		StartAt:          startAt.Unix(),
+		EndAt:            endAt.Unix(),
+		SittingSeconds:   sittingSeconds,
+		SessionCount:     len(oa.sessions),
+		LongSessionCount: longSessionCount,
+		LongestSession:   longest,
+		DailyTotals:      []OccupancyDailyTotal{},
+		Heatmap:          make([]OccupancyHeatmapCell, 0, occupancyHeatmapWeekdays*occupancyHeatmapHours),
+	}
+
+	day := startAt.In(occupancyLocation)
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, occupancyLocation)
+	for day.Before(endAt) {
+		date := day.Format(occupancyDateFormat)
+		if total, ok := oa.daily[date]; ok {
+			res.DailyTotals = append(res.DailyTotals, *total)
+		} else {
+			res.DailyTotals = append(res.DailyTotals, OccupancyDailyTotal{Date: date})
+		}
+		day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, occupancyLocation)
+	}
+
+	for weekday := 0; weekday < occupancyHeatmapWeekdays; weekday++ {
+		for hour := 0; hour < occupancyHeatmapHours; hour++ {
+			cell := OccupancyHeatmapCell{
+				Weekday:        weekday,
+				Hour:           hour,
+				ConditionCount: oa.total[weekday][hour],
+			}
+			if cell.ConditionCount > 0 {
+				cell.SittingPercentage = oa.sitting[weekday][hour] * 100 / cell.ConditionCount
+			}
+			res.Heatmap = append(res.Heatmap, cell)
+		}
+	}
+	return res
+}
+
+// 集計期間と長時間の着席とみなす時間をクエリパラメータから取得
+// 返すエラーのメッセージはそのままレスポンスとして使う
+func parseOccupancyRange(c echo.Context) (time.Time, time.Time, time.Duration, error) {
+	until := time.Now()
+	if untilStr := c.QueryParam("until"); untilStr != "" {
+		untilInt64, err := strconv.ParseInt(untilStr, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("bad format: until")
+		}
+		until = time.Unix(untilInt64, 0)
+	}
+
+	since := until.Add(-occupancyDefaultRange)
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		sinceInt64, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("bad format: since")
+		}
+		since = time.Unix(sinceInt64, 0)
+	}
+
+	if !since.Before(until) {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("bad request: since must be before until")
+	}
+	if until.Sub(since) > occupancyMaxRange {
+		return time.Time{}, time.Time{}, 0, fmt.Errorf("bad request: range too large")
+	}
+
+	longSession := occupancyDefaultLongSession
+	if longSessionStr := c.QueryParam("long_session"); longSessionStr != "" {
+		var err error
+		longSession, err = time.ParseDuration(longSessionStr)
+		if err != nil || longSession <= 0 {
+			return time.Time{}, time.Time{}, 0, fmt.Errorf("bad format: long_session")
+		}
+	}
+
+	return since, until, longSession, nil
+}
+
+// ISUのコンディションを順に集計する
+// 1つのISUのコンディションは1つのシャードにまとまっているので，シャード毎に読めばよい
+func analyzeOccupancy(jiaIsuUUIDs []string, since time.Time, until time.Time, analyzer *occupancyAnalyzer) error {
+	shards, groups := conditionShards.Group(jiaIsuUUIDs)
+	for i, shard := range shards {
+		err := analyzeShardOccupancy(shard.DB, groups[i], since, until, analyzer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func analyzeShardOccupancy(db *sqlx.DB, jiaIsuUUIDs []string, since time.Time, until time.Time, analyzer *occupancyAnalyzer) error {
+	query, args, err := sqlx.In(
+		"SELECT `jia_isu_uuid`, `timestamp`, `is_sitting` FROM `isu_condition`"+
+			"	WHERE `jia_isu_uuid` IN (?) AND ? <= `timestamp` AND `timestamp` < ?"+
+			"	ORDER BY `jia_isu_uuid`, `timestamp`",
+		jiaIsuUUIDs, since, until)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cond occupancyCondition
+		err = rows.StructScan(&cond)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		analyzer.add(cond)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// GET /api/isu/:jia_isu_uuid/occupancy
+// ISUの着席の履歴と着席率を取得
+func getIsuOccupancy(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	since, until, longSession, err := parseOccupancyRange(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	var isuID int
+	err = db.Get(&isuID, "SELECT `id` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	analyzer := newOccupancyAnalyzer(longSession)
+	err = analyzeOccupancy([]string{jiaIsuUUID}, since, until, analyzer)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := IsuOccupancyResponse{
+		OccupancyResponse: analyzer.response(since, until),
+		Sessions:          analyzer.sessions,
+	}
+	// 新しい順に返す
+	for i, j := 0, len(res.Sessions)-1; i < j; i, j = i+1, j-1 {
+		res.Sessions[i], res.Sessions[j] = res.Sessions[j], res.Sessions[i]
+	}
+	if len(res.Sessions) > occupancyMaxSessionsInResponse {
+		res.Sessions = res.Sessions[:occupancyMaxSessionsInResponse]
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/occupancy
+// 自分の全てのISUの着席率と，ISU毎の着席の集計を取得
+func getFleetOccupancy(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	since, until, longSession, err := parseOccupancyRange(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	isuList := []Isu{}
+	err = db.Select(&isuList, "SELECT `id`, `jia_isu_uuid`, `name` FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id` DESC",
+		jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	jiaIsuUUIDs := make([]string, 0, len(isuList))
+	for _, isu := range isuList {
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+
+	analyzer := newOccupancyAnalyzer(longSession)
+	err = analyzeOccupancy(jiaIsuUUIDs, since, until, analyzer)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := FleetOccupancyResponse{
+		OccupancyResponse: analyzer.response(since, until),
+		Isus:              []OccupancyIsuSummary{},
+	}
+	sessionsByIsu := map[string][]SittingSession{}
+	for _, session := range analyzer.sessions {
+		sessionsByIsu[session.JIAIsuUUID] = append(sessionsByIsu[session.JIAIsuUUID], session)
+	}
+	for _, isu := range isuList {
+		sessions := sessionsByIsu[isu.JIAIsuUUID]
+		sittingSeconds, longSessionCount, longest := summarizeSittingSessions(sessions, longSession)
+		res.Isus = append(res.Isus, OccupancyIsuSummary{
+			JIAIsuUUID:       isu.JIAIsuUUID,
+			Name:             isu.Name,
+			SittingSeconds:   sittingSeconds,
+			SessionCount:     len(sessions),
+			LongSessionCount: longSessionCount,
+			LongestSession:   longest,
+		})
+	}
+	return c.JSON(http.StatusOK, res)
+}
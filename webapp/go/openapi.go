@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	openAPIValidationOff      = "off"
+	openAPIValidationRequest  = "request"
+	openAPIValidationResponse = "response" // リクエストに加えてレスポンスも検証する．デバッグ用
+
+	openAPISchemaRefPrefix = "#/components/schemas/"
+
+	// 検証のために読み込む JSON のリクエストボディの上限
+	openAPIRequestBodyMaxSize = 1 << 20
+)
+
+var errOpenAPIRequestBodyTooLarge = errors.New("request body too large")
+
+// セキュリティスキーム毎の認証
+// 認証されていないリクエストのために検証の手間をかけないよう，検証より先に行う
+// 返すステータスコードとエラーのメッセージはそのままレスポンスとして使う
+var openAPIAuthenticators = map[string]func(c echo.Context) (int, error){
+	"session": func(c echo.Context) (int, error) {
+		_, errStatusCode, err := getUserIDFromSession(c)
+		if err != nil && errStatusCode == http.StatusUnauthorized {
+			return http.StatusUnauthorized, fmt.Errorf("you are not signed in")
+		}
+		return errStatusCode, err
+	},
+	"adminToken": checkAdminToken,
+	"gatewayToken": func(c echo.Context) (int, error) {
+		_, errStatusCode, err := checkGatewayToken(c)
+		return errStatusCode, err
+	},
+}
+
+// 全ての言語実装が従うAPI仕様
+// ルートやリクエスト，レスポンスを変更した場合はここも更新すること
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+type openAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Format     string                    `json:"format"`
+	Enum       []interface{}             `json:"enum"`
+	Nullable   bool                      `json:"nullable"`
+	Items      *openAPISchema            `json:"items"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Required   []string                  `json:"required"`
+	AllOf      []*openAPISchema          `json:"allOf"`
+	AnyOf      []*openAPISchema          `json:"anyOf"`
+	Minimum    *float64                  `json:"minimum"`
+	Maximum    *float64                  `json:"maximum"`
+	MinLength  *int                      `json:"minLength"`
+	MaxLength  *int                      `json:"maxLength"`
+	MinItems   *int                      `json:"minItems"`
+}
+
+type openAPIParameter struct {
+	Name           string         `json:"name"`
+	In             string         `json:"in"`
+	Required       bool           `json:"required"`
+	Schema         *openAPISchema `json:"schema"`
+	MissingMessage string         `json:"x-missing-message"` // 既存のクライアントとの互換のため，未指定時のメッセージを変える
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Security    []map[string][]string      `json:"security"`
+	Parameters  []openAPIParameter         `json:"parameters"`
+	RequestBody *openAPIRequestBody        `json:"requestBody"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	// ボディの大きさを制限しながら読むハンドラーに検証を任せる
+	// 大量に届くISUのコンディションを2度読まないためにも使う
+	BodyValidatedByHandler bool `json:"x-body-validated-by-handler"`
+}
+
+type openAPISpec struct {
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*openAPISchema `json:"schemas"`
+	} `json:"components"`
+}
+
+// API仕様に従ってリクエストとレスポンスを検証する
+type openAPIValidator struct {
+	schemas          map[string]*openAPISchema
+	operations       map[string]*openAPIOperation // "GET /api/isu/:jia_isu_uuid" の形式のキー
+	validateResponse bool
+}
+
+func newOpenAPIValidator(document []byte, validateResponse bool) (*openAPIValidator, error) {
+	var spec openAPISpec
+	err := json.Unmarshal(document, &spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document: %v", err)
+	}
+
+	v := &openAPIValidator{
+		schemas:          spec.Components.Schemas,
+		operations:       map[string]*openAPIOperation{},
+		validateResponse: validateResponse,
+	}
+	for path, item := range spec.Paths {
+		// `{name}` 形式のパスパラメータを echo のルートの形式に変換する
+		routePath := path
+		for {
+			start := strings.Index(routePath, "{")
+			end := strings.Index(routePath, "}")
+			if start < 0 || end < start {
+				break
+			}
+			routePath = routePath[:start] + ":" + routePath[start+1:end] + routePath[end+1:]
+		}
+		for method, operation := range item {
+			v.operations[strings.ToUpper(method)+" "+routePath] = operation
+		}
+	}
+
+	for key, operation := range v.operations {
+		for _, param := range operation.Parameters {
+			if err := v.checkRef(param.Schema); err != nil {
+				return nil, fmt.Errorf("%v: %v", key, err)
+			}
+		}
+	}
+	return v, nil
+}
+
+// 参照先のスキーマが存在するか確認
+func (v *openAPIValidator) checkRef(s *openAPISchema) error {
+	if s == nil {
+		return nil
+	}
+	if s.Ref != "" {
+		if v.resolve(s) == nil {
+			return fmt.Errorf("unknown schema: %v", s.Ref)
+		}
+		return nil
+	}
+	return v.checkRef(s.Items)
+}
+
+func (v *openAPIValidator) resolve(s *openAPISchema) *openAPISchema {
+	for s != nil && s.Ref != "" {
+		s = v.schemas[strings.TrimPrefix(s.Ref, openAPISchemaRefPrefix)]
+	}
+	return s
+}
+
+func joinOpenAPIPath(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func openAPIBadFormat(path string) error {
+	if path == "" {
+		return fmt.Errorf("bad request body")
+	}
+	return fmt.Errorf("bad format: %v", path)
+}
+
+// 値がスキーマに従っているか検証
+// 数値は json.Number として渡すこと
+// 返すエラーのメッセージはそのままレスポンスとして使う
+func (v *openAPIValidator) validateValue(s *openAPISchema, value interface{}, path string) error {
+	s = v.resolve(s)
+	if s == nil {
+		return nil
+	}
+	if value == nil {
+		if s.Nullable || s.Type == "" && len(s.AllOf) == 0 && len(s.AnyOf) == 0 {
+			return nil
+		}
+		return openAPIBadFormat(path)
+	}
+
+	for _, sub := range s.AllOf {
+		if err := v.validateValue(sub, value, path); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var firstErr error
+		for _, sub := range s.AnyOf {
+			err := v.validateValue(sub, value, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, candidate := range s.Enum {
+			if fmt.Sprint(candidate) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return openAPIBadFormat(path)
+		}
+	}
+
+	switch s.Type {
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return openAPIBadFormat(path)
+		}
+		length := utf8.RuneCountInString(str)
+		if (s.MinLength != nil && length < *s.MinLength) || (s.MaxLength != nil && length > *s.MaxLength) {
+			return openAPIBadFormat(path)
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			return openAPIBadFormat(path)
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return openAPIBadFormat(path)
+		}
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				return openAPIBadFormat(path)
+			}
+		}
+		if (s.Minimum != nil && f < *s.Minimum) || (s.Maximum != nil && f > *s.Maximum) {
+			return openAPIBadFormat(path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return openAPIBadFormat(path)
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return openAPIBadFormat(path)
+		}
+		if s.MinItems != nil && len(items) < *s.MinItems {
+			return openAPIBadFormat(path)
+		}
+		for i, item := range items {
+			if err := v.validateValue(s.Items, item, fmt.Sprintf("%v[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return openAPIBadFormat(path)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("missing: %v", joinOpenAPIPath(path, name))
+			}
+		}
+		for name, property := range s.Properties {
+			if propertyValue, ok := obj[name]; ok {
+				if err := v.validateValue(property, propertyValue, joinOpenAPIPath(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// クエリパラメータ等の文字列をスキーマの型に変換して検証
+func (v *openAPIValidator) validateParameter(param openAPIParameter, raw string) error {
+	s := v.resolve(param.Schema)
+	if s == nil {
+		return nil
+	}
+
+	var value interface{}
+	switch s.Type {
+	case "array":
+		// 配列は explode: false のカンマ区切りのみ対応する
+		items := []interface{}{}
+		for _, item := range strings.Split(raw, ",") {
+			parsed, ok := parseOpenAPIScalar(v.resolve(s.Items), item)
+			if !ok {
+				return openAPIBadFormat(param.Name)
+			}
+			items = append(items, parsed)
+		}
+		value = items
+	default:
+		parsed, ok := parseOpenAPIScalar(s, raw)
+		if !ok {
+			return openAPIBadFormat(param.Name)
+		}
+		value = parsed
+	}
+	if err := v.validateValue(s, value, param.Name); err != nil {
+		// 配列の要素の位置ではなくパラメータ名を返す
+		return openAPIBadFormat(param.Name)
+	}
+	return nil
+}
+
+func parseOpenAPIScalar(s *openAPISchema, raw string) (interface{}, bool) {
+	if s == nil {
+		return raw, true
+	}
+	switch s.Type {
+	case "integer":
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, false
+		}
+		return json.Number(raw), true
+	case "number":
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return nil, false
+		}
+		return json.Number(raw), true
+	case "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, false
+		}
+		return b, true
+	default:
+		return raw, true
+	}
+}
+
+func (v *openAPIValidator) validateRequest(c echo.Context, operation *openAPIOperation) error {
+	for _, param := range operation.Parameters {
+		var raw string
+		switch param.In {
+		case "path":
+			raw = c.Param(param.Name)
+		case "query":
+			raw = c.QueryParam(param.Name)
+		case "header":
+			raw = c.Request().Header.Get(param.Name)
+		default:
+			continue
+		}
+
+		if raw == "" {
+			if param.Required {
+				if param.MissingMessage != "" {
+					return fmt.Errorf("%v", param.MissingMessage)
+				}
+				return fmt.Errorf("missing: %v", param.Name)
+			}
+			continue
+		}
+		if err := v.validateParameter(param, raw); err != nil {
+			return err
+		}
+	}
+
+	if operation.RequestBody != nil && !operation.BodyValidatedByHandler {
+		return v.validateRequestBody(c, operation.RequestBody)
+	}
+	return nil
+}
+
+func (v *openAPIValidator) validateRequestBody(c echo.Context, requestBody *openAPIRequestBody) error {
+	// 圧縮されたボディは展開してから読むハンドラーに任せる
+	if isCompressedRequest(c.Request()) {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		if requestBody.Required {
+			return fmt.Errorf("bad request body")
+		}
+		return nil
+	}
+	content, ok := requestBody.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("bad request body")
+	}
+
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, openAPIRequestBodyMaxSize+1))
+		if err != nil {
+			return fmt.Errorf("bad request body")
+		}
+		if len(body) > openAPIRequestBodyMaxSize {
+			return errOpenAPIRequestBodyTooLarge
+		}
+		// ハンドラーでもう一度読めるように戻しておく
+		c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if len(bytes.TrimSpace(body)) == 0 {
+			if requestBody.Required {
+				return fmt.Errorf("bad request body")
+			}
+			return nil
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("bad request body")
+		}
+		return v.validateValue(content.Schema, value, "")
+	case echo.MIMEMultipartForm:
+		form, err := c.MultipartForm()
+		if err != nil {
+			return fmt.Errorf("bad request body")
+		}
+		s := v.resolve(content.Schema)
+		if s == nil {
+			return nil
+		}
+		for _, name := range s.Required {
+			if len(form.Value[name]) == 0 && len(form.File[name]) == 0 {
+				return fmt.Errorf("missing: %v", name)
+			}
+		}
+		for name, property := range s.Properties {
+			property = v.resolve(property)
+			if property == nil || property.Format == "binary" || len(form.Value[name]) == 0 {
+				continue
+			}
+			if err := v.validateParameter(openAPIParameter{Name: name, Schema: property}, form.Value[name][0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 操作のセキュリティ要件のいずれかを満たすか確認
+// 要件を1つも満たさない場合は，最初の要件の失敗を返す
+func (v *openAPIValidator) authenticate(c echo.Context, operation *openAPIOperation) (int, error) {
+	var firstStatusCode int
+	var firstErr error
+	for _, requirement := range operation.Security {
+		var statusCode int
+		var err error
+		for scheme := range requirement {
+			authenticator, ok := openAPIAuthenticators[scheme]
+			if !ok {
+				return http.StatusInternalServerError, fmt.Errorf("unknown security scheme: %v", scheme)
+			}
+			if statusCode, err = authenticator(c); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			return 0, nil
+		}
+		if firstErr == nil {
+			firstStatusCode, firstErr = statusCode, err
+		}
+	}
+	return firstStatusCode, firstErr
+}
+
+// レスポンスを検証するために書き込まれた内容を控えておく
+type openAPIResponseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *openAPIResponseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// レスポンスが仕様に従っているか検証
+// 既に送ったレスポンスは変えられないので，違反はログに出すだけにする
+func (v *openAPIValidator) checkResponse(c echo.Context, operation *openAPIOperation, body []byte) error {
+	status := c.Response().Status
+	response, ok := operation.Responses[strconv.Itoa(status)]
+	if !ok {
+		return fmt.Errorf("undocumented status code: %v", status)
+	}
+
+	content, ok := response.Content[echo.MIMEApplicationJSON]
+	if !ok || content.Schema == nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid json: %v", err)
+	}
+	return v.validateValue(content.Schema, value, "")
+}
+
+// API仕様に従ってリクエストを検証するミドルウェア
+// 仕様に載っていないルートは検証しない
+// 認証が必要な操作は，認証してから検証する
+func (v *openAPIValidator) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			operation, ok := v.operations[c.Request().Method+" "+c.Path()]
+			if !ok {
+				return next(c)
+			}
+
+			if errStatusCode, err := v.authenticate(c, operation); err != nil {
+				if errStatusCode == http.StatusInternalServerError {
+					c.Logger().Error(err)
+					return c.NoContent(http.StatusInternalServerError)
+				}
+				return c.String(errStatusCode, err.Error())
+			}
+
+			if err := v.validateRequest(c, operation); err != nil {
+				if errors.Is(err, errOpenAPIRequestBodyTooLarge) {
+					return c.String(http.StatusRequestEntityTooLarge, err.Error())
+				}
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+
+			if !v.validateResponse {
+				return next(c)
+			}
+
+			writer := c.Response().Writer
+			recorder := &openAPIResponseRecorder{ResponseWriter: writer}
+			c.Response().Writer = recorder
+			defer func() {
+				c.Response().Writer = writer
+			}()
+
+			if err := next(c); err != nil {
+				return err
+			}
+			if err := v.checkResponse(c, operation, recorder.body.Bytes()); err != nil {
+				c.Logger().Errorf("openapi: %v %v: response does not match the specification: %v", c.Request().Method, c.Path(), err)
+			}
+			return nil
+		}
+	}
+}
+
+// GET /api/openapi.json
+// API仕様を取得
+func getOpenAPI(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, openAPIDocument)
+}
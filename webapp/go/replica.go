@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	readYourWritesCookieName    = "isucondition_rw"
+	replicaHealthCheckInterval  = time.Second
+	replicaHealthCheckTimeout   = time.Second
+	replicaMaxOpenConns         = 10
+	defaultReplicaMaxLag        = time.Second * 2
+	defaultReadYourWritesWindow = time.Second * 5
+)
+
+var (
+	replicas = newReplicaRouter()
+
+	// 書き込んだセッションがこの期間内に読み込む場合はレプリカを使わない
+	readYourWritesWindow = defaultReadYourWritesWindow
+	// 遅延がこれより大きいレプリカは使わない
+	replicaMaxLag = defaultReplicaMaxLag
+
+	// レプリケーションが止まっているだけで，再開すれば使える
+	errReplicationNotRunning = errors.New("replication is not running")
+)
+
+// 読み込み専用のレプリカ
+// ヘルスチェックで遅延が replicaMaxLag 以下と確認できたものだけを使う
+type dbReplica struct {
+	Addr string
+	DB   *sqlx.DB
+
+	mu      sync.RWMutex
+	healthy bool
+	checked bool
+}
+
+func (r *dbReplica) isHealthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.healthy
+}
+
+// プライマリやシャード毎のレプリカ
+// 同じDBを共有するシャードはレプリカも共有する
+type replicaRouter struct {
+	replicas map[*sqlx.DB][]*dbReplica
+	next     uint32
+}
+
+func newReplicaRouter() *replicaRouter {
+	return &replicaRouter{replicas: map[*sqlx.DB][]*dbReplica{}}
+}
+
+// MYSQL_REPLICAS を読み込みレプリカに接続する
+// プライマリのレプリカは `host:port`，シャードのレプリカは `shard_id=host:port` をカンマ区切りで並べる
+// ユーザー名やパスワード，DB名はプライマリと同じものを使う
+func connectReplicas(primary *MySQLConnectionEnv, shards *conditionShardRouter, s string) (*replicaRouter, error) {
+	router := newReplicaRouter()
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		source, addr := db, entry
+		if kv := strings.SplitN(entry, "=", 2); len(kv) == 2 {
+			shard, ok := shards.byID[kv[0]]
+			if !ok {
+				return nil, fmt.Errorf("unknown shard in MYSQL_REPLICAS: %v", kv[0])
+			}
+			source, addr = shard.DB, kv[1]
+		}
+		host, port, ok := parseMySQLHostPort(addr)
+		if !ok {
+			return nil, fmt.Errorf("bad format: MYSQL_REPLICAS: %v", entry)
+		}
+
+		env := *primary
+		env.Host, env.Port = host, port
+		replicaDB, err := env.ConnectDB()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect replica %v: %v", addr, err)
+		}
+		replicaDB.SetMaxOpenConns(replicaMaxOpenConns)
+		router.replicas[source] = append(router.replicas[source], &dbReplica{Addr: addr, DB: replicaDB})
+	}
+	return router, nil
+}
+
+// 環境変数からレプリカの遅延の許容範囲と，書き込み後にプライマリを読む期間を読み込む
+func replicaSettingsFromEnv() (time.Duration, time.Duration, error) {
+	maxLag, err := getEnvDuration("REPLICA_MAX_LAG", defaultReplicaMaxLag)
+	if err != nil {
+		return 0, 0, err
+	}
+	window, err := getEnvDuration("READ_YOUR_WRITES_WINDOW", defaultReadYourWritesWindow)
+	if err != nil {
+		return 0, 0, err
+	}
+	// 遅延は秒単位でしか分からないため，許容範囲より1秒以上長くしないと書き込みがまだ届いていないレプリカを読むことがある
+	if window < maxLag+time.Second {
+		return 0, 0, fmt.Errorf("READ_YOUR_WRITES_WINDOW must be at least REPLICA_MAX_LAG + 1s")
+	}
+	return maxLag, window, nil
+}
+
+// 全てのレプリカ
+func (rr *replicaRouter) All() []*dbReplica {
+	res := []*dbReplica{}
+	for _, rs := range rr.replicas {
+		res = append(res, rs...)
+	}
+	return res
+}
+
+// source の代わりに読み込みに使うDB
+// 使えるレプリカがない場合は source を返す
+func (rr *replicaRouter) Reader(source *sqlx.DB) *sqlx.DB {
+	rs := rr.replicas[source]
+	if len(rs) == 0 {
+		return source
+	}
+	start := atomic.AddUint32(&rr.next, 1)
+	for i := 0; i < len(rs); i++ {
+		r := rs[(int(start)+i)%len(rs)]
+		if r.isHealthy() {
+			return r.DB
+		}
+	}
+	return source
+}
+
+// レプリカの遅延を調べ，使えるかどうかを更新する
+func (rr *replicaRouter) CheckHealth() {
+	for _, r := range rr.All() {
+		lag, err := getReplicaLag(r.DB)
+		healthy := err == nil && lag <= replicaMaxLag
+
+		r.mu.Lock()
+		// 起動時から使えないレプリカも記録する
+		wasHealthy := r.healthy || !r.checked
+		r.healthy = healthy
+		r.checked = true
+		r.mu.Unlock()
+
+		switch {
+		case err != nil && wasHealthy:
+			log.Warnf("replica %v is removed from rotation: %v", r.Addr, err)
+		case err == nil && !healthy && wasHealthy:
+			log.Warnf("replica %v is removed from rotation: lag %v", r.Addr, lag)
+		case healthy && !wasHealthy:
+			log.Infof("replica %v is back in rotation: lag %v", r.Addr, lag)
+		}
+	}
+}
+
+// 起動時に全てのレプリカの遅延を調べられることを確かめる
+// 権限がない，レプリカではない等の理由で調べられないレプリカは，いつまでも使われないのでエラーにする
+func (rr *replicaRouter) Verify() error {
+	for _, r := range rr.All() {
+		_, err := getReplicaLag(r.DB)
+		if err != nil && !errors.Is(err, errReplicationNotRunning) {
+			return fmt.Errorf("cannot check replica %v: %v", r.Addr, err)
+		}
+	}
+	return nil
+}
+
+func (rr *replicaRouter) RunHealthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rr.CheckHealth()
+	}
+}
+
+// SHOW REPLICA STATUS の Seconds_Behind_Source を遅延とする
+// 古いMySQLでは SHOW SLAVE STATUS の Seconds_Behind_Master を使い，MariaDBはどちらの文でも Seconds_Behind_Master を返す
+// レプリケーションが止まっている場合は NULL になるのでエラーとする
+func getReplicaLag(replicaDB *sqlx.DB) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), replicaHealthCheckTimeout)
+	defer cancel()
+
+	rows, err := replicaDB.QueryxContext(ctx, "SHOW REPLICA STATUS")
+	if mysqlErr, ok := err.(*mysql.MySQLError); ok && mysqlErr.Number == mysqlErrNumParseError {
+		rows, err = replicaDB.QueryxContext(ctx, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("db error: %v", err)
+		}
+		return 0, fmt.Errorf("not a replica")
+	}
+	status := map[string]interface{}{}
+	err = rows.MapScan(status)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+
+	column := "Seconds_Behind_Source"
+	if _, ok := status[column]; !ok {
+		column = "Seconds_Behind_Master"
+	}
+	value, ok := status[column]
+	if !ok {
+		return 0, fmt.Errorf("replica status has no Seconds_Behind_Source or Seconds_Behind_Master")
+	}
+	var seconds sql.NullString
+	if err := seconds.Scan(value); err != nil || !seconds.Valid {
+		return 0, errReplicationNotRunning
+	}
+	n, err := strconv.ParseInt(seconds.String, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad format: %v: %v", column, seconds.String)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// 読み込みに使うDB
+// セッションが直前に書き込んでいた場合は，自身の書き込みが見えるよう source をそのまま使う
+func readDB(c echo.Context, source *sqlx.DB) *sqlx.DB {
+	if cookie, err := c.Cookie(readYourWritesCookieName); err == nil {
+		wroteAt, err := strconv.ParseInt(cookie.Value, 10, 64)
+		if err == nil && time.Since(time.Unix(0, wroteAt)) < readYourWritesWindow {
+			return source
+		}
+	}
+	return replicas.Reader(source)
+}
+
+// ログイン中のセッションによる書き込みを記録するミドルウェア
+// 書き込みに成功したレスポンスに，書き込んだ時刻を持つ短命なCookieを付ける
+func readYourWrites(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(c)
+		}
+		if _, err := c.Cookie(sessionName); err != nil {
+			return next(c)
+		}
+
+		res := c.Response()
+		res.Before(func() {
+			if res.Status >= http.StatusBadRequest {
+				return
+			}
+			http.SetCookie(res, &http.Cookie{
+				Name:     readYourWritesCookieName,
+				Value:    strconv.FormatInt(time.Now().UnixNano(), 10),
+				Path:     "/",
+				MaxAge:   int((readYourWritesWindow + time.Second - 1) / time.Second),
+				HttpOnly: true,
+			})
+		})
+		return next(c)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	scoringProfileSyncInterval    = time.Second
+	scoringProfileReloadInterval  = time.Minute // 件数で気付けない取りこぼしも，定期的に全て読み直して取り込む
+	scoringProfileVersionHeader   = "X-Scoring-Profile-Version"
+	scoringProfileVersionParam    = "scoring_profile_version"
+	scoringProfileMaxWeight       = 100
+	scoringProfileMaxScore        = 100
+	scoringProfileMaxThreshold    = scoringProfileMaxWeight * 3
+	builtinScoringProfileVersion  = 0
+	scoringProfileScopeBuiltin    = "builtin"
+	scoringProfileScopeDeployment = "deployment"
+	scoringProfileScopeUser       = "user"
+
+	auditActionUpdateScoringProfile = "update_scoring_profile"
+	auditActionDeleteScoringProfile = "delete_scoring_profile"
+)
+
+// コンディションレベルとグラフのスコアの決め方
+// 悪い状態の重みの合計が閾値以上であれば warning や critical とし，レベル毎の点数の平均をスコアとする
+type ScoringProfile struct {
+	Weights    ScoringWeights    `json:"weights"`
+	Thresholds ScoringThresholds `json:"thresholds"`
+	Scores     ScoringScores     `json:"scores"`
+}
+
+type ScoringWeights struct {
+	IsDirty      int `json:"is_dirty"`
+	IsOverweight int `json:"is_overweight"`
+	IsBroken     int `json:"is_broken"`
+}
+
+type ScoringThresholds struct {
+	Warning  int `json:"warning"`
+	Critical int `json:"critical"`
+}
+
+type ScoringScores struct {
+	Info     int `json:"info"`
+	Warning  int `json:"warning"`
+	Critical int `json:"critical"`
+}
+
+type ScoringProfileResponse struct {
+	Version int64          `json:"version"`
+	Scope   string         `json:"scope"`
+	Profile ScoringProfile `json:"profile"`
+}
+
+// 変更前と同じ，悪い状態の数が 0 なら info，1〜2 なら warning，3 なら critical とするもの
+var defaultScoringProfile = &ScoringProfile{
+	Weights:    ScoringWeights{IsDirty: 1, IsOverweight: 1, IsBroken: 1},
+	Thresholds: ScoringThresholds{Warning: 1, Critical: 3},
+	Scores: ScoringScores{
+		Info:     scoreConditionLevelInfo,
+		Warning:  scoreConditionLevelWarning,
+		Critical: scoreConditionLevelCritical,
+	},
+}
+
+// 返すエラーのメッセージはそのままレスポンスとして使う
+func (p *ScoringProfile) validate() error {
+	for _, w := range []int{p.Weights.IsDirty, p.Weights.IsOverweight, p.Weights.IsBroken} {
+		if w < 0 || w > scoringProfileMaxWeight {
+			return fmt.Errorf("bad format: weights")
+		}
+	}
+	if p.Thresholds.Warning < 1 || p.Thresholds.Critical < p.Thresholds.Warning || p.Thresholds.Critical > scoringProfileMaxThreshold {
+		return fmt.Errorf("bad format: thresholds")
+	}
+	if p.Scores.Critical < 0 || p.Scores.Warning < p.Scores.Critical || p.Scores.Info < p.Scores.Warning ||
+		p.Scores.Info < 1 || p.Scores.Info > scoringProfileMaxScore {
+		return fmt.Errorf("bad format: scores")
+	}
+	return nil
+}
+
+func (p *ScoringProfile) weight(conditionName string) int {
+	switch conditionName {
+	case "is_dirty":
+		return p.Weights.IsDirty
+	case "is_overweight":
+		return p.Weights.IsOverweight
+	case "is_broken":
+		return p.Weights.IsBroken
+	}
+	return 0
+}
+
+// ISUのコンディションの文字列からコンディションレベルを計算
+func (p *ScoringProfile) conditionLevel(condition string) (string, error) {
+	if !isValidConditionFormat(condition) {
+		return "", fmt.Errorf("invalid condition format")
+	}
+
+	total := 0
+	for _, condStr := range strings.Split(condition, ",") {
+		keyValue := strings.Split(condStr, "=")
+		if keyValue[1] == "true" {
+			total += p.weight(keyValue[0])
+		}
+	}
+
+	switch {
+	case total >= p.Thresholds.Critical:
+		return conditionLevelCritical, nil
+	case total >= p.Thresholds.Warning:
+		return conditionLevelWarning, nil
+	default:
+		return conditionLevelInfo, nil
+	}
+}
+
+func (p *ScoringProfile) levelScore(conditionLevel string) int {
+	switch conditionLevel {
+	case conditionLevelCritical:
+		return p.Scores.Critical
+	case conditionLevelWarning:
+		return p.Scores.Warning
+	}
+	return p.Scores.Info
+}
+
+// レベル毎の点数の合計を，全て info だった場合を 100 とするスコアに変換
+func (p *ScoringProfile) score(rawScore int, count int) int {
+	return rawScore * 100 / p.Scores.Info / count
+}
+
+// `scoring_profile` の行
+// 行は追記するだけで，最も新しい行がそのユーザー (空文字列はデプロイメント全体) の設定になる
+// definition が NULL の行は，ユーザーの設定を取り消してデプロイメント全体の設定に戻したことを表す
+type ScoringProfileVersion struct {
+	ID         int64          `db:"id"`
+	JIAUserID  string         `db:"jia_user_id"`
+	Definition sql.NullString `db:"definition"`
+	CreatedAt  time.Time      `db:"created_at"`
+}
+
+type scoringProfileEntry struct {
+	Version   int64
+	JIAUserID string
+	Profile   *ScoringProfile
+}
+
+// 設定のプロセス内キャッシュ
+// 行は変更されないので，他のアプリケーションサーバーが追記したものは ID を見て定期的に取り込む
+type scoringProfileCache struct {
+	mu       sync.RWMutex
+	versions map[int64]*scoringProfileEntry
+	active   map[string]int64
+	syncedID int64
+}
+
+var scoringProfiles = newScoringProfileCache()
+
+func newScoringProfileCache() *scoringProfileCache {
+	return &scoringProfileCache{versions: map[int64]*scoringProfileEntry{}, active: map[string]int64{}}
+}
+
+func (v *ScoringProfileVersion) toEntry() (*scoringProfileEntry, error) {
+	entry := &scoringProfileEntry{Version: v.ID, JIAUserID: v.JIAUserID}
+	if v.Definition.Valid {
+		var profile ScoringProfile
+		err := json.Unmarshal([]byte(v.Definition.String), &profile)
+		if err != nil {
+			return nil, fmt.Errorf("bad scoring profile %v: %v", v.ID, err)
+		}
+		entry.Profile = &profile
+	}
+	return entry, nil
+}
+
+func (sc *scoringProfileCache) addLocked(entry *scoringProfileEntry) {
+	sc.versions[entry.Version] = entry
+	if entry.Version > sc.active[entry.JIAUserID] {
+		sc.active[entry.JIAUserID] = entry.Version
+	}
+}
+
+// 自分で追記した設定をすぐに反映する
+// 他のアプリケーションサーバーが先に追記したものを取りこぼさないよう，同期済みの位置は進めない
+func (sc *scoringProfileCache) Add(entry *scoringProfileEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.addLocked(entry)
+}
+
+func (sc *scoringProfileCache) apply(rows []ScoringProfileVersion) error {
+	entries := make([]*scoringProfileEntry, 0, len(rows))
+	for _, row := range rows {
+		entry, err := row.toEntry()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, entry := range entries {
+		sc.addLocked(entry)
+		if entry.Version > sc.syncedID {
+			sc.syncedID = entry.Version
+		}
+	}
+	return nil
+}
+
+// キャッシュの内容をDBの内容で置き換える
+func (sc *scoringProfileCache) Load(db *sqlx.DB) error {
+	rows := []ScoringProfileVersion{}
+	err := db.Select(&rows, "SELECT * FROM `scoring_profile` ORDER BY `id`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	sc.mu.Lock()
+	sc.versions = map[int64]*scoringProfileEntry{}
+	sc.active = map[string]int64{}
+	sc.syncedID = 0
+	sc.mu.Unlock()
+	return sc.apply(rows)
+}
+
+// ユーザーの削除に合わせて，そのユーザーの設定を消す
+func (sc *scoringProfileCache) Forget(jiaUserID string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for version, entry := range sc.versions {
+		if entry.JIAUserID == jiaUserID {
+			delete(sc.versions, version)
+		}
+	}
+	delete(sc.active, jiaUserID)
+}
+
+// 前回の同期以降に追記された設定を取り込む
+// `id` は採番順にコミットされるとは限らないため，取り込んだ後も件数が合わなければ読み込み直す
+// 初期化やユーザーの削除で行が減った場合も同様に読み込み直す
+func (sc *scoringProfileCache) Sync(db *sqlx.DB) error {
+	sc.mu.RLock()
+	syncedID := sc.syncedID
+	sc.mu.RUnlock()
+
+	var stats struct {
+		Count int   `db:"count"`
+		MaxID int64 `db:"max_id"`
+	}
+	err := db.Get(&stats, "SELECT COUNT(*) AS `count`, COALESCE(MAX(`id`), 0) AS `max_id` FROM `scoring_profile`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if stats.MaxID < syncedID {
+		return sc.Load(db)
+	}
+
+	if stats.MaxID > syncedID {
+		rows := []ScoringProfileVersion{}
+		err = db.Select(&rows, "SELECT * FROM `scoring_profile` WHERE `id` > ? ORDER BY `id`", syncedID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		err = sc.apply(rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	sc.mu.RLock()
+	cachedCount := len(sc.versions)
+	sc.mu.RUnlock()
+	if cachedCount != stats.Count {
+		return sc.Load(db)
+	}
+	return nil
+}
+
+// 他のアプリケーションサーバーによる更新を定期的に取り込む
+func (sc *scoringProfileCache) RunSync(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastReloadedAt := time.Now()
+	for now := range ticker.C {
+		var err error
+		if now.Sub(lastReloadedAt) >= scoringProfileReloadInterval {
+			err = sc.Load(db)
+			lastReloadedAt = now
+		} else {
+			err = sc.Sync(db)
+		}
+		if err != nil {
+			log.Errorf("failed to sync scoring profiles: %v", err)
+		}
+	}
+}
+
+// ユーザーに使う設定
+// ユーザーの設定がなければデプロイメント全体の設定を，それもなければ組み込みの設定を使う
+// jiaUserID が空文字列の場合はデプロイメント全体の設定を返す
+func (sc *scoringProfileCache) Resolve(jiaUserID string) (int64, string, *ScoringProfile) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	if jiaUserID != "" {
+		if entry, ok := sc.versions[sc.active[jiaUserID]]; ok && entry.Profile != nil {
+			return entry.Version, scoringProfileScopeUser, entry.Profile
+		}
+	}
+	if entry, ok := sc.versions[sc.active[""]]; ok && entry.Profile != nil {
+		return entry.Version, scoringProfileScopeDeployment, entry.Profile
+	}
+	return builtinScoringProfileVersion, scoringProfileScopeBuiltin, defaultScoringProfile
+}
+
+// 過去のものを含め，ユーザーが使える版の設定を取得
+// 他のユーザーの設定は存在しないものとして扱う
+func (sc *scoringProfileCache) Get(version int64, jiaUserID string) (string, *ScoringProfile, bool) {
+	if version == builtinScoringProfileVersion {
+		return scoringProfileScopeBuiltin, defaultScoringProfile, true
+	}
+
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	entry, ok := sc.versions[version]
+	if !ok || entry.Profile == nil {
+		return "", nil, false
+	}
+	switch entry.JIAUserID {
+	case "":
+		return scoringProfileScopeDeployment, entry.Profile, true
+	case jiaUserID:
+		return scoringProfileScopeUser, entry.Profile, true
+	}
+	return "", nil, false
+}
+
+// リクエストに使う設定を決め，その版をレスポンスヘッダーで返す
+// scoring_profile_version が指定された場合は，その版で計算し直す
+func scoringProfileForRequest(c echo.Context, jiaUserID string) (*ScoringProfile, int, error) {
+	version, _, profile := scoringProfiles.Resolve(jiaUserID)
+	if versionStr := c.QueryParam(scoringProfileVersionParam); versionStr != "" {
+		var err error
+		version, err = strconv.ParseInt(versionStr, 10, 64)
+		if err != nil || version < 0 {
+			return nil, http.StatusBadRequest, fmt.Errorf("bad format: %v", scoringProfileVersionParam)
+		}
+		var ok bool
+		_, profile, ok = scoringProfiles.Get(version, jiaUserID)
+		if !ok {
+			return nil, http.StatusNotFound, fmt.Errorf("not found: scoring_profile")
+		}
+	}
+	c.Response().Header().Set(scoringProfileVersionHeader, strconv.FormatInt(version, 10))
+	return profile, http.StatusOK, nil
+}
+
+// 設定を1行追記し，キャッシュにも反映する
+// profile が nil の場合はユーザーの設定を取り消す
+func insertScoringProfile(jiaUserID string, profile *ScoringProfile) error {
+	var definition sql.NullString
+	if profile != nil {
+		b, err := json.Marshal(profile)
+		if err != nil {
+			return err
+		}
+		definition = sql.NullString{String: string(b), Valid: true}
+	}
+
+	result, err := db.Exec("INSERT INTO `scoring_profile` (`jia_user_id`, `definition`) VALUES (?, ?)", jiaUserID, definition)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	scoringProfiles.Add(&scoringProfileEntry{Version: id, JIAUserID: jiaUserID, Profile: profile})
+	return nil
+}
+
+func bindScoringProfile(c echo.Context) (*ScoringProfile, error) {
+	var profile ScoringProfile
+	err := c.Bind(&profile)
+	if err != nil {
+		return nil, fmt.Errorf("bad request body")
+	}
+	if err = profile.validate(); err != nil {
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func newScoringProfileResponse(jiaUserID string) ScoringProfileResponse {
+	version, scope, profile := scoringProfiles.Resolve(jiaUserID)
+	return ScoringProfileResponse{Version: version, Scope: scope, Profile: *profile}
+}
+
+// GET /api/user/scoring_profile
+// 自分に使われるコンディションレベルとスコアの設定を取得
+func getMyScoringProfile(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, newScoringProfileResponse(jiaUserID))
+}
+
+// GET /api/user/scoring_profile/:version
+// 過去のものを含め，自分かデプロイメント全体の設定を版を指定して取得
+func getMyScoringProfileVersion(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+	if err != nil || version < 0 {
+		return c.String(http.StatusBadRequest, "bad format: version")
+	}
+	scope, profile, ok := scoringProfiles.Get(version, jiaUserID)
+	if !ok {
+		return c.String(http.StatusNotFound, "not found: scoring_profile")
+	}
+	return c.JSON(http.StatusOK, ScoringProfileResponse{Version: version, Scope: scope, Profile: *profile})
+}
+
+// PUT /api/user/scoring_profile
+// 自分に使うコンディションレベルとスコアの設定を変更
+func putMyScoringProfile(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditTarget(c, jiaUserID, "")
+
+	profile, err := bindScoringProfile(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	err = insertScoringProfile(jiaUserID, profile)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := newScoringProfileResponse(jiaUserID)
+	setAuditDetail(c, fmt.Sprintf("version %d", res.Version))
+	return c.JSON(http.StatusOK, res)
+}
+
+// DELETE /api/user/scoring_profile
+// 自分の設定を取り消し，デプロイメント全体の設定を使う
+func deleteMyScoringProfile(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditTarget(c, jiaUserID, "")
+
+	if _, scope, _ := scoringProfiles.Resolve(jiaUserID); scope == scoringProfileScopeUser {
+		err = insertScoringProfile(jiaUserID, nil)
+		if err != nil {
+			c.Logger().Error(err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	// 取り消した後に使われる設定の版を記録する
+	res := newScoringProfileResponse(jiaUserID)
+	setAuditDetail(c, fmt.Sprintf("version %d", res.Version))
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/admin/config/scoring_profile
+// デプロイメント全体のコンディションレベルとスコアの設定を取得
+func getAdminScoringProfile(c echo.Context) error {
+	return c.JSON(http.StatusOK, newScoringProfileResponse(""))
+}
+
+// PUT /api/admin/config/scoring_profile
+// デプロイメント全体のコンディションレベルとスコアの設定を変更
+// 自分の設定を持つユーザーには影響しない
+func putAdminScoringProfile(c echo.Context) error {
+	setAuditTarget(c, adminActor, "")
+
+	profile, err := bindScoringProfile(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	err = insertScoringProfile("", profile)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := newScoringProfileResponse("")
+	setAuditDetail(c, fmt.Sprintf("version %d", res.Version))
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultTLSReloadInterval = time.Second * 10
+)
+
+// 証明書と秘密鍵のファイル
+// ファイルが更新されたら読み込み直し，新しい接続から使う
+type certReloader struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{CertFile: certFile, KeyFile: keyFile}
+	_, err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 証明書と秘密鍵のどちらかの更新時刻
+func (r *certReloader) latestModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// ファイルが更新されていれば読み込み直し，読み込み直したかを返す
+// 読み込めなかった場合はそれまでの証明書を使い続ける
+func (r *certReloader) Reload() (bool, error) {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	unchanged := r.cert != nil && modTime.Equal(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) RunReload(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reloaded, err := r.Reload()
+		if err != nil {
+			log.Errorf("failed to reload tls certificate: %v", err)
+			continue
+		}
+		if reloaded {
+			log.Infof("reloaded tls certificate: %v", r.CertFile)
+		}
+	}
+}
+
+// SERVER_APP_PORT で待ち受ける
+// SERVER_TLS_CERT と SERVER_TLS_KEY が指定されている場合は HTTPS と HTTP/2 で，
+// SERVER_H2C が true の場合は平文の HTTP/2 (h2c) でも待ち受ける
+func startServer(e *echo.Echo) error {
+	address := fmt.Sprintf(":%v", getEnv("SERVER_APP_PORT", "3000"))
+
+	certFile, keyFile := os.Getenv("SERVER_TLS_CERT"), os.Getenv("SERVER_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return fmt.Errorf("SERVER_TLS_CERT and SERVER_TLS_KEY must be set together")
+	}
+
+	h2c := false
+	if h2cStr := os.Getenv("SERVER_H2C"); h2cStr != "" {
+		var err error
+		h2c, err = strconv.ParseBool(h2cStr)
+		if err != nil {
+			return fmt.Errorf("bad format: SERVER_H2C: %v", h2cStr)
+		}
+	}
+
+	if certFile == "" {
+		if h2c {
+			return e.StartH2CServer(address, &http2.Server{})
+		}
+		return e.Start(address)
+	}
+	if h2c {
+		return fmt.Errorf("SERVER_H2C cannot be used with SERVER_TLS_CERT")
+	}
+
+	reloadInterval, err := getEnvDuration("SERVER_TLS_RELOAD_INTERVAL", defaultTLSReloadInterval)
+	if err != nil {
+		return err
+	}
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %v", err)
+	}
+	go reloader.RunReload(reloadInterval)
+
+	s := &http.Server{
+		Addr: address,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		},
+	}
+	err = http2.ConfigureServer(s, &http2.Server{})
+	if err != nil {
+		return err
+	}
+	return e.StartServer(s)
+}
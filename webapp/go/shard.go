@@ -0,0 +1,691 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	primaryShardID             = "primary"
+	shardVirtualNodes          = 128
+	shardPlacementSyncInterval = time.Second
+	shardMaxOpenConns          = 10
+	shardMoveBatchSize         = 1000
+	shardMoveIsuBatchSize      = 100
+	// `updated_at` より後にコミットされる変更があるため，前回の同期より少し前から読み直す
+	shardPlacementSyncOverlap = time.Second * 10
+	// それでも取りこぼした変更は，定期的に全て読み直して取り込む
+	shardPlacementReloadInterval = time.Minute
+)
+
+// ISU毎に振り分けるテーブル
+// `id` 以外のカラムを移動先にそのまま書き込むので，`id` は移動先で振り直される
+var shardedTables = []shardedTable{
+	{Name: "isu_condition", Columns: []string{"jia_isu_uuid", "timestamp", "is_sitting", "condition", "message", "created_at"}},
+	{Name: "isu_condition_quarantine", Columns: []string{"jia_isu_uuid", "timestamp", "is_sitting", "condition", "message", "reason", "created_at"}},
+}
+
+type shardedTable struct {
+	Name    string
+	Columns []string
+}
+
+// コンディションを保存するDB
+// ユーザーやISUの情報はプライマリ (db) にのみ置き，コンディションは `jia_isu_uuid` 毎にいずれかのシャードに置く
+// ISU毎の最新のコンディション (`isu_latest_condition`) は書き込み時にプライマリにも保存するので，
+// それだけを使う getIsuList や getTrend はシャードを見なくてよい
+type conditionShard struct {
+	ID string
+	DB *sqlx.DB
+}
+
+// プライマリと同じDBか
+// 同じ場合はプライマリのテーブルと1つのトランザクションで更新できる
+func (s *conditionShard) isPrimary() bool {
+	return s.DB == db
+}
+
+// シャードに書き込むトランザクションを開始する
+// シャードがプライマリと同じ場合は primaryTx をそのまま返し，owned は false になる
+// owned が true の場合は，primaryTx より先にコミットすること
+func (s *conditionShard) beginTx(primaryTx *sqlx.Tx) (tx *sqlx.Tx, owned bool, err error) {
+	if s.isPrimary() {
+		return primaryTx, false, nil
+	}
+	tx, err = s.DB.Beginx()
+	if err != nil {
+		return nil, false, fmt.Errorf("db error: %v", err)
+	}
+	return tx, true, nil
+}
+
+type shardRingPoint struct {
+	hash  uint32
+	shard int
+}
+
+// シャードの追加や削除で移動するISUが一部で済むよう，コンシステントハッシュで配置先を決める
+type shardRing struct {
+	points []shardRingPoint
+}
+
+func shardHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newShardRing(shards []*conditionShard) *shardRing {
+	r := &shardRing{points: make([]shardRingPoint, 0, len(shards)*shardVirtualNodes)}
+	for i, shard := range shards {
+		for v := 0; v < shardVirtualNodes; v++ {
+			r.points = append(r.points, shardRingPoint{hash: shardHash(shard.ID + "#" + strconv.Itoa(v)), shard: i})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func (r *shardRing) locate(jiaIsuUUID string) int {
+	h := shardHash(jiaIsuUUID)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ISUの配置先を決める
+// 配置は `isu_shard` テーブルを正とし，プロセス内にも同じ内容を保持する
+// 登録時にリングで決めた配置を記録するので，シャードを追加してもISUは rebalance で移動するまで元のシャードに残る
+// 読み込みはプロセス内の配置を使うが，書き込みは Lock でDB上の配置を読んでから行う
+type conditionShardRouter struct {
+	shards []*conditionShard
+	byID   map[string]*conditionShard
+	ring   *shardRing
+
+	mu         sync.RWMutex
+	placements map[string]string
+	syncedAt   time.Time
+}
+
+type IsuShardPlacement struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	ShardID    string    `db:"shard_id"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+var conditionShards = newConditionShardRouter(nil)
+
+func newConditionShardRouter(shards []*conditionShard) *conditionShardRouter {
+	router := &conditionShardRouter{
+		shards:     shards,
+		byID:       map[string]*conditionShard{},
+		placements: map[string]string{},
+	}
+	for _, shard := range shards {
+		router.byID[shard.ID] = shard
+	}
+	router.ring = newShardRing(shards)
+
+	// MYSQL_SHARDS を設定する前に登録したISUは `primary` に配置されている
+	// プライマリのシャードが別のIDで設定されていればそれを使い，設定されていなければリングには含めずに加える
+	if len(shards) > 0 {
+		if _, ok := router.byID[primaryShardID]; !ok {
+			var primary *conditionShard
+			for _, shard := range shards {
+				if shard.isPrimary() {
+					primary = shard
+					break
+				}
+			}
+			if primary == nil {
+				primary = &conditionShard{ID: primaryShardID, DB: db}
+				router.shards = append(router.shards, primary)
+			}
+			router.byID[primaryShardID] = primary
+		}
+	}
+	return router
+}
+
+// MYSQL_SHARDS を読み込みシャードに接続する
+// `shard_id=host:port` をカンマ区切りで並べる．ユーザー名やパスワード，DB名はプライマリと同じものを使う
+// プライマリと同じホストを指定したシャードはプライマリの接続を共有する．未指定の場合はプライマリのみを使う
+// `primary` はプライマリに残っているコンディションの配置を表すので，他のホストには使えない
+func connectConditionShards(primary *MySQLConnectionEnv, s string) ([]*conditionShard, error) {
+	if strings.TrimSpace(s) == "" {
+		return []*conditionShard{{ID: primaryShardID, DB: db}}, nil
+	}
+
+	shards := []*conditionShard{}
+	seen := map[string]struct{}{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("bad format: MYSQL_SHARDS: %v", entry)
+		}
+		if _, ok := seen[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate shard id: %v", kv[0])
+		}
+		seen[kv[0]] = struct{}{}
+		host, port, ok := parseMySQLHostPort(kv[1])
+		if !ok {
+			return nil, fmt.Errorf("bad format: MYSQL_SHARDS: %v", entry)
+		}
+
+		if host == primary.Host && port == primary.Port {
+			shards = append(shards, &conditionShard{ID: kv[0], DB: db})
+			continue
+		}
+		if kv[0] == primaryShardID {
+			return nil, fmt.Errorf("shard %v must be the primary: %v", primaryShardID, entry)
+		}
+		env := *primary
+		env.Host, env.Port = host, port
+		shardDB, err := env.ConnectDB()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect shard %v: %v", kv[0], err)
+		}
+		shardDB.SetMaxOpenConns(shardMaxOpenConns)
+		shards = append(shards, &conditionShard{ID: kv[0], DB: shardDB})
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("bad format: MYSQL_SHARDS: %v", s)
+	}
+	return shards, nil
+}
+
+// `host:port` を分ける．ポートを省略した場合は 3306 とする
+func parseMySQLHostPort(s string) (string, string, bool) {
+	host, port := s, "3306"
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		host, port = s[:i], s[i+1:]
+	}
+	return host, port, host != "" && port != ""
+}
+
+// 全てのシャード
+func (r *conditionShardRouter) All() []*conditionShard {
+	return r.shards
+}
+
+// プライマリ以外のDBにあるシャード
+func (r *conditionShardRouter) Remote() []*conditionShard {
+	res := []*conditionShard{}
+	for _, shard := range r.shards {
+		if !shard.isPrimary() {
+			res = append(res, shard)
+		}
+	}
+	return res
+}
+
+// リングで決まるISUの配置先
+func (r *conditionShardRouter) home(jiaIsuUUID string) *conditionShard {
+	return r.shards[r.ring.locate(jiaIsuUUID)]
+}
+
+// ISUのコンディションが置かれているシャード
+func (r *conditionShardRouter) Shard(jiaIsuUUID string) *conditionShard {
+	r.mu.RLock()
+	shardID, ok := r.placements[jiaIsuUUID]
+	r.mu.RUnlock()
+	if ok {
+		if shard, ok := r.byID[shardID]; ok {
+			return shard
+		}
+		log.Errorf("unknown shard %v for isu %v", shardID, jiaIsuUUID)
+	}
+	return r.home(jiaIsuUUID)
+}
+
+// 複数のISUをシャード毎にまとめる
+// シャードの並びは設定の順で，各シャードのISUは渡された順になる
+func (r *conditionShardRouter) Group(jiaIsuUUIDs []string) ([]*conditionShard, [][]string) {
+	indexes := map[*conditionShard]int{}
+	grouped := make([][]string, len(r.shards))
+	for i, shard := range r.shards {
+		indexes[shard] = i
+	}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		i := indexes[r.Shard(jiaIsuUUID)]
+		grouped[i] = append(grouped[i], jiaIsuUUID)
+	}
+
+	shards := []*conditionShard{}
+	res := [][]string{}
+	for i, shard := range r.shards {
+		if len(grouped[i]) > 0 {
+			shards = append(shards, shard)
+			res = append(res, grouped[i])
+		}
+	}
+	return shards, res
+}
+
+// 新しく登録するISUの配置先を決めて記録する
+// コミットが成功したら返したシャードを Set で反映すること
+func (r *conditionShardRouter) Assign(tx *sqlx.Tx, jiaIsuUUID string) (*conditionShard, error) {
+	shard := r.home(jiaIsuUUID)
+	_, err := tx.Exec(
+		"INSERT INTO `isu_shard` (`jia_isu_uuid`, `shard_id`) VALUES (?, ?)"+
+			"	ON DUPLICATE KEY UPDATE `shard_id` = VALUES(`shard_id`)",
+		jiaIsuUUID, shard.ID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return shard, nil
+}
+
+// コンディションを書き込むISUの配置を，プライマリのトランザクションで共有ロックを取って読む
+// rebalance は配置を書き換えるときにこのロックを待つので，tx をコミットするまでは配置が変わらない
+// シャードのトランザクションは tx より先にコミットするので，配置を書き換えた後に古いシャードに書き込まれることはない
+// 配置が記録されていないISUはリングで決まる配置先とする
+func (r *conditionShardRouter) Lock(tx *sqlx.Tx, jiaIsuUUIDs []string) (map[string]*conditionShard, error) {
+	res := make(map[string]*conditionShard, len(jiaIsuUUIDs))
+	if len(jiaIsuUUIDs) == 0 {
+		return res, nil
+	}
+
+	// 他のリクエストとロックの順序が揃うよう，ISUの順に読む
+	query, args, err := sqlx.In(
+		"SELECT * FROM `isu_shard` WHERE `jia_isu_uuid` IN (?) ORDER BY `jia_isu_uuid` LOCK IN SHARE MODE",
+		jiaIsuUUIDs)
+	if err != nil {
+		return nil, err
+	}
+	placements := []IsuShardPlacement{}
+	err = tx.Select(&placements, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, placement := range placements {
+		shard, ok := r.byID[placement.ShardID]
+		if !ok {
+			return nil, fmt.Errorf("unknown shard %v for isu %v", placement.ShardID, placement.JIAIsuUUID)
+		}
+		res[placement.JIAIsuUUID] = shard
+		r.placements[placement.JIAIsuUUID] = placement.ShardID
+	}
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		if _, ok := res[jiaIsuUUID]; !ok {
+			res[jiaIsuUUID] = r.home(jiaIsuUUID)
+		}
+	}
+	return res, nil
+}
+
+func (r *conditionShardRouter) Set(jiaIsuUUID string, shard *conditionShard) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.placements[jiaIsuUUID] = shard.ID
+}
+
+// キャッシュの内容をDBの内容で置き換える
+func (r *conditionShardRouter) Load(db *sqlx.DB) error {
+	placements := []IsuShardPlacement{}
+	err := db.Select(&placements, "SELECT * FROM `isu_shard`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.placements = make(map[string]string, len(placements))
+	r.syncedAt = time.Time{}
+	r.setLocked(placements)
+	return nil
+}
+
+// 前回の同期以降に変更された配置を取り込む
+// 遅れてコミットされた変更を拾うため，前回の同期より少し前から読む
+func (r *conditionShardRouter) Sync(db *sqlx.DB) error {
+	r.mu.RLock()
+	syncedAt := r.syncedAt
+	r.mu.RUnlock()
+
+	placements := []IsuShardPlacement{}
+	err := db.Select(&placements, "SELECT * FROM `isu_shard` WHERE `updated_at` >= ?", syncedAt.Add(-shardPlacementSyncOverlap))
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLocked(placements)
+	return nil
+}
+
+func (r *conditionShardRouter) setLocked(placements []IsuShardPlacement) {
+	for _, placement := range placements {
+		r.placements[placement.JIAIsuUUID] = placement.ShardID
+		if placement.UpdatedAt.After(r.syncedAt) {
+			r.syncedAt = placement.UpdatedAt
+		}
+	}
+}
+
+// 他のアプリケーションサーバーや rebalance による配置の変更を定期的に取り込む
+// 同期の重なりより長く遅れた変更も反映されるよう，定期的に全て読み直す
+func (r *conditionShardRouter) RunSync(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastReloadedAt := time.Now()
+	for now := range ticker.C {
+		var err error
+		if now.Sub(lastReloadedAt) >= shardPlacementReloadInterval {
+			err = r.Load(db)
+			lastReloadedAt = now
+		} else {
+			err = r.Sync(db)
+		}
+		if err != nil {
+			log.Errorf("failed to sync isu shard placements: %v", err)
+		}
+	}
+}
+
+// プライマリの全てのISUの配置を記録し直す
+// 初期データの投入後に呼ぶ
+func (r *conditionShardRouter) assignAll(db *sqlx.DB) (map[*conditionShard][]string, error) {
+	jiaIsuUUIDs := []string{}
+	err := db.Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu`")
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := map[*conditionShard][]string{}
+	for start := 0; start < len(jiaIsuUUIDs); start += shardMoveBatchSize {
+		end := start + shardMoveBatchSize
+		if end > len(jiaIsuUUIDs) {
+			end = len(jiaIsuUUIDs)
+		}
+
+		query := "INSERT INTO `isu_shard` (`jia_isu_uuid`, `shard_id`) VALUES "
+		args := []interface{}{}
+		for i, jiaIsuUUID := range jiaIsuUUIDs[start:end] {
+			if i > 0 {
+				query += ","
+			}
+			query += "(?, ?)"
+			shard := r.home(jiaIsuUUID)
+			args = append(args, jiaIsuUUID, shard.ID)
+			res[shard] = append(res[shard], jiaIsuUUID)
+		}
+		query += " ON DUPLICATE KEY UPDATE `shard_id` = VALUES(`shard_id`)"
+		_, err = db.Exec(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+	}
+	return res, r.Load(db)
+}
+
+// ISUの行を src から dst に複製する
+// afterID より大きい `id` の行のみを対象とし，複製した中で最大の `id` を返す
+func copyShardedRows(src *sqlx.DB, dst *sqlx.DB, table shardedTable, jiaIsuUUIDs []string, afterID int64) (int64, error) {
+	columns := "`" + strings.Join(table.Columns, "`, `") + "`"
+	placeholders := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(table.Columns)), ", ") + ")"
+	for {
+		query, args, err := sqlx.In(
+			"SELECT `id`, "+columns+" FROM `"+table.Name+"` WHERE `jia_isu_uuid` IN (?) AND `id` > ? ORDER BY `id` LIMIT ?",
+			jiaIsuUUIDs, afterID, shardMoveBatchSize)
+		if err != nil {
+			return 0, err
+		}
+		rows, err := src.Queryx(query, args...)
+		if err != nil {
+			return 0, fmt.Errorf("db error: %v", err)
+		}
+
+		insert := "INSERT INTO `" + table.Name + "` (" + columns + ") VALUES "
+		insertArgs := []interface{}{}
+		count := 0
+		for rows.Next() {
+			values, err := rows.SliceScan()
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("db error: %v", err)
+			}
+			id, err := shardedRowID(values[0])
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("unexpected id in %v: %v", table.Name, err)
+			}
+			afterID = id
+			if count > 0 {
+				insert += ","
+			}
+			insert += placeholders
+			insertArgs = append(insertArgs, values[1:]...)
+			count++
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("db error: %v", err)
+		}
+		rows.Close()
+
+		if count == 0 {
+			return afterID, nil
+		}
+		_, err = dst.Exec(insert, insertArgs...)
+		if err != nil {
+			return 0, fmt.Errorf("db error: %v", err)
+		}
+		if count < shardMoveBatchSize {
+			return afterID, nil
+		}
+	}
+}
+
+// プロトコルによって `id` は数値かバイト列で返ってくる
+func shardedRowID(v interface{}) (int64, error) {
+	switch id := v.(type) {
+	case int64:
+		return id, nil
+	case []byte:
+		return strconv.ParseInt(string(id), 10, 64)
+	}
+	return 0, fmt.Errorf("unexpected type %T", v)
+}
+
+func deleteShardedRows(db *sqlx.DB, table shardedTable, jiaIsuUUIDs []string) error {
+	query, args, err := sqlx.In("DELETE FROM `"+table.Name+"` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// ISUの行を src から dst に移動する
+// 書き込みは Lock で配置を読むので，配置の書き換えは src への書き込みが全てコミットされるまで待つ
+// 書き換えた後に src に書き込まれた残りの行を複製すれば dst に全て揃う
+// 古い配置で src を読むアプリケーションサーバーが新しい配置を取り込むまで settle だけ待ってから，src から消す
+// 配置を書き換える前に失敗した移動をやり直しても行が重複しないよう，複製の前に dst の行を消す
+// 配置が src の間は dst の行は読まれないので，消してもよい
+func moveIsusBetweenShards(primary *sqlx.DB, src *conditionShard, dst *conditionShard, jiaIsuUUIDs []string, settle time.Duration) error {
+	if src.DB == dst.DB {
+		return updateIsuShardPlacements(primary, dst, jiaIsuUUIDs)
+	}
+
+	for _, table := range shardedTables {
+		err := deleteShardedRows(dst.DB, table, jiaIsuUUIDs)
+		if err != nil {
+			return err
+		}
+	}
+
+	lastIDs := make([]int64, len(shardedTables))
+	for i, table := range shardedTables {
+		lastID, err := copyShardedRows(src.DB, dst.DB, table, jiaIsuUUIDs, 0)
+		if err != nil {
+			return err
+		}
+		lastIDs[i] = lastID
+	}
+
+	err := updateIsuShardPlacements(primary, dst, jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+
+	for i, table := range shardedTables {
+		_, err := copyShardedRows(src.DB, dst.DB, table, jiaIsuUUIDs, lastIDs[i])
+		if err != nil {
+			return err
+		}
+	}
+	time.Sleep(settle)
+
+	for _, table := range shardedTables {
+		err = deleteShardedRows(src.DB, table, jiaIsuUUIDs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateIsuShardPlacements(primary *sqlx.DB, dst *conditionShard, jiaIsuUUIDs []string) error {
+	query, args, err := sqlx.In("UPDATE `isu_shard` SET `shard_id` = ? WHERE `jia_isu_uuid` IN (?)", dst.ID, jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+	_, err = primary.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 初期データとしてプライマリに投入されたコンディションを配置先のシャードに移す
+// 初期化中は他からの書き込みがないので待たない
+func distributeInitialConditions(db *sqlx.DB) error {
+	assigned, err := conditionShards.assignAll(db)
+	if err != nil {
+		return err
+	}
+
+	primary := &conditionShard{ID: primaryShardID, DB: db}
+	for _, shard := range conditionShards.Remote() {
+		jiaIsuUUIDs := assigned[shard]
+		for start := 0; start < len(jiaIsuUUIDs); start += shardMoveIsuBatchSize {
+			end := start + shardMoveIsuBatchSize
+			if end > len(jiaIsuUUIDs) {
+				end = len(jiaIsuUUIDs)
+			}
+			err = moveIsusBetweenShards(db, primary, shard, jiaIsuUUIDs[start:end], 0)
+			if err != nil {
+				return fmt.Errorf("failed to move conditions to shard %v: %v", shard.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// プライマリ以外のシャードの振り分けたテーブルを空にする
+func truncateRemoteShards() error {
+	for _, shard := range conditionShards.Remote() {
+		for _, table := range shardedTables {
+			_, err := shard.DB.Exec("TRUNCATE TABLE `" + table.Name + "`")
+			if err != nil {
+				return fmt.Errorf("failed to truncate %v on shard %v: %v", table.Name, shard.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// `rebalance` サブコマンド
+// 記録されている配置が現在のリングでの配置先と異なるISUを移動する
+// MYSQL_SHARDS を設定する前からプライマリにある (`primary` に配置された) ISUも対象になる
+//
+//	rebalance [-dry-run]
+func runRebalanceCommand(primary *sqlx.DB, args []string) error {
+	dryRun := false
+	for _, arg := range args {
+		switch arg {
+		case "-dry-run", "--dry-run":
+			dryRun = true
+		default:
+			return fmt.Errorf("usage: rebalance [-dry-run]")
+		}
+	}
+
+	placements := []IsuShardPlacement{}
+	err := primary.Select(&placements, "SELECT * FROM `isu_shard` ORDER BY `jia_isu_uuid`")
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	type shardMove struct {
+		src *conditionShard
+		dst *conditionShard
+	}
+	moves := map[shardMove][]string{}
+	order := []shardMove{}
+	for _, placement := range placements {
+		src, ok := conditionShards.byID[placement.ShardID]
+		if !ok {
+			return fmt.Errorf("isu %v is placed on unknown shard %v", placement.JIAIsuUUID, placement.ShardID)
+		}
+		dst := conditionShards.home(placement.JIAIsuUUID)
+		if src == dst {
+			continue
+		}
+		move := shardMove{src: src, dst: dst}
+		if _, ok := moves[move]; !ok {
+			order = append(order, move)
+		}
+		moves[move] = append(moves[move], placement.JIAIsuUUID)
+	}
+
+	for _, move := range order {
+		jiaIsuUUIDs := moves[move]
+		fmt.Printf("%v -> %v: %d isu\n", move.src.ID, move.dst.ID, len(jiaIsuUUIDs))
+		if dryRun {
+			continue
+		}
+		for start := 0; start < len(jiaIsuUUIDs); start += shardMoveIsuBatchSize {
+			end := start + shardMoveIsuBatchSize
+			if end > len(jiaIsuUUIDs) {
+				end = len(jiaIsuUUIDs)
+			}
+			// アプリケーションサーバーが配置の変更を取り込むまで待つ
+			err = moveIsusBetweenShards(primary, move.src, move.dst, jiaIsuUUIDs[start:end], shardPlacementSyncInterval*3)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%v -> %v: moved %d/%d isu\n", move.src.ID, move.dst.ID, end, len(jiaIsuUUIDs))
+		}
+	}
+	if len(order) == 0 {
+		fmt.Println("all isu are placed on their home shards")
+	}
+	return nil
+}
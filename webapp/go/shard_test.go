@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func testShards(ids ...string) []*conditionShard {
+	shards := make([]*conditionShard, 0, len(ids))
+	for _, id := range ids {
+		shards = append(shards, &conditionShard{ID: id})
+	}
+	return shards
+}
+
+func TestShardRingLocate(t *testing.T) {
+	t.Run("single shard", func(t *testing.T) {
+		r := newShardRing(testShards("a"))
+		for i := 0; i < 100; i++ {
+			if got := r.locate(fmt.Sprintf("isu-%d", i)); got != 0 {
+				t.Fatalf("locate(isu-%d) = %d, want 0", i, got)
+			}
+		}
+	})
+
+	t.Run("wrap around", func(t *testing.T) {
+		r := &shardRing{points: []shardRingPoint{{hash: 1 << 30, shard: 0}, {hash: 1 << 31, shard: 1}}}
+		found := map[string]bool{}
+		for i := 0; len(found) < 3 && i < 10000; i++ {
+			key := fmt.Sprintf("isu-%d", i)
+			h := shardHash(key)
+			var name string
+			var want int
+			switch {
+			case h <= 1<<30:
+				name, want = "before first", 0
+			case h <= 1<<31:
+				name, want = "between", 1
+			default:
+				name, want = "after last", 0
+			}
+			if got := r.locate(key); got != want {
+				t.Fatalf("%v: locate(%v) = %d, want %d", name, key, got, want)
+			}
+			found[name] = true
+		}
+		if len(found) != 3 {
+			t.Fatalf("not all ranges were checked: %v", found)
+		}
+	})
+
+	t.Run("adding a shard moves isu only to the new shard", func(t *testing.T) {
+		before := newShardRing(testShards("a", "b", "c"))
+		after := newShardRing(testShards("a", "b", "c", "d"))
+		const isuCount = 10000
+		counts := make([]int, 3)
+		moved := 0
+		for i := 0; i < isuCount; i++ {
+			key := fmt.Sprintf("isu-%d", i)
+			from, to := before.locate(key), after.locate(key)
+			counts[from]++
+			if from != to {
+				if to != 3 {
+					t.Fatalf("%v moved from shard %d to existing shard %d", key, from, to)
+				}
+				moved++
+			}
+		}
+		for i, count := range counts {
+			if count < isuCount/3/2 || count > isuCount/3*2 {
+				t.Errorf("shard %d has %d isu, which is too unbalanced", i, count)
+			}
+		}
+		if moved < isuCount/4/2 || moved > isuCount/4*2 {
+			t.Errorf("%d isu moved, want about %d", moved, isuCount/4)
+		}
+	})
+}
+
+func TestConditionShardRouterPrimaryPlacement(t *testing.T) {
+	primaryDB, remoteDB := &sqlx.DB{}, &sqlx.DB{}
+	defer func(prev *sqlx.DB) { db = prev }(db)
+	db = primaryDB
+
+	t.Run("primary shard with another id", func(t *testing.T) {
+		r := newConditionShardRouter([]*conditionShard{{ID: "a", DB: primaryDB}, {ID: "b", DB: remoteDB}})
+		r.placements["isu"] = primaryShardID
+		if got := r.Shard("isu"); got.ID != "a" {
+			t.Errorf("Shard(isu) = %v, want a", got.ID)
+		}
+		if len(r.All()) != 2 {
+			t.Errorf("len(All()) = %d, want 2", len(r.All()))
+		}
+	})
+
+	t.Run("without primary shard", func(t *testing.T) {
+		r := newConditionShardRouter([]*conditionShard{{ID: "a", DB: remoteDB}})
+		r.placements["isu"] = primaryShardID
+		if got := r.Shard("isu"); got.DB != primaryDB {
+			t.Errorf("Shard(isu) = %v, want primary", got.ID)
+		}
+		if got := r.home("isu"); got.ID != "a" {
+			t.Errorf("home(isu) = %v, want a", got.ID)
+		}
+		if len(r.All()) != 2 || len(r.Remote()) != 1 {
+			t.Errorf("len(All()) = %d, len(Remote()) = %d, want 2 and 1", len(r.All()), len(r.Remote()))
+		}
+	})
+}
+
+// copyShardedRows と moveIsusBetweenShards が使う SELECT, INSERT, DELETE と，配置の UPDATE だけを解釈する，テスト用のメモリ上のテーブル
+type fakeShardTable struct {
+	mu      sync.Mutex
+	columns []string
+	rows    [][]driver.Value // 先頭は `id`
+	nextID  int64
+	inserts []int // INSERT 毎の行数
+}
+
+func (t *fakeShardTable) add(values ...driver.Value) {
+	t.nextID++
+	t.rows = append(t.rows, append([]driver.Value{t.nextID}, values...))
+}
+
+var (
+	fakeShardTablesMu sync.Mutex
+	fakeShardTables   = map[string]*fakeShardTable{}
+)
+
+func init() {
+	sql.Register("fakeshard", fakeShardDriver{})
+}
+
+type fakeShardDriver struct{}
+
+func (fakeShardDriver) Open(name string) (driver.Conn, error) {
+	fakeShardTablesMu.Lock()
+	defer fakeShardTablesMu.Unlock()
+	table, ok := fakeShardTables[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown table %v", name)
+	}
+	return &fakeShardConn{table: table}, nil
+}
+
+type fakeShardConn struct {
+	table *fakeShardTable
+}
+
+func (c *fakeShardConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeShardStmt{table: c.table, query: query}, nil
+}
+
+func (c *fakeShardConn) Close() error {
+	return nil
+}
+
+func (c *fakeShardConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+type fakeShardStmt struct {
+	table *fakeShardTable
+	query string
+}
+
+func (s *fakeShardStmt) Close() error {
+	return nil
+}
+
+func (s *fakeShardStmt) NumInput() int {
+	return -1
+}
+
+// INSERT INTO ... VALUES (?, ...),(?, ...)
+// DELETE FROM ... WHERE `jia_isu_uuid` IN (?, ...)
+// UPDATE `isu_shard` ... は配置を見ないので何もしない
+func (s *fakeShardStmt) Exec(args []driver.Value) (driver.Result, error) {
+	t := s.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "UPDATE "):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "DELETE "):
+		jiaIsuUUIDs := map[interface{}]bool{}
+		for _, arg := range args {
+			jiaIsuUUIDs[arg] = true
+		}
+		rows := [][]driver.Value{}
+		for _, row := range t.rows {
+			if !jiaIsuUUIDs[row[1]] {
+				rows = append(rows, row)
+			}
+		}
+		deleted := len(t.rows) - len(rows)
+		t.rows = rows
+		return driver.RowsAffected(deleted), nil
+	case !strings.HasPrefix(s.query, "INSERT "):
+		return nil, fmt.Errorf("unexpected query: %v", s.query)
+	}
+	if len(args)%len(t.columns) != 0 {
+		return nil, fmt.Errorf("unexpected number of args: %d", len(args))
+	}
+	for i := 0; i < len(args); i += len(t.columns) {
+		t.add(args[i : i+len(t.columns)]...)
+	}
+	t.inserts = append(t.inserts, len(args)/len(t.columns))
+	return driver.RowsAffected(len(args) / len(t.columns)), nil
+}
+
+// SELECT `id`, ... WHERE `jia_isu_uuid` IN (?, ...) AND `id` > ? ORDER BY `id` LIMIT ?
+func (s *fakeShardStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT ") {
+		return nil, fmt.Errorf("unexpected query: %v", s.query)
+	}
+	afterID := args[len(args)-2].(int64)
+	limit := int(args[len(args)-1].(int64))
+	jiaIsuUUIDs := map[interface{}]bool{}
+	for _, arg := range args[:len(args)-2] {
+		jiaIsuUUIDs[arg] = true
+	}
+
+	t := s.table
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := [][]driver.Value{}
+	for _, row := range t.rows {
+		if row[0].(int64) > afterID && jiaIsuUUIDs[row[1]] {
+			res = append(res, row)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i][0].(int64) < res[j][0].(int64)
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return &fakeShardRows{columns: append([]string{"id"}, t.columns...), rows: res}, nil
+}
+
+type fakeShardRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeShardRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeShardRows) Close() error {
+	return nil
+}
+
+func (r *fakeShardRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func openFakeShard(t *testing.T, name string, table *fakeShardTable) *sqlx.DB {
+	fakeShardTablesMu.Lock()
+	fakeShardTables[name] = table
+	fakeShardTablesMu.Unlock()
+	db, err := sqlx.Open("fakeshard", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeShardTablesMu.Lock()
+		delete(fakeShardTables, name)
+		fakeShardTablesMu.Unlock()
+	})
+	return db
+}
+
+func TestCopyShardedRows(t *testing.T) {
+	table := shardedTable{Name: "isu_condition", Columns: []string{"jia_isu_uuid", "message"}}
+
+	tests := []struct {
+		name        string
+		rows        int
+		afterRow    int // この行より後を複製する．0 は全て
+		wantInserts []int
+	}{
+		{name: "empty", rows: 0, wantInserts: nil},
+		{name: "less than a batch", rows: 10, wantInserts: []int{10}},
+		{name: "exactly a batch", rows: shardMoveBatchSize, wantInserts: []int{shardMoveBatchSize}},
+		{name: "multiple batches", rows: shardMoveBatchSize*2 + 500, wantInserts: []int{shardMoveBatchSize, shardMoveBatchSize, 500}},
+		{name: "exact multiple of a batch", rows: shardMoveBatchSize * 2, wantInserts: []int{shardMoveBatchSize, shardMoveBatchSize}},
+		{name: "after id", rows: shardMoveBatchSize + 200, afterRow: 300, wantInserts: []int{900}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeShardTable{columns: table.Columns}
+			// 複製しないISUの行を挟む
+			ids := []int64{}
+			for n := 0; n < tt.rows; n++ {
+				src.add("moving", strconv.Itoa(n))
+				ids = append(ids, src.nextID)
+				if n%7 == 0 {
+					src.add("staying", strconv.Itoa(n))
+				}
+			}
+			dst := &fakeShardTable{columns: table.Columns}
+			srcDB := openFakeShard(t, fmt.Sprintf("src-%d", i), src)
+			dstDB := openFakeShard(t, fmt.Sprintf("dst-%d", i), dst)
+
+			var afterID int64
+			if tt.afterRow > 0 {
+				afterID = ids[tt.afterRow-1]
+			}
+			lastID, err := copyShardedRows(srcDB, dstDB, table, []string{"moving"}, afterID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantLastID := afterID
+			if len(ids) > 0 {
+				wantLastID = ids[len(ids)-1]
+			}
+			if lastID != wantLastID {
+				t.Errorf("last id = %d, want %d", lastID, wantLastID)
+			}
+			if fmt.Sprint(dst.inserts) != fmt.Sprint(tt.wantInserts) {
+				t.Errorf("inserts = %v, want %v", dst.inserts, tt.wantInserts)
+			}
+			if len(dst.rows) != tt.rows-tt.afterRow {
+				t.Fatalf("copied %d rows, want %d", len(dst.rows), tt.rows-tt.afterRow)
+			}
+			for n, row := range dst.rows {
+				if row[1] != "moving" || row[2] != strconv.Itoa(tt.afterRow+n) {
+					t.Fatalf("row %d = %v, want message %d of moving isu", n, row[1:], tt.afterRow+n)
+				}
+			}
+		})
+	}
+}
+
+func TestMoveIsusBetweenShardsRetry(t *testing.T) {
+	columns := []string{"jia_isu_uuid", "message"}
+	defer func(prev []shardedTable) { shardedTables = prev }(shardedTables)
+	shardedTables = []shardedTable{{Name: "isu_condition", Columns: columns}}
+
+	src := &fakeShardTable{columns: columns}
+	for n := 0; n < 10; n++ {
+		src.add("moving", strconv.Itoa(n))
+		src.add("staying", strconv.Itoa(n))
+	}
+	// 配置を書き換える前に失敗した移動で，途中まで複製された行
+	dst := &fakeShardTable{columns: columns}
+	for n := 0; n < 4; n++ {
+		dst.add("moving", strconv.Itoa(n))
+	}
+	dst.add("other", "0")
+
+	primaryDB := openFakeShard(t, "retry-primary", &fakeShardTable{})
+	srcShard := &conditionShard{ID: "src", DB: openFakeShard(t, "retry-src", src)}
+	dstShard := &conditionShard{ID: "dst", DB: openFakeShard(t, "retry-dst", dst)}
+	err := moveIsusBetweenShards(primaryDB, srcShard, dstShard, []string{"moving"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]int{}
+	for _, row := range dst.rows {
+		got[fmt.Sprint(row[1:])]++
+	}
+	if len(got) != 11 || len(dst.rows) != 11 || got["[other 0]"] != 1 {
+		t.Fatalf("dst rows = %v, want 10 moved rows and the other row without duplicates", dst.rows)
+	}
+	for _, row := range src.rows {
+		if row[1] != "staying" {
+			t.Fatalf("src still has %v", row[1:])
+		}
+	}
+}
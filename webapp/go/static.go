@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	contentEncodingBrotli = "br"
+
+	frontendIndexFile = "index.html"
+
+	// SPA のルートで返す index.html は，デプロイ後すぐに新しいアセットを参照するよう短くキャッシュさせる
+	frontendIndexCacheControl = "public, max-age=60"
+	// ファイル名にハッシュを含むアセットは中身が変わらない
+	frontendHashedAssetCacheControl = "public, max-age=31536000, immutable"
+	frontendAssetCacheControl       = "public, max-age=3600"
+
+	// これより小さいファイルは圧縮しても効果がない
+	staticAssetMinCompressSize = 256
+)
+
+var (
+	// go build -tags embed_frontend でビルドした場合に，バイナリに埋め込んだフロントエンド
+	embeddedFrontend fs.FS
+
+	frontendAssets *staticAssets
+
+	// vite がファイル名に付けるハッシュ (例: index.23dac98b.js)
+	hashedAssetNamePattern = regexp.MustCompile(`\.[0-9a-f]{8,}\.[0-9A-Za-z]+$`)
+)
+
+// 配信するファイルの中身
+// Content-Encoding 毎に ETag を持つ
+type staticAssetVariant struct {
+	Data []byte
+	ETag string
+}
+
+type staticAsset struct {
+	ContentType  string
+	CacheControl string
+	ModTime      time.Time
+	Variants     map[string]*staticAssetVariant // Content-Encoding 毎の中身．無圧縮は identity
+}
+
+// 起動時に読み込んだフロントエンドのファイル
+// 入れ替えた場合はアプリケーションを再起動する
+type staticAssets struct {
+	assets map[string]*staticAsset
+}
+
+func newStaticAssetVariant(data []byte, encoding string) *staticAssetVariant {
+	sum := sha256.Sum256(data)
+	etag := hex.EncodeToString(sum[:8])
+	if encoding != contentEncodingIdentity {
+		etag += "-" + encoding
+	}
+	return &staticAssetVariant{Data: data, ETag: strconv.Quote(etag)}
+}
+
+// 圧縮すると小さくなる形式か
+func isCompressibleContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/javascript", "application/json", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = gw.Write(data); err != nil {
+		return nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// フロントエンドのファイルを全て読み込む
+// ビルド時に作られた .br と .gz はそのファイルの圧縮済みの中身として扱い，
+// .gz がない場合は圧縮が効く形式のものをここで gzip する
+func loadStaticAssets(fsys fs.FS) (*staticAssets, error) {
+	names := map[string]bool{}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			names[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sa := &staticAssets{assets: map[string]*staticAsset{}}
+	for name := range names {
+		if ext := path.Ext(name); (ext == ".br" || ext == ".gz") && names[strings.TrimSuffix(name, ext)] {
+			continue
+		}
+
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		cacheControl := frontendAssetCacheControl
+		switch {
+		case name == frontendIndexFile:
+			cacheControl = frontendIndexCacheControl
+		case hashedAssetNamePattern.MatchString(name):
+			cacheControl = frontendHashedAssetCacheControl
+		}
+
+		asset := &staticAsset{
+			ContentType:  contentType,
+			CacheControl: cacheControl,
+			ModTime:      info.ModTime(),
+			Variants: map[string]*staticAssetVariant{
+				contentEncodingIdentity: newStaticAssetVariant(data, contentEncodingIdentity),
+			},
+		}
+		for encoding, ext := range map[string]string{contentEncodingBrotli: ".br", contentEncodingGzip: ".gz"} {
+			if !names[name+ext] {
+				continue
+			}
+			compressed, err := fs.ReadFile(fsys, name+ext)
+			if err != nil {
+				return nil, err
+			}
+			asset.Variants[encoding] = newStaticAssetVariant(compressed, encoding)
+		}
+		if _, ok := asset.Variants[contentEncodingGzip]; !ok &&
+			len(data) >= staticAssetMinCompressSize && isCompressibleContentType(contentType) {
+			compressed, err := gzipBytes(data)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compress %v: %v", name, err)
+			}
+			if len(compressed) < len(data) {
+				asset.Variants[contentEncodingGzip] = newStaticAssetVariant(compressed, contentEncodingGzip)
+			}
+		}
+		sa.assets[name] = asset
+	}
+
+	if _, ok := sa.assets[frontendIndexFile]; !ok {
+		return nil, fmt.Errorf("not found: %v", frontendIndexFile)
+	}
+	return sa, nil
+}
+
+// 埋め込んだフロントエンドがあればそれを，なければ frontendContentsPath のファイルを読み込む
+func loadFrontendAssets() (*staticAssets, error) {
+	fsys := embeddedFrontend
+	if fsys == nil {
+		fsys = os.DirFS(frontendContentsPath)
+	}
+	return loadStaticAssets(fsys)
+}
+
+// Accept-Encoding から，クライアントが受け付ける Content-Encoding の q 値を読み取る
+func parseAcceptEncoding(header string) map[string]float64 {
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if encoding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[encoding] = q
+	}
+	return accepted
+}
+
+// 返す中身を選ぶ．br，gzip，無圧縮の順に優先する
+func (a *staticAsset) negotiate(acceptEncoding string) (string, *staticAssetVariant) {
+	accepted := parseAcceptEncoding(acceptEncoding)
+	for _, encoding := range []string{contentEncodingBrotli, contentEncodingGzip} {
+		variant, ok := a.Variants[encoding]
+		if !ok {
+			continue
+		}
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return encoding, variant
+		}
+	}
+	return contentEncodingIdentity, a.Variants[contentEncodingIdentity]
+}
+
+// ファイルを返す
+// If-None-Match や If-Modified-Since が一致する場合は 304 を返す
+func (sa *staticAssets) serve(c echo.Context, name string) error {
+	asset, ok := sa.assets[name]
+	if !ok {
+		return echo.ErrNotFound
+	}
+
+	req := c.Request()
+	res := c.Response()
+	encoding, variant := asset.negotiate(req.Header.Get(echo.HeaderAcceptEncoding))
+	header := res.Header()
+	header.Set(echo.HeaderContentType, asset.ContentType)
+	header.Set("Cache-Control", asset.CacheControl)
+	header.Set("ETag", variant.ETag)
+	if len(asset.Variants) > 1 {
+		header.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	}
+	if encoding != contentEncodingIdentity {
+		header.Set(echo.HeaderContentEncoding, encoding)
+	}
+	http.ServeContent(res, req, name, asset.ModTime, bytes.NewReader(variant.Data))
+	return nil
+}
+
+func getIndex(c echo.Context) error {
+	return frontendAssets.serve(c, frontendIndexFile)
+}
+
+// GET /assets/*
+func getFrontendAsset(c echo.Context) error {
+	name, err := url.PathUnescape(c.Param("*"))
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	return frontendAssets.serve(c, path.Join("assets", path.Clean("/"+name)))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	isuTagMaxLength = 64
+	isuTagMaxCount  = 20
+
+	auditActionUpdateIsuTag = "update_isu_tag"
+)
+
+var (
+	// 照合順序で同じとみなされるタグが含まれていた
+	errIsuTagDuplicated = errors.New("bad format: tags")
+)
+
+type PutIsuTagRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type TagResponse struct {
+	Tag      string `json:"tag"`
+	IsuCount int    `json:"isu_count"`
+}
+
+// タグを正規化し，重複を除いて並べる
+// 一覧の絞り込みでカンマ区切りにするため，カンマを含むものは使えない
+// DBでは大文字と小文字を区別しないので，それだけが違うものは重複とする
+// 大文字と小文字の違いだけのタグはここでまとめる
+// アクセントの有無など，それ以外に照合順序で同じとみなされるものは保存時の重複エラーで弾く
+func normalizeIsuTags(tags []string, maxCount int) ([]string, error) {
+	seen := map[string]struct{}{}
+	res := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || utf8.RuneCountInString(tag) > isuTagMaxLength || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("bad format: tags")
+		}
+		key := strings.ToLower(tag)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		res = append(res, tag)
+	}
+	if len(res) > maxCount {
+		return nil, fmt.Errorf("bad format: tags")
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// 照合順序で同じとみなされるタグを保存しようとした
+func isDuplicateTagError(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == uint16(mysqlErrNumDuplicateEntry)
+}
+
+// ユーザーのISUのタグを取得
+func getIsuTagsByUser(db *sqlx.DB, jiaUserID string) (map[string][]string, error) {
+	rows := []struct {
+		JIAIsuUUID string `db:"jia_isu_uuid"`
+		Tag        string `db:"tag"`
+	}{}
+	err := db.Select(&rows,
+		"SELECT t.`jia_isu_uuid`, t.`tag` FROM `isu_tag` t INNER JOIN `isu` i ON t.`jia_isu_uuid` = i.`jia_isu_uuid`"+
+			"	WHERE i.`jia_user_id` = ? ORDER BY t.`jia_isu_uuid`, t.`tag`",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	res := map[string][]string{}
+	for _, row := range rows {
+		res[row.JIAIsuUUID] = append(res[row.JIAIsuUUID], row.Tag)
+	}
+	return res, nil
+}
+
+func getIsuTags(db sqlx.Queryer, jiaIsuUUID string) ([]string, error) {
+	tags := []string{}
+	err := sqlx.Select(db, &tags, "SELECT `tag` FROM `isu_tag` WHERE `jia_isu_uuid` = ? ORDER BY `tag`", jiaIsuUUID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return tags, nil
+}
+
+// 指定した全てのタグを持つISUに絞り込むSQLの条件
+func isuTagCondition(tags []string) (string, []interface{}) {
+	args := make([]interface{}, 0, len(tags)+1)
+	for _, tag := range tags {
+		args = append(args, tag)
+	}
+	args = append(args, len(tags))
+	return "`jia_isu_uuid` IN (SELECT `jia_isu_uuid` FROM `isu_tag` WHERE `tag` IN (?" + strings.Repeat(", ?", len(tags)-1) + ")" +
+		" GROUP BY `jia_isu_uuid` HAVING COUNT(*) = ?)", args
+}
+
+// GET /api/tag
+// 自分のISUに付いているタグを，付いているISUの数と共に取得
+func getTags(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	res := []TagResponse{}
+	err = readDB(c, db).Select(&res,
+		"SELECT t.`tag` AS `tag`, COUNT(*) AS `isu_count` FROM `isu_tag` t"+
+			"	INNER JOIN `isu` i ON t.`jia_isu_uuid` = i.`jia_isu_uuid`"+
+			"	WHERE i.`jia_user_id` = ? GROUP BY t.`tag` ORDER BY t.`tag`",
+		jiaUserID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// GET /api/isu/:jia_isu_uuid/tag
+// ISUのタグを取得
+func getIsuTag(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	readerDB := readDB(c, db)
+
+	var isuID int
+	err = readerDB.Get(&isuID, "SELECT `id` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ?",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	tags, err := getIsuTags(readerDB, jiaIsuUUID)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, tags)
+}
+
+// PUT /api/isu/:jia_isu_uuid/tag
+// ISUのタグを置き換える
+func putIsuTag(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	jiaIsuUUID := c.Param("jia_isu_uuid")
+	setAuditTarget(c, jiaUserID, jiaIsuUUID)
+
+	var req PutIsuTagRequest
+	err = c.Bind(&req)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad request body")
+	}
+	tags, err := normalizeIsuTags(req.Tags, isuTagMaxCount)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	setAuditDetail(c, strings.Join(tags, ","))
+
+	tx, err := db.Beginx()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var isuID int
+	err = tx.Get(&isuID, "SELECT `id` FROM `isu` WHERE `jia_user_id` = ? AND `jia_isu_uuid` = ? FOR UPDATE",
+		jiaUserID, jiaIsuUUID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: isu")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	_, err = tx.Exec("DELETE FROM `isu_tag` WHERE `jia_isu_uuid` = ?", jiaIsuUUID)
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT INTO `isu_tag` (`jia_isu_uuid`, `tag`) VALUES (?, ?)", jiaIsuUUID, tag)
+		if err != nil {
+			if isDuplicateTagError(err) {
+				return c.String(http.StatusBadRequest, errIsuTagDuplicated.Error())
+			}
+
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, tags)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	trendHistoryDefaultRange = time.Hour * 24
+	trendHistoryMaxRange     = time.Hour * 24 * 7
+)
+
+type TrendSummaryResponse struct {
+	Character    string `json:"character"`
+	Info         int    `json:"info"`
+	Warning      int    `json:"warning"`
+	Critical     int    `json:"critical"`
+	AverageScore int    `json:"average_score"`
+}
+
+type TrendHistoryResponse struct {
+	StartAt    int64                    `json:"start_at"`
+	EndAt      int64                    `json:"end_at"`
+	Characters []*TrendHistoryCharacter `json:"characters"`
+}
+
+type TrendHistoryCharacter struct {
+	Character string `json:"character"`
+	Info      int    `json:"info"`
+	Warning   int    `json:"warning"`
+	Critical  int    `json:"critical"`
+}
+
+type trendHistoryRow struct {
+	JIAIsuUUID string    `db:"jia_isu_uuid"`
+	Character  string    `db:"-"`
+	Hour       time.Time `db:"hour"`
+	Condition  string    `db:"condition"`
+	Count      int       `db:"count"`
+}
+
+// 性格毎の最新のコンディションをレベル毎の件数と平均スコアに集計
+// スコアはグラフのスコアと同じ尺度で計算する
+func summarizeTrend(profile *ScoringProfile, trend TrendResponse) TrendSummaryResponse {
+	res := TrendSummaryResponse{
+		Character: trend.Character,
+		Info:      len(trend.Info),
+		Warning:   len(trend.Warning),
+		Critical:  len(trend.Critical),
+	}
+
+	total := res.Info + res.Warning + res.Critical
+	if total > 0 {
+		rawScore := res.Info*profile.Scores.Info + res.Warning*profile.Scores.Warning + res.Critical*profile.Scores.Critical
+		res.AverageScore = profile.score(rawScore, total)
+	}
+
+	return res
+}
+
+// GET /api/trend/history
+// 性格毎のコンディションレベルの分布を1時間毎に取得
+// 全てのシャードのコンディションを集計するため，サインインしたユーザーにのみ返す
+func getTrendHistory(c echo.Context) error {
+	_, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	character := c.QueryParam("character")
+
+	until := time.Now()
+	if untilStr := c.QueryParam("until"); untilStr != "" {
+		untilInt64, err := strconv.ParseInt(untilStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: until")
+		}
+		until = time.Unix(untilInt64, 0)
+	}
+
+	since := until.Add(-trendHistoryDefaultRange)
+	if sinceStr := c.QueryParam("since"); sinceStr != "" {
+		sinceInt64, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: since")
+		}
+		since = time.Unix(sinceInt64, 0)
+	}
+	since = since.Truncate(time.Hour)
+
+	if !since.Before(until) {
+		return c.String(http.StatusBadRequest, "bad request: since must be before until")
+	}
+	if until.Sub(since) > trendHistoryMaxRange {
+		return c.String(http.StatusBadRequest, "bad request: range too large")
+	}
+
+	// 全てのユーザーのISUを集計するので，デプロイメント全体の設定を使う
+	profile, errStatusCode, err := scoringProfileForRequest(c, "")
+	if err != nil {
+		return c.String(errStatusCode, err.Error())
+	}
+
+	rows, err := selectTrendHistoryRows(since, until, character)
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	distributions := map[int64]map[string]*TrendHistoryCharacter{}
+	for _, row := range rows {
+		conditionLevel, err := profile.conditionLevel(row.Condition)
+		if err != nil {
+			continue
+		}
+
+		hour := row.Hour.Unix()
+		if _, ok := distributions[hour]; !ok {
+			distributions[hour] = map[string]*TrendHistoryCharacter{}
+		}
+		distribution, ok := distributions[hour][row.Character]
+		if !ok {
+			distribution = &TrendHistoryCharacter{Character: row.Character}
+			distributions[hour][row.Character] = distribution
+		}
+
+		switch conditionLevel {
+		case conditionLevelInfo:
+			distribution.Info += row.Count
+		case conditionLevelWarning:
+			distribution.Warning += row.Count
+		case conditionLevelCritical:
+			distribution.Critical += row.Count
+		}
+	}
+
+	res := []TrendHistoryResponse{}
+	for thisTime := since; thisTime.Before(until); thisTime = thisTime.Add(time.Hour) {
+		characters := []*TrendHistoryCharacter{}
+		for _, distribution := range distributions[thisTime.Unix()] {
+			characters = append(characters, distribution)
+		}
+		sort.Slice(characters, func(i, j int) bool {
+			return characters[i].Character < characters[j].Character
+		})
+
+		res = append(res, TrendHistoryResponse{
+			StartAt:    thisTime.Unix(),
+			EndAt:      thisTime.Add(time.Hour).Unix(),
+			Characters: characters,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// 期間内のコンディションをISU・時間帯・コンディションの文字列毎に数える
+// コンディションはシャードに分かれているため，ISUの性格はプライマリから引いて付け加える
+// コンディションの文字列は高々8種類しかないため，文字列毎に集計してからレベルを計算する
+// 期間の絞り込みには `jia_isu_uuid_timestamp` インデックスを使う
+func selectTrendHistoryRows(since time.Time, until time.Time, character string) ([]trendHistoryRow, error) {
+	query := "SELECT `jia_isu_uuid`, `character` FROM `isu` WHERE `character` <> ''"
+	args := []interface{}{}
+	if character != "" {
+		query += " AND `character` = ?"
+		args = append(args, character)
+	}
+	isus := []Isu{}
+	err := db.Select(&isus, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	characters := map[string]string{}
+	jiaIsuUUIDs := make([]string, 0, len(isus))
+	for _, isu := range isus {
+		characters[isu.JIAIsuUUID] = isu.Character
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+
+	rows := []trendHistoryRow{}
+	shards, groups := conditionShards.Group(jiaIsuUUIDs)
+	for i, shard := range shards {
+		query, args, err := sqlx.In(
+			"SELECT `jia_isu_uuid`,"+
+				"	CAST(DATE_FORMAT(`timestamp`, '%Y-%m-%d %H:00:00') AS DATETIME) AS `hour`,"+
+				"	`condition`, COUNT(*) AS `count`"+
+				"	FROM `isu_condition`"+
+				"	WHERE `jia_isu_uuid` IN (?) AND ? <= `timestamp` AND `timestamp` < ?"+
+				"	GROUP BY `jia_isu_uuid`, `hour`, `condition`",
+			groups[i], since, until)
+		if err != nil {
+			return nil, err
+		}
+		shardRows := []trendHistoryRow{}
+		err = shard.DB.Select(&shardRows, query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+		for _, row := range shardRows {
+			row.Character = characters[row.JIAIsuUUID]
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
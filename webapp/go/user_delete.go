@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	auditActionDeleteUser = "delete_user"
+
+	deletedUserActorPrefix = "deleted:"
+)
+
+// ユーザーを削除するときに，ISUに紐づく行を消すプライマリのテーブル
+// `isu_shard` はシャード上の行を消してから消す
+var userIsuTables = []string{
+	"isu_latest_condition",
+	"isu_connectivity",
+	"isu_connectivity_event",
+	"isu_maintenance",
+	"isu_activation",
+	"isu_shard",
+	"isu_tag",
+	"isu_group_isu",
+}
+
+// 削除したユーザーの操作履歴に残す仮名
+// 同じユーザーの操作であることは分かるが，元のIDには戻せない
+func deletedUserActor(jiaUserID string) string {
+	sum := sha256.Sum256([]byte(jiaUserID))
+	return deletedUserActorPrefix + hex.EncodeToString(sum[:8])
+}
+
+// ユーザーと所有する全てのISUのデータを削除する
+// 操作履歴は残すが，操作者や操作対象のユーザーIDを仮名に置き換え，IPアドレスとUser-Agentを消す
+// 削除したISUは deactivate を待つISUとして登録し，削除したISUのIDを返す
+func deleteUserData(jiaUserID string, now time.Time) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	jiaIsuUUIDs := []string{}
+	err = tx.Select(&jiaIsuUUIDs, "SELECT `jia_isu_uuid` FROM `isu` WHERE `jia_user_id` = ? FOR UPDATE", jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	// シャードへの書き込みと同じく，プライマリより先にシャードをコミットする
+	ownedShardTxs := []*sqlx.Tx{}
+	defer func() {
+		for _, shardTx := range ownedShardTxs {
+			shardTx.Rollback()
+		}
+	}()
+	if len(jiaIsuUUIDs) > 0 {
+		shards, groups := conditionShards.Group(jiaIsuUUIDs)
+		for i, shard := range shards {
+			shardTx, owned, err := shard.beginTx(tx)
+			if err != nil {
+				return nil, err
+			}
+			if owned {
+				ownedShardTxs = append(ownedShardTxs, shardTx)
+			}
+			for _, table := range shardedTables {
+				err = deleteIsuRows(shardTx, table.Name, groups[i])
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		for _, table := range userIsuTables {
+			err = deleteIsuRows(tx, table, jiaIsuUUIDs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = insertPendingIsuDeactivations(tx, jiaIsuUUIDs, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM `isu` WHERE `jia_user_id` = ?", jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec(
+		"DELETE c FROM `user_export_chunk` c INNER JOIN `user_export` e ON c.`user_export_id` = e.`id`"+
+			"	WHERE e.`jia_user_id` = ?",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	_, err = tx.Exec(
+		"DELETE t FROM `isu_group_tag` t INNER JOIN `isu_group` g ON t.`group_id` = g.`id`"+
+			"	WHERE g.`jia_user_id` = ?",
+		jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	for _, table := range []string{"isu_group", "scoring_profile", "user_export", "user_disabled", "user"} {
+		_, err = tx.Exec("DELETE FROM `"+table+"` WHERE `jia_user_id` = ?", jiaUserID)
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+	}
+	_, err = tx.Exec("UPDATE `audit_log` SET `actor` = ?, `ip` = '', `user_agent` = '' WHERE `actor` = ?",
+		deletedUserActor(jiaUserID), jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	// 管理者による無効化・有効化の履歴は対象のユーザーIDを detail に持つので，同じ仮名に置き換える
+	_, err = tx.Exec("UPDATE `audit_log` SET `detail` = ? WHERE `action` IN (?, ?) AND `detail` = ?",
+		deletedUserActor(jiaUserID), auditActionAdminDisableUser, auditActionAdminEnableUser, jiaUserID)
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+
+	for _, shardTx := range ownedShardTxs {
+		err = shardTx.Commit()
+		if err != nil {
+			return nil, fmt.Errorf("db error: %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("db error: %v", err)
+	}
+	return jiaIsuUUIDs, nil
+}
+
+func deleteIsuRows(tx *sqlx.Tx, table string, jiaIsuUUIDs []string) error {
+	query, args, err := sqlx.In("DELETE FROM `"+table+"` WHERE `jia_isu_uuid` IN (?)", jiaIsuUUIDs)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// DELETE /api/user/me
+// サインインしている自分自身と所有する全てのISUを削除し，JIAにISUの deactivate を依頼する
+func deleteMe(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setAuditTarget(c, deletedUserActor(jiaUserID), "")
+
+	jiaIsuUUIDs, err := deleteUserData(jiaUserID, time.Now())
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	latestConditions.Delete(jiaIsuUUIDs)
+	scoringProfiles.Forget(jiaUserID)
+	notifyDeactivationWorker()
+	setAuditDetail(c, fmt.Sprintf("deleted %d isu", len(jiaIsuUUIDs)))
+
+	session, err := getSession(c.Request())
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	session.Options = &sessions.Options{MaxAge: -1, Path: "/"}
+	err = session.Save(c.Request(), c.Response())
+	if err != nil {
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,761 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	userExportStatusPending    = "pending"
+	userExportStatusProcessing = "processing"
+	userExportStatusDone       = "done"
+	userExportStatusFailed     = "failed"
+
+	userExportWorkerInterval = time.Second
+	userExportBatchSize      = 5
+	userExportLease          = time.Minute * 10 // 処理中のエクスポートを他のアプリケーションサーバーが重複して処理しないための猶予
+	userExportExpiry         = time.Hour * 24
+	userExportChunkSize      = 1024 * 1024 // `max_allowed_packet` に収まるよう分割して保存する
+	userExportErrorMaxLength = 1024
+)
+
+var (
+	// エクスポートが要求されたことをワーカーに知らせる
+	userExportWakeup = make(chan struct{}, 1)
+
+	// 処理している間に期限が切れ，他のアプリケーションサーバーが処理を引き継いだ
+	errUserExportLeaseLost = errors.New("lease of user export was lost")
+)
+
+// ユーザーのデータをまとめたZIPファイル
+// 全てのアプリケーションサーバーからダウンロードできるよう，中身は `user_export_chunk` に分割して保存する
+type UserExport struct {
+	ID             int64          `db:"id"`
+	JIAUserID      string         `db:"jia_user_id"`
+	Status         string         `db:"status"`
+	Size           int64          `db:"size"`
+	Error          sql.NullString `db:"error"`
+	LeaseExpiresAt sql.NullTime   `db:"lease_expires_at"`
+	CreatedAt      time.Time      `db:"created_at"`
+	CompletedAt    sql.NullTime   `db:"completed_at"`
+}
+
+type UserExportResponse struct {
+	ID          int64   `json:"id"`
+	Status      string  `json:"status"`
+	RequestedAt int64   `json:"requested_at"`
+	CompletedAt *int64  `json:"completed_at"`
+	ExpiresAt   *int64  `json:"expires_at"`
+	Size        *int64  `json:"size"`
+	DownloadURL *string `json:"download_url"`
+	Error       *string `json:"error"`
+}
+
+func (e *UserExport) toResponse() UserExportResponse {
+	res := UserExportResponse{
+		ID:          e.ID,
+		Status:      e.Status,
+		RequestedAt: e.CreatedAt.Unix(),
+	}
+	if e.CompletedAt.Valid {
+		completedAt := e.CompletedAt.Time.Unix()
+		res.CompletedAt = &completedAt
+	}
+	if e.Status == userExportStatusDone {
+		expiresAt := e.expiresAt().Unix()
+		size := e.Size
+		downloadURL := fmt.Sprintf("/api/user/export/%d", e.ID)
+		res.ExpiresAt = &expiresAt
+		res.Size = &size
+		res.DownloadURL = &downloadURL
+	}
+	if e.Error.Valid {
+		exportError := e.Error.String
+		res.Error = &exportError
+	}
+	return res
+}
+
+func (e *UserExport) expiresAt() time.Time {
+	return e.CreatedAt.Add(userExportExpiry)
+}
+
+// 作り直さずにそのまま返せるか
+func (e *UserExport) reusable(now time.Time) bool {
+	switch e.Status {
+	case userExportStatusPending, userExportStatusProcessing:
+		return true
+	case userExportStatusDone:
+		return now.Before(e.expiresAt())
+	}
+	return false
+}
+
+// エクスポートに含めるISU
+type userExportIsu struct {
+	ID         int      `json:"id"`
+	JIAIsuUUID string   `json:"jia_isu_uuid"`
+	Name       string   `json:"name"`
+	Character  string   `json:"character"`
+	Tags       []string `json:"tags"`
+	Icon       *string  `json:"icon"` // ZIP内のパス
+	CreatedAt  int64    `json:"created_at"`
+	UpdatedAt  int64    `json:"updated_at"`
+}
+
+type userExportProfile struct {
+	JIAUserID string `json:"jia_user_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type userExportCondition struct {
+	Timestamp int64  `json:"timestamp"`
+	IsSitting bool   `json:"is_sitting"`
+	Condition string `json:"condition"`
+	Message   string `json:"message"`
+}
+
+// 自分で変更したコンディションレベルとスコアの設定の履歴
+// 取り消した版は profile が null になる
+type userExportScoringProfile struct {
+	Version   int64           `json:"version"`
+	Profile   *ScoringProfile `json:"profile"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+type userExportConnectivityEvent struct {
+	JIAIsuUUID     string `json:"jia_isu_uuid"`
+	PreviousStatus string `json:"previous_status"`
+	Status         string `json:"status"`
+	Timestamp      int64  `json:"timestamp"`
+}
+
+// ZIPファイルを `user_export_chunk` に分割して書き込む
+// 書き込む度に処理の期限を延ばし，期限が切れて他に引き継がれていれば書き込まない
+type userExportChunkWriter struct {
+	db     *sqlx.DB
+	export *UserExport
+	seq    int
+	buf    []byte
+	size   int64
+}
+
+func (w *userExportChunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= userExportChunkSize {
+		if err := w.flush(w.buf[:userExportChunkSize]); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[userExportChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// 残りを書き込む
+func (w *userExportChunkWriter) Close() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.flush(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *userExportChunkWriter) flush(data []byte) error {
+	tx, err := w.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	leaseExpiresAt, err := renewUserExportLease(tx, w.export)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO `user_export_chunk` (`user_export_id`, `seq`, `data`) VALUES (?, ?, ?)",
+		w.export.ID, w.seq, data)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	w.export.LeaseExpiresAt = leaseExpiresAt
+	w.seq++
+	w.size += int64(len(data))
+	return nil
+}
+
+// 処理中のエクスポートの期限を延ばす
+// 期限は処理している証として使い，自分が延ばした期限のままの場合のみ延ばせる
+func renewUserExportLease(q sqlx.Execer, export *UserExport) (sql.NullTime, error) {
+	leaseExpiresAt := sql.NullTime{Time: time.Now().Add(userExportLease).Truncate(time.Microsecond), Valid: true}
+	result, err := q.Exec(
+		"UPDATE `user_export` SET `lease_expires_at` = ? WHERE `id` = ? AND `status` = ? AND `lease_expires_at` = ?",
+		leaseExpiresAt, export.ID, userExportStatusProcessing, export.LeaseExpiresAt)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return sql.NullTime{}, errUserExportLeaseLost
+	}
+	return leaseExpiresAt, nil
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v interface{}) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// アイコンの形式に合った拡張子
+func iconFileExtension(image []byte) string {
+	switch http.DetectContentType(image) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	}
+	return ".bin"
+}
+
+// ユーザーのデータをZIPファイルにまとめて保存し，その大きさを返す
+//
+//	profile.json
+//	isus.json
+//	icons/<jia_isu_uuid>.<ext>
+//	conditions/<jia_isu_uuid>.jsonl
+//	quarantined_conditions/<jia_isu_uuid>.jsonl
+//	groups.json
+//	scoring_profiles.json
+//	maintenances.json
+//	connectivity_events.json
+//	audit_log.json
+func buildUserExport(db *sqlx.DB, export *UserExport) (int64, error) {
+	// 途中で止まったものを処理し直す場合に備えて消しておく
+	_, err := db.Exec("DELETE FROM `user_export_chunk` WHERE `user_export_id` = ?", export.ID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+
+	w := &userExportChunkWriter{db: db, export: export}
+	zw := zip.NewWriter(w)
+
+	var profile userExportProfile
+	var createdAt time.Time
+	err = db.Get(&createdAt, "SELECT `created_at` FROM `user` WHERE `jia_user_id` = ?", export.JIAUserID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	profile.JIAUserID = export.JIAUserID
+	profile.CreatedAt = createdAt.Unix()
+	if err = writeZipJSON(zw, "profile.json", profile); err != nil {
+		return 0, err
+	}
+
+	isuList := []Isu{}
+	err = db.Select(&isuList, "SELECT * FROM `isu` WHERE `jia_user_id` = ? ORDER BY `id`", export.JIAUserID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	tags, err := getIsuTagsByUser(db, export.JIAUserID)
+	if err != nil {
+		return 0, err
+	}
+	isus := make([]userExportIsu, 0, len(isuList))
+	jiaIsuUUIDs := make([]string, 0, len(isuList))
+	for _, isu := range isuList {
+		exportIsu := userExportIsu{
+			ID:         isu.ID,
+			JIAIsuUUID: isu.JIAIsuUUID,
+			Name:       isu.Name,
+			Character:  isu.Character,
+			Tags:       tags[isu.JIAIsuUUID],
+			CreatedAt:  isu.CreatedAt.Unix(),
+			UpdatedAt:  isu.UpdatedAt.Unix(),
+		}
+		if len(isu.Image) > 0 {
+			icon := "icons/" + isu.JIAIsuUUID + iconFileExtension(isu.Image)
+			f, err := zw.Create(icon)
+			if err != nil {
+				return 0, err
+			}
+			if _, err = f.Write(isu.Image); err != nil {
+				return 0, err
+			}
+			exportIsu.Icon = &icon
+		}
+		isus = append(isus, exportIsu)
+		jiaIsuUUIDs = append(jiaIsuUUIDs, isu.JIAIsuUUID)
+	}
+	if err = writeZipJSON(zw, "isus.json", isus); err != nil {
+		return 0, err
+	}
+
+	for _, jiaIsuUUID := range jiaIsuUUIDs {
+		// コンディションの少ないISUが続くと書き込みが起きないので，ISU毎にも期限を延ばす
+		export.LeaseExpiresAt, err = renewUserExportLease(db, export)
+		if err != nil {
+			return 0, err
+		}
+		if err = writeUserExportConditions(zw, jiaIsuUUID); err != nil {
+			return 0, err
+		}
+	}
+
+	groups := []IsuGroup{}
+	err = db.Select(&groups, "SELECT * FROM `isu_group` WHERE `jia_user_id` = ? ORDER BY `id`", export.JIAUserID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	groupResponses := make([]*IsuGroupResponse, 0, len(groups))
+	for _, group := range groups {
+		groupRes, err := group.toResponse(db)
+		if err != nil {
+			return 0, err
+		}
+		groupResponses = append(groupResponses, groupRes)
+	}
+	if err = writeZipJSON(zw, "groups.json", groupResponses); err != nil {
+		return 0, err
+	}
+
+	scoringProfileVersions := []ScoringProfileVersion{}
+	err = db.Select(&scoringProfileVersions, "SELECT * FROM `scoring_profile` WHERE `jia_user_id` = ? ORDER BY `id`", export.JIAUserID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	scoringProfileHistory := make([]userExportScoringProfile, 0, len(scoringProfileVersions))
+	for _, v := range scoringProfileVersions {
+		entry, err := v.toEntry()
+		if err != nil {
+			return 0, err
+		}
+		scoringProfileHistory = append(scoringProfileHistory, userExportScoringProfile{
+			Version:   entry.Version,
+			Profile:   entry.Profile,
+			CreatedAt: v.CreatedAt.Unix(),
+		})
+	}
+	if err = writeZipJSON(zw, "scoring_profiles.json", scoringProfileHistory); err != nil {
+		return 0, err
+	}
+
+	maintenances := []*IsuMaintenanceResponse{}
+	connectivityEvents := []userExportConnectivityEvent{}
+	if len(jiaIsuUUIDs) > 0 {
+		query, args, err := sqlx.In("SELECT * FROM `isu_maintenance` WHERE `jia_isu_uuid` IN (?) ORDER BY `id`", jiaIsuUUIDs)
+		if err != nil {
+			return 0, err
+		}
+		rows := []IsuMaintenance{}
+		if err = db.Select(&rows, query, args...); err != nil {
+			return 0, fmt.Errorf("db error: %v", err)
+		}
+		for _, m := range rows {
+			maintenances = append(maintenances, m.toResponse())
+		}
+
+		query, args, err = sqlx.In("SELECT * FROM `isu_connectivity_event` WHERE `jia_isu_uuid` IN (?) ORDER BY `id`", jiaIsuUUIDs)
+		if err != nil {
+			return 0, err
+		}
+		events := []IsuConnectivityEvent{}
+		if err = db.Select(&events, query, args...); err != nil {
+			return 0, fmt.Errorf("db error: %v", err)
+		}
+		for _, event := range events {
+			connectivityEvents = append(connectivityEvents, userExportConnectivityEvent{
+				JIAIsuUUID:     event.JIAIsuUUID,
+				PreviousStatus: event.PreviousStatus,
+				Status:         event.Status,
+				Timestamp:      event.CreatedAt.Unix(),
+			})
+		}
+	}
+	if err = writeZipJSON(zw, "maintenances.json", maintenances); err != nil {
+		return 0, err
+	}
+	if err = writeZipJSON(zw, "connectivity_events.json", connectivityEvents); err != nil {
+		return 0, err
+	}
+
+	auditLogs := []AuditLog{}
+	err = db.Select(&auditLogs, "SELECT * FROM `audit_log` WHERE `actor` = ? ORDER BY `id`", export.JIAUserID)
+	if err != nil {
+		return 0, fmt.Errorf("db error: %v", err)
+	}
+	auditLogResponses := make([]AuditLogResponse, 0, len(auditLogs))
+	for _, l := range auditLogs {
+		auditLogResponses = append(auditLogResponses, l.toResponse())
+	}
+	if err = writeZipJSON(zw, "audit_log.json", auditLogResponses); err != nil {
+		return 0, err
+	}
+
+	if err = zw.Close(); err != nil {
+		return 0, err
+	}
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	return w.size, nil
+}
+
+// ISUの全てのコンディションと隔離されたコンディションを1行1件のJSONで書き込む
+// 件数が多いので，シャードから読みながら書き込む
+func writeUserExportConditions(zw *zip.Writer, jiaIsuUUID string) error {
+	shardDB := conditionShards.Shard(jiaIsuUUID).DB
+
+	f, err := zw.Create("conditions/" + jiaIsuUUID + ".jsonl")
+	if err != nil {
+		return err
+	}
+	rows, err := shardDB.Queryx("SELECT * FROM `isu_condition` WHERE `jia_isu_uuid` = ? ORDER BY `timestamp`, `id`", jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer rows.Close()
+	enc := json.NewEncoder(f)
+	for rows.Next() {
+		var cond IsuCondition
+		if err = rows.StructScan(&cond); err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		err = enc.Encode(userExportCondition{
+			Timestamp: cond.Timestamp.Unix(),
+			IsSitting: cond.IsSitting,
+			Condition: cond.Condition,
+			Message:   cond.Message,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	quarantined := []IsuConditionQuarantine{}
+	err = shardDB.Select(&quarantined, "SELECT * FROM `isu_condition_quarantine` WHERE `jia_isu_uuid` = ? ORDER BY `id`", jiaIsuUUID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if len(quarantined) == 0 {
+		return nil
+	}
+	f, err = zw.Create("quarantined_conditions/" + jiaIsuUUID + ".jsonl")
+	if err != nil {
+		return err
+	}
+	enc = json.NewEncoder(f)
+	for _, q := range quarantined {
+		err = enc.Encode(IsuConditionQuarantineResponse{
+			ID:         q.ID,
+			JIAIsuUUID: q.JIAIsuUUID,
+			Timestamp:  q.Timestamp,
+			IsSitting:  q.IsSitting,
+			Condition:  q.Condition,
+			Message:    q.Message,
+			Reason:     q.Reason,
+			ReceivedAt: q.CreatedAt.Unix(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ワーカーにエクスポートが要求されたことを知らせる
+func notifyUserExportWorker() {
+	select {
+	case userExportWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// 要求されたエクスポートと，処理中のまま猶予が過ぎたエクスポートを処理する
+func processPendingUserExports(ctx context.Context, db *sqlx.DB, now time.Time) error {
+	exportIDs := []int64{}
+	err := db.Select(&exportIDs,
+		"SELECT `id` FROM `user_export`"+
+			"	WHERE `status` = ? OR (`status` = ? AND `lease_expires_at` <= ?)"+
+			"	ORDER BY `id` LIMIT ?",
+		userExportStatusPending, userExportStatusProcessing, now, userExportBatchSize)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	for _, exportID := range exportIDs {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = processPendingUserExport(db, exportID, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func processPendingUserExport(db *sqlx.DB, exportID int64, now time.Time) error {
+	// 複数のアプリケーションサーバーで同時に処理しないよう，処理中にできた場合のみ処理する
+	result, err := db.Exec(
+		"UPDATE `user_export` SET `status` = ?, `lease_expires_at` = ?"+
+			"	WHERE `id` = ? AND (`status` = ? OR (`status` = ? AND `lease_expires_at` <= ?))",
+		userExportStatusProcessing, now.Add(userExportLease),
+		exportID, userExportStatusPending, userExportStatusProcessing, now)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		return nil
+	}
+
+	var export UserExport
+	err = db.Get(&export, "SELECT * FROM `user_export` WHERE `id` = ?", exportID)
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+
+	size, buildErr := buildUserExport(db, &export)
+	if errors.Is(buildErr, errUserExportLeaseLost) {
+		log.Warnf("user export %v was taken over by another server", exportID)
+		return nil
+	}
+	if buildErr != nil {
+		log.Errorf("failed to export user data %v: %v", exportID, buildErr)
+	}
+	return completeUserExport(db, &export, size, buildErr)
+}
+
+// 処理を終えたエクスポートの状態を更新する
+// 期限が切れて他に引き継がれていれば何もしない．失敗した場合は書き込んだ分を消す
+func completeUserExport(db *sqlx.DB, export *UserExport, size int64, buildErr error) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	defer tx.Rollback()
+
+	var result sql.Result
+	if buildErr != nil {
+		result, err = tx.Exec(
+			"UPDATE `user_export` SET `status` = ?, `error` = ?, `completed_at` = ?"+
+				"	WHERE `id` = ? AND `status` = ? AND `lease_expires_at` = ?",
+			userExportStatusFailed, truncateAuditValue(buildErr.Error(), userExportErrorMaxLength), time.Now(),
+			export.ID, userExportStatusProcessing, export.LeaseExpiresAt)
+	} else {
+		result, err = tx.Exec(
+			"UPDATE `user_export` SET `status` = ?, `size` = ?, `completed_at` = ?"+
+				"	WHERE `id` = ? AND `status` = ? AND `lease_expires_at` = ?",
+			userExportStatusDone, size, time.Now(),
+			export.ID, userExportStatusProcessing, export.LeaseExpiresAt)
+	}
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	if affected == 0 {
+		log.Warnf("user export %v was taken over by another server", export.ID)
+		return nil
+	}
+	if buildErr != nil {
+		_, err = tx.Exec("DELETE FROM `user_export_chunk` WHERE `user_export_id` = ?", export.ID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	return nil
+}
+
+// 期限の過ぎたエクスポートを消す
+func deleteExpiredUserExports(db *sqlx.DB, now time.Time) error {
+	exportIDs := []int64{}
+	err := db.Select(&exportIDs, "SELECT `id` FROM `user_export` WHERE `created_at` < ?", now.Add(-userExportExpiry))
+	if err != nil {
+		return fmt.Errorf("db error: %v", err)
+	}
+	for _, exportID := range exportIDs {
+		_, err = db.Exec("DELETE FROM `user_export_chunk` WHERE `user_export_id` = ?", exportID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+		_, err = db.Exec("DELETE FROM `user_export` WHERE `id` = ?", exportID)
+		if err != nil {
+			return fmt.Errorf("db error: %v", err)
+		}
+	}
+	return nil
+}
+
+// 要求されたエクスポートを定期的に処理する
+func runUserExportWorker(db *sqlx.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-userExportWakeup:
+		}
+		now := time.Now()
+		if err := processPendingUserExports(context.Background(), db, now); err != nil {
+			log.Errorf("failed to process pending user exports: %v", err)
+		}
+		if err := deleteExpiredUserExports(db, now); err != nil {
+			log.Errorf("failed to delete expired user exports: %v", err)
+		}
+	}
+}
+
+// GET /api/user/export
+// 自分自身のデータのエクスポートを要求し，その状況を取得
+// 処理中か期限内のエクスポートがあればそれを返す．refresh=true の場合は完了したものを作り直す
+func getUserExport(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	refresh := false
+	if refreshStr := c.QueryParam("refresh"); refreshStr != "" {
+		refresh, err = strconv.ParseBool(refreshStr)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "bad format: refresh")
+		}
+	}
+
+	var export UserExport
+	err = db.Get(&export, "SELECT * FROM `user_export` WHERE `jia_user_id` = ? ORDER BY `id` DESC LIMIT 1", jiaUserID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	found := err == nil
+	inProgress := found && (export.Status == userExportStatusPending || export.Status == userExportStatusProcessing)
+
+	if !found || !export.reusable(time.Now()) || (refresh && !inProgress) {
+		result, err := db.Exec("INSERT INTO `user_export` (`jia_user_id`, `status`) VALUES (?, ?)",
+			jiaUserID, userExportStatusPending)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		exportID, err := result.LastInsertId()
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		err = db.Get(&export, "SELECT * FROM `user_export` WHERE `id` = ?", exportID)
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		notifyUserExportWorker()
+	}
+
+	if export.Status == userExportStatusDone {
+		return c.JSON(http.StatusOK, export.toResponse())
+	}
+	return c.JSON(http.StatusAccepted, export.toResponse())
+}
+
+// GET /api/user/export/:export_id
+// 完了したエクスポートのZIPファイルをダウンロード
+func getUserExportDownload(c echo.Context) error {
+	jiaUserID, errStatusCode, err := getUserIDFromSession(c)
+	if err != nil {
+		if errStatusCode == http.StatusUnauthorized {
+			return c.String(http.StatusUnauthorized, "you are not signed in")
+		}
+
+		c.Logger().Error(err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	exportID, err := strconv.ParseInt(c.Param("export_id"), 10, 64)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "bad format: export_id")
+	}
+
+	var export UserExport
+	err = db.Get(&export, "SELECT * FROM `user_export` WHERE `id` = ? AND `jia_user_id` = ?", exportID, jiaUserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.String(http.StatusNotFound, "not found: export")
+		}
+
+		c.Logger().Errorf("db error: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if !time.Now().Before(export.expiresAt()) {
+		return c.String(http.StatusNotFound, "not found: export")
+	}
+	if export.Status != userExportStatusDone {
+		return c.String(http.StatusConflict, "export is not ready")
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/zip")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"isucondition-export-%d.zip\"", export.ID))
+	res.Header().Set(echo.HeaderContentLength, strconv.FormatInt(export.Size, 10))
+	res.WriteHeader(http.StatusOK)
+
+	// ヘッダーを送った後は失敗してもステータスコードを変えられないので，ログに残して打ち切る
+	for seq := 0; ; seq++ {
+		var data []byte
+		err = db.Get(&data, "SELECT `data` FROM `user_export_chunk` WHERE `user_export_id` = ? AND `seq` = ?", export.ID, seq)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			c.Logger().Errorf("db error: %v", err)
+			return nil
+		}
+		if _, err = res.Write(data); err != nil {
+			return nil
+		}
+	}
+}
@@ -1,9 +1,32 @@
+-- webapp/go/migrations から生成したスキーマ．直接編集しないこと
+-- webapp/go で `go run . migrate schema > ../sql/0_Schema.sql` を実行して生成する
+
+DROP TABLE IF EXISTS `scoring_profile`;
+DROP TABLE IF EXISTS `isu_group_isu`;
+DROP TABLE IF EXISTS `isu_group_tag`;
+DROP TABLE IF EXISTS `isu_group`;
+DROP TABLE IF EXISTS `isu_tag`;
+DROP TABLE IF EXISTS `isu_deactivation`;
+DROP TABLE IF EXISTS `user_export_chunk`;
+DROP TABLE IF EXISTS `user_export`;
+DROP TABLE IF EXISTS `isu_shard`;
+DROP TABLE IF EXISTS `isu_condition_quarantine`;
+DROP TABLE IF EXISTS `condition_message`;
+DROP TABLE IF EXISTS `isu_activation`;
+DROP TABLE IF EXISTS `user_disabled`;
+DROP TABLE IF EXISTS `audit_log`;
+DROP TABLE IF EXISTS `isu_maintenance`;
+DROP TABLE IF EXISTS `isu_connectivity_event`;
+DROP TABLE IF EXISTS `isu_connectivity`;
+DROP TABLE IF EXISTS `isu_latest_condition`;
 DROP TABLE IF EXISTS `isu_association_config`;
+DROP TABLE IF EXISTS `user`;
 DROP TABLE IF EXISTS `isu_condition`;
 DROP TABLE IF EXISTS `isu`;
-DROP TABLE IF EXISTS `user`;
+DROP TABLE IF EXISTS `schema_migrations`;
 
-CREATE TABLE `isu` (
+-- 0001_create_initial_tables
+CREATE TABLE IF NOT EXISTS `isu` (
   `id` bigint AUTO_INCREMENT,
   `jia_isu_uuid` CHAR(36) NOT NULL UNIQUE,
   `name` VARCHAR(255) NOT NULL,
@@ -15,7 +38,7 @@ CREATE TABLE `isu` (
    PRIMARY KEY(`id`)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
-CREATE TABLE `isu_condition` (
+CREATE TABLE IF NOT EXISTS `isu_condition` (
   `id` bigint AUTO_INCREMENT,
   `jia_isu_uuid` CHAR(36) NOT NULL,
   `timestamp` DATETIME NOT NULL,
@@ -26,12 +49,229 @@ CREATE TABLE `isu_condition` (
   PRIMARY KEY(`id`)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
-CREATE TABLE `user` (
+CREATE TABLE IF NOT EXISTS `user` (
   `jia_user_id` VARCHAR(255) PRIMARY KEY,
   `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
 
-CREATE TABLE `isu_association_config` (
+CREATE TABLE IF NOT EXISTS `isu_association_config` (
   `name` VARCHAR(255) PRIMARY KEY,
   `url` VARCHAR(255) NOT NULL UNIQUE
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0002_create_isu_latest_condition
+CREATE TABLE IF NOT EXISTS `isu_latest_condition` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `timestamp` DATETIME NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `updated_at` (`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0003_create_isu_connectivity
+CREATE TABLE IF NOT EXISTS `isu_connectivity` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(16) NOT NULL,
+  `last_ingested_at` DATETIME(6) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `status_last_ingested_at` (`status`, `last_ingested_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_connectivity_event` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `previous_status` VARCHAR(16) NOT NULL,
+  `status` VARCHAR(16) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_isu_uuid_created_at` (`jia_isu_uuid`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0004_create_isu_maintenance
+CREATE TABLE IF NOT EXISTS `isu_maintenance` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `type` VARCHAR(32) NOT NULL,
+  `note` TEXT NOT NULL,
+  `timestamp` DATETIME NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0005_create_audit_log
+CREATE TABLE IF NOT EXISTS `audit_log` (
+  `id` bigint AUTO_INCREMENT,
+  `action` VARCHAR(64) NOT NULL,
+  `actor` VARCHAR(255) NOT NULL,
+  `jia_isu_uuid` VARCHAR(255) NOT NULL,
+  `ip` VARCHAR(64) NOT NULL,
+  `user_agent` VARCHAR(1024) NOT NULL,
+  `result` VARCHAR(16) NOT NULL,
+  `status_code` INT NOT NULL,
+  `detail` TEXT NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `actor_id` (`actor`, `id`),
+  INDEX `jia_isu_uuid_id` (`jia_isu_uuid`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0006_create_user_disabled
+CREATE TABLE IF NOT EXISTS `user_disabled` (
+  `jia_user_id` VARCHAR(255) PRIMARY KEY,
+  `disabled_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0007_create_isu_activation
+CREATE TABLE IF NOT EXISTS `isu_activation` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(32) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_error` TEXT,
+  `next_attempt_at` DATETIME(6) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `status_next_attempt_at` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0008_create_condition_message
+CREATE TABLE IF NOT EXISTS `condition_message` (
+  `id` bigint AUTO_INCREMENT,
+  `message` VARCHAR(255) COLLATE utf8mb4_bin NOT NULL,
+  `tokens` TEXT NOT NULL,
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `message` (`message`),
+  FULLTEXT KEY `tokens` (`tokens`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+ALTER TABLE `isu_condition` ADD INDEX `jia_isu_uuid_message` (`jia_isu_uuid`, `message`);
+
+-- 0009_create_isu_condition_quarantine
+CREATE TABLE IF NOT EXISTS `isu_condition_quarantine` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `timestamp` bigint NOT NULL,
+  `is_sitting` TINYINT(1) NOT NULL,
+  `condition` VARCHAR(255) NOT NULL,
+  `message` VARCHAR(255) NOT NULL,
+  `reason` VARCHAR(32) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_isu_uuid_id` (`jia_isu_uuid`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0010_create_isu_shard
+CREATE TABLE IF NOT EXISTS `isu_shard` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `shard_id` VARCHAR(64) NOT NULL,
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `updated_at` (`updated_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0011_create_user_export
+CREATE TABLE IF NOT EXISTS `user_export` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `status` VARCHAR(32) NOT NULL,
+  `size` bigint NOT NULL DEFAULT 0,
+  `error` TEXT,
+  `lease_expires_at` DATETIME(6),
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `completed_at` DATETIME(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_user_id_id` (`jia_user_id`, `id`),
+  INDEX `status_lease_expires_at` (`status`, `lease_expires_at`),
+  INDEX `created_at` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `user_export_chunk` (
+  `user_export_id` bigint NOT NULL,
+  `seq` INT NOT NULL,
+  `data` MEDIUMBLOB NOT NULL,
+  PRIMARY KEY(`user_export_id`, `seq`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0012_create_isu_deactivation
+CREATE TABLE IF NOT EXISTS `isu_deactivation` (
+  `jia_isu_uuid` CHAR(36) PRIMARY KEY,
+  `status` VARCHAR(32) NOT NULL,
+  `attempts` INT NOT NULL DEFAULT 0,
+  `last_error` TEXT,
+  `next_attempt_at` DATETIME(6) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  INDEX `status_next_attempt_at` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0013_create_isu_tag_and_group
+CREATE TABLE IF NOT EXISTS `isu_tag` (
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  `tag` VARCHAR(64) NOT NULL,
+  PRIMARY KEY(`jia_isu_uuid`, `tag`),
+  INDEX `tag_jia_isu_uuid` (`tag`, `jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_group` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  `updated_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  UNIQUE KEY `jia_user_id_name` (`jia_user_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_group_tag` (
+  `group_id` bigint NOT NULL,
+  `tag` VARCHAR(64) NOT NULL,
+  PRIMARY KEY(`group_id`, `tag`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `isu_group_isu` (
+  `group_id` bigint NOT NULL,
+  `jia_isu_uuid` CHAR(36) NOT NULL,
+  PRIMARY KEY(`group_id`, `jia_isu_uuid`),
+  INDEX `jia_isu_uuid` (`jia_isu_uuid`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0014_create_scoring_profile
+CREATE TABLE IF NOT EXISTS `scoring_profile` (
+  `id` bigint AUTO_INCREMENT,
+  `jia_user_id` VARCHAR(255) NOT NULL DEFAULT '',
+  `definition` TEXT,
+  `created_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6),
+  PRIMARY KEY(`id`),
+  INDEX `jia_user_id_id` (`jia_user_id`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+-- 0015_add_isu_condition_timestamp_index
+ALTER TABLE `isu_condition` ADD INDEX `jia_isu_uuid_timestamp` (`jia_isu_uuid`, `timestamp`);
+
+-- 0016_backfill_isu_shard
+INSERT IGNORE INTO `isu_shard` (`jia_isu_uuid`, `shard_id`) SELECT `jia_isu_uuid`, 'primary' FROM `isu`;
+
+CREATE TABLE IF NOT EXISTS `schema_migrations` (
+  `version` bigint PRIMARY KEY,
+  `name` VARCHAR(255) NOT NULL,
+  `applied_at` DATETIME(6) DEFAULT CURRENT_TIMESTAMP(6)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+INSERT INTO `schema_migrations` (`version`, `name`) VALUES
+  (1, 'create_initial_tables'),
+  (2, 'create_isu_latest_condition'),
+  (3, 'create_isu_connectivity'),
+  (4, 'create_isu_maintenance'),
+  (5, 'create_audit_log'),
+  (6, 'create_user_disabled'),
+  (7, 'create_isu_activation'),
+  (8, 'create_condition_message'),
+  (9, 'create_isu_condition_quarantine'),
+  (10, 'create_isu_shard'),
+  (11, 'create_user_export'),
+  (12, 'create_isu_deactivation'),
+  (13, 'create_isu_tag_and_group'),
+  (14, 'create_scoring_profile'),
+  (15, 'add_isu_condition_timestamp_index'),
+  (16, 'backfill_isu_shard');